@@ -0,0 +1,174 @@
+package mailer
+
+import (
+  "bytes"
+  "crypto/hmac"
+  "crypto/md5"
+  "encoding/hex"
+  "fmt"
+  "os"
+  "strings"
+  "time"
+  "github.com/buchanae/mailer/imap"
+)
+
+func init() {
+  // Authentication is only advertised before the client is authenticated.
+  registerCapabilityFunc(func(f *fake) []string {
+    if f.state != notAuthenticatedState {
+      return nil
+    }
+    caps := []string{"SASL-IR"}
+    for _, mech := range f.authMechs() {
+      caps = append(caps, "AUTH=" + mech)
+    }
+    if f.loginDisabled() {
+      caps = append(caps, "LOGINDISABLED")
+    }
+    return caps
+  })
+}
+
+// authMechs returns the SASL mechanisms available on the connection.
+// Mechanisms which send the password in the clear (PLAIN and LOGIN)
+// follow the same rules as the LOGIN command.
+func (f *fake) authMechs() []string {
+  mechs := []string{"CRAM-MD5"}
+  if !f.loginDisabled() {
+    mechs = append(mechs, "PLAIN", "LOGIN")
+  }
+  return mechs
+}
+
+// Authenticate implements the AUTHENTICATE command (RFC 3501 section 6.2.2),
+// including initial responses from RFC 4959 (SASL-IR).
+func (f *fake) Authenticate(cmd *imap.AuthenticateCommand) {
+  allowed := false
+  for _, mech := range f.authMechs() {
+    if mech == cmd.AuthType {
+      allowed = true
+    }
+  }
+  if !allowed {
+    imap.No(f.w, cmd.Tag, "unsupported authentication mechanism %q", cmd.AuthType)
+    return
+  }
+
+  var ok bool
+  var err error
+
+  switch cmd.AuthType {
+  case "PLAIN":
+    ok, err = f.authPlain(cmd)
+  case "LOGIN":
+    ok, err = f.authLogin(cmd)
+  case "CRAM-MD5":
+    ok, err = f.authCramMD5(cmd)
+  }
+
+  if err == imap.ErrCanceled {
+    imap.Bad(f.w, cmd.Tag, "authentication canceled")
+    return
+  }
+  if err != nil {
+    imap.Bad(f.w, cmd.Tag, "auth error: %v", err)
+    return
+  }
+  if !ok {
+    imap.No(f.w, cmd.Tag, "auth error: invalid username or password")
+    return
+  }
+
+  f.state = authenticatedState
+  imap.CompleteCode(f.w, cmd.Tag, imap.CapabilityCode(f.capabilityList()), "AUTHENTICATE")
+}
+
+// response returns the initial response, if the client sent one,
+// otherwise it sends the challenge and reads the client's response.
+func (f *fake) response(cmd *imap.AuthenticateCommand, challenge string) ([]byte, error) {
+  if cmd.HasInitialResponse {
+    cmd.HasInitialResponse = false
+    return cmd.InitialResponse, nil
+  }
+  return f.d.Challenge([]byte(challenge))
+}
+
+func (f *fake) checkPassword(username, password string) bool {
+  if f.user.NoAuth {
+    return true
+  }
+  return username == f.user.Name && password == f.user.Password
+}
+
+// authPlain implements the PLAIN mechanism from RFC 4616.
+// The response is "authzid NUL authcid NUL passwd".
+func (f *fake) authPlain(cmd *imap.AuthenticateCommand) (bool, error) {
+  resp, err := f.response(cmd, "")
+  if err != nil {
+    return false, err
+  }
+
+  parts := bytes.Split(resp, []byte{0})
+  if len(parts) != 3 {
+    return false, fmt.Errorf("unable to parse PLAIN response")
+  }
+
+  authzid, authcid, passwd := string(parts[0]), string(parts[1]), string(parts[2])
+  // Acting as another user is not supported.
+  if authzid != "" && authzid != authcid {
+    return false, nil
+  }
+  return f.checkPassword(authcid, passwd), nil
+}
+
+// authLogin implements the (obsolete, but widely used) LOGIN mechanism.
+func (f *fake) authLogin(cmd *imap.AuthenticateCommand) (bool, error) {
+  username, err := f.response(cmd, "Username:")
+  if err != nil {
+    return false, err
+  }
+
+  password, err := f.d.Challenge([]byte("Password:"))
+  if err != nil {
+    return false, err
+  }
+  return f.checkPassword(string(username), string(password)), nil
+}
+
+// authCramMD5 implements the CRAM-MD5 mechanism from RFC 2195.
+func (f *fake) authCramMD5(cmd *imap.AuthenticateCommand) (bool, error) {
+  // CRAM-MD5 doesn't have an initial response.
+  if cmd.HasInitialResponse {
+    return false, fmt.Errorf("CRAM-MD5 does not allow an initial response")
+  }
+
+  hostname, err := os.Hostname()
+  if err != nil {
+    hostname = "localhost"
+  }
+  shared := fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), hostname)
+
+  resp, err := f.d.Challenge([]byte(shared))
+  if err != nil {
+    return false, err
+  }
+
+  // The response is "username SP hex-digest".
+  fields := strings.Split(string(resp), " ")
+  if len(fields) != 2 {
+    return false, fmt.Errorf("unable to parse CRAM-MD5 response")
+  }
+  username, digest := fields[0], fields[1]
+
+  if f.user.NoAuth {
+    return true, nil
+  }
+  if username != f.user.Name {
+    return false, nil
+  }
+
+  mac := hmac.New(md5.New, []byte(f.user.Password))
+  mac.Write([]byte(shared))
+  expected := hex.EncodeToString(mac.Sum(nil))
+  return hmac.Equal([]byte(expected), []byte(strings.ToLower(digest))), nil
+}
@@ -3,93 +3,111 @@ package mailer
 import (
   "fmt"
   "io"
-  "bufio"
+  "io/ioutil"
   "net/mail"
+  "net/textproto"
   "mime"
   "strings"
   "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
   "github.com/buchanae/mailer/multipart"
 )
 
-func bodyStructure(r io.Reader) (imap.Bodystructure, error) {
+// bodyStructure builds the body structure of a message. If "extended"
+// is true, extension data is included, as needed by BODYSTRUCTURE.
+// Otherwise, the result is suitable for BODY.
+func bodyStructure(r io.Reader, extended bool) (imap.Bodystructure, error) {
 
   msg, err := mail.ReadMessage(r)
   if err != nil {
     return nil, fmt.Errorf("reading message: %v", err)
   }
 
-  mediaType, _, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
-  if err != nil {
-    return nil, fmt.Errorf("parsing media type: %v", err)
-  }
-
-  var bs imap.Bodystructure
-  switch {
-  case strings.HasPrefix(mediaType, "multipart/"):
-    bs, err = parseMultipart(msg)
-  case strings.HasPrefix(mediaType, "text/"):
-    bs, err = parseSinglepart(msg)
-  default:
-    err = fmt.Errorf("unhandled content type: %q", mediaType)
-  }
-  return bs, err
+  return partStructure(textproto.MIMEHeader(msg.Header), msg.Body, "text/plain", extended)
 }
 
-func parseSinglepart(msg *mail.Message) (*imap.PartStructure, error) {
-
-  ct := msg.Header.Get("Content-Type")
-  mt, params, err := mime.ParseMediaType(ct)
-  if err != nil {
-    return nil, fmt.Errorf("parsing part media type: %v", err)
+// partStructure builds the body structure of an entity (a message or
+// body part), recursing into multipart and message/rfc822 parts.
+// "defaultType" is used when the entity has no Content-Type header,
+// which depends on the parent (e.g. message/rfc822 in multipart/digest).
+func partStructure(h textproto.MIMEHeader, body io.Reader, defaultType string, extended bool) (imap.Bodystructure, error) {
+  typ, subtype, params := contentType(h, defaultType)
+  if typ == "multipart" {
+    return parseMultipart(h, body, subtype, params, extended)
   }
 
-  typ, subtype, err := splitMediaType(mt)
-  if err != nil {
-    return nil, fmt.Errorf("parsing part media type: %v", err)
+  cr := &countReader{R: body}
+  part := imap.PartStructure{
+    Type: typ,
+    Subtype: subtype,
+    Params: params,
+    ID: h.Get("Content-Id"),
+    Description: h.Get("Content-Description"),
+    Encoding: h.Get("Content-Transfer-Encoding"),
+    MD5: h.Get("Content-Md5"),
+    Disposition: disposition(h),
+    Language: language(h),
+    Location: h.Get("Content-Location"),
+    Extended: extended,
   }
-
-  enc := msg.Header.Get("Content-Transfer-Encoding")
-  if enc == "" {
-    enc = "7BIT"
+  if part.Encoding == "" {
+    part.Encoding = "7BIT"
   }
 
-  lines, size, err := countLinesAndSize(msg.Body)
-  if err != nil {
-    return nil, fmt.Errorf("reading part body: %v", err)
-  }
+  if typ == "message" && subtype == "rfc822" {
+    inner, err := mail.ReadMessage(model.DecodeBody(h, cr))
+    if err != nil {
+      return nil, fmt.Errorf("reading encapsulated message: %v", err)
+    }
 
-  return &imap.PartStructure{
-    Type: typ,
-    Subtype: subtype,
-    Params: params,
-    Encoding: enc,
-    Size: size,
-    Lines: lines,
-  }, nil
-}
+    innerHeader := textproto.MIMEHeader(inner.Header)
+    bs, err := partStructure(innerHeader, inner.Body, "text/plain", extended)
+    if err != nil {
+      return nil, err
+    }
 
-func parseMultipart(msg *mail.Message) (*imap.MultipartStructure, error) {
-  mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
-  if err != nil {
-    return nil, fmt.Errorf("parsing media type: %v", err)
-  }
+    // Drain the rest of the part, so the size and lines are complete.
+    _, err = io.Copy(ioutil.Discard, cr)
+    if err != nil {
+      return nil, fmt.Errorf("reading part body: %v", err)
+    }
 
-  _, subtype, err := splitMediaType(mediaType)
-  if err != nil {
-    return nil, fmt.Errorf("parsing media type: %v", err)
+    part.Size = cr.N
+    part.Lines = cr.Lines()
+    return &imap.MessageStructure{
+      PartStructure: part,
+      Envelope: envelope(model.Headers(inner.Header)),
+      Body: bs,
+    }, nil
   }
 
-  boundary, ok := params["boundary"]
-  if !ok {
-    return nil, fmt.Errorf("missing multipart boundary")
+  _, err := io.Copy(ioutil.Discard, cr)
+  if err != nil {
+    return nil, fmt.Errorf("reading part body: %v", err)
   }
+  part.Size = cr.N
+  part.Lines = cr.Lines()
+  return &part, nil
+}
 
+func parseMultipart(h textproto.MIMEHeader, body io.Reader, subtype string, params map[string]string, extended bool) (*imap.MultipartStructure, error) {
   mp := &imap.MultipartStructure{
     Subtype: subtype,
     Params: params,
+    Disposition: disposition(h),
+    Language: language(h),
+    Location: h.Get("Content-Location"),
+    Extended: extended,
   }
 
-  mr := multipart.NewReader(msg.Body, boundary)
+  // The default content type of parts of a multipart/digest
+  // is message/rfc822 (RFC 2046 section 5.1.5).
+  defaultType := "text/plain"
+  if subtype == "digest" {
+    defaultType = "message/rfc822"
+  }
+
+  mr := multipart.NewReader(model.DecodeBody(h, body), params["boundary"])
   for {
     p, err := mr.NextPart()
     if err == io.EOF {
@@ -99,58 +117,92 @@ func parseMultipart(msg *mail.Message) (*imap.MultipartStructure, error) {
       return nil, fmt.Errorf("reading part: %v", err)
     }
 
-    ct := p.Header.Get("Content-Type")
-    mt, params, err := mime.ParseMediaType(ct)
-    if err != nil {
-      return nil, fmt.Errorf("parsing part media type: %v", err)
-    }
-
-    typ, subtype, err := splitMediaType(mt)
-    if err != nil {
-      return nil, fmt.Errorf("parsing part media type: %v", err)
-    }
-
-    enc := p.Header.Get("Content-Transfer-Encoding")
-    if enc == "" {
-      enc = "7BIT"
-    }
-
-    lines, size, err := countLinesAndSize(p)
+    bs, err := partStructure(p.Header, p, defaultType, extended)
     if err != nil {
-      return nil, fmt.Errorf("reading part body: %v", err)
+      return nil, err
     }
-
-    mp.Parts = append(mp.Parts, &imap.PartStructure{
-      Type: typ,
-      Subtype: subtype,
-      Params: params,
-      Encoding: enc,
-      Size: size,
-      Lines: lines,
-    })
+    mp.Parts = append(mp.Parts, bs)
   }
   return mp, nil
 }
 
-func countLinesAndSize(r io.Reader) (lines int, size int, err error) {
-  sr := &sizeReader{R: r}
-  scanner := bufio.NewScanner(sr)
-  for scanner.Scan() {
-    lines++
+// disposition parses the Content-Disposition header, if any.
+func disposition(h textproto.MIMEHeader) *imap.Disposition {
+  cd := h.Get("Content-Disposition")
+  if cd == "" {
+    return nil
   }
-  return lines, sr.N, scanner.Err()
+  typ, params, err := mime.ParseMediaType(cd)
+  if err != nil {
+    return nil
+  }
+  return &imap.Disposition{Type: typ, Params: params}
 }
 
-type sizeReader struct {
+// language parses the Content-Language header (RFC 3282), if any.
+func language(h textproto.MIMEHeader) []string {
+  var langs []string
+  for _, l := range strings.Split(h.Get("Content-Language"), ",") {
+    l = strings.TrimSpace(l)
+    if l != "" {
+      langs = append(langs, l)
+    }
+  }
+  return langs
+}
+
+// countReader counts the bytes and lines read from the underlying reader.
+type countReader struct {
   R io.Reader
   N int
+  newlines int
+  last byte
 }
-func (s *sizeReader) Read(p []byte) (int, error) {
-  n, err := s.R.Read(p)
-  s.N += n
+
+func (c *countReader) Read(p []byte) (int, error) {
+  n, err := c.R.Read(p)
+  for _, b := range p[:n] {
+    if b == '\n' {
+      c.newlines++
+    }
+  }
+  if n > 0 {
+    c.last = p[n-1]
+  }
+  c.N += n
   return n, err
 }
 
+// Lines returns the number of lines read, including
+// a final line which doesn't end with a newline.
+func (c *countReader) Lines() int {
+  if c.N > 0 && c.last != '\n' {
+    return c.newlines + 1
+  }
+  return c.newlines
+}
+
+// contentType parses the Content-Type header of an entity, returning the
+// lowercase type and subtype, e.g. "text" and "plain", and the parameters.
+// "defaultType" is used when the header is missing. As RFC 2045 says,
+// an invalid content type is treated as text/plain. So is a multipart
+// entity without a boundary, since it can't be split into parts.
+func contentType(h textproto.MIMEHeader, defaultType string) (typ, subtype string, params map[string]string) {
+  ct := h.Get("Content-Type")
+  if ct == "" {
+    ct = defaultType
+  }
+
+  mediaType, params, err := mime.ParseMediaType(ct)
+  if err == nil {
+    typ, subtype, err = splitMediaType(mediaType)
+  }
+  if err != nil || (typ == "multipart" && params["boundary"] == "") {
+    return "text", "plain", map[string]string{"charset": "us-ascii"}
+  }
+  return typ, subtype, params
+}
+
 func splitMediaType(raw string) (typ string, subtype string, err error) {
   idx := strings.Index(raw, "/")
   if idx == -1 {
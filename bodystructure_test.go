@@ -0,0 +1,63 @@
+package mailer
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestBodyStructure(t *testing.T) {
+  tests := []struct {
+    desc, msg, expected string
+  }{
+    {
+      "nested multipart",
+      "Content-Type: multipart/mixed; boundary=a\r\n\r\n" +
+        "--a\r\nContent-Type: text/plain\r\n\r\nhello\r\n" +
+        "--a\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n" +
+        "--b\r\n\r\nplain\r\n" +
+        "--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n" +
+        "--b--\r\n--a--\r\n",
+      `(("text" "plain" NIL NIL NIL "7BIT" 5 1)` +
+        `(("text" "plain" NIL NIL NIL "7BIT" 5 1)("text" "html" NIL NIL NIL "7BIT" 11 1) "alternative") "mixed")`,
+    },
+    {
+      "message/rfc822",
+      "Content-Type: message/rfc822\r\n\r\n" +
+        "Subject: inner\r\nFrom: a@example.com\r\n\r\ninner body\r\n",
+      `("message" "rfc822" NIL NIL NIL "7BIT" 51 ` +
+        `(NIL "inner" ((NIL NIL "a" "example.com")) ((NIL NIL "a" "example.com")) ((NIL NIL "a" "example.com")) NIL NIL NIL NIL NIL) ` +
+        `("text" "plain" NIL NIL NIL "7BIT" 12 1) 4)`,
+    },
+    {
+      "content type without a subtype",
+      "Content-Type: text\r\n\r\nhello\r\n",
+      `("text" "plain" ("charset" "us-ascii") NIL NIL "7BIT" 7 1)`,
+    },
+    {
+      "multipart without a boundary",
+      "Content-Type: multipart/mixed\r\n\r\n--a\r\n\r\nhello\r\n--a--\r\n",
+      `("text" "plain" ("charset" "us-ascii") NIL NIL "7BIT" 21 4)`,
+    },
+    {
+      "invalid content type of a part",
+      "Content-Type: multipart/mixed; boundary=a\r\n\r\n" +
+        "--a\r\nContent-Type: ;;;\r\n\r\nhello\r\n--a--\r\n",
+      `(("text" "plain" ("charset" "us-ascii") NIL NIL "7BIT" 5 1) "mixed")`,
+    },
+  }
+
+  for _, test := range tests {
+    bs, err := bodyStructure(strings.NewReader(test.msg), false)
+    if err != nil {
+      t.Errorf("%s: %v", test.desc, err)
+      continue
+    }
+    buf := &bytes.Buffer{}
+    imap.Encode(buf, bs)
+    if buf.String() != test.expected {
+      t.Errorf("%s: unexpected body structure\nexpected: %s\ngot:      %s", test.desc, test.expected, buf.String())
+    }
+  }
+}
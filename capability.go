@@ -0,0 +1,43 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+// capabilities holds the functions registered by each extension, which
+// return the capabilities to advertise to a session. Some capabilities
+// depend on the session, e.g. STARTTLS is only advertised before the
+// connection uses TLS, and AUTH=* only before the client authenticates.
+var capabilities []func(f *fake) []string
+
+// registerCapability registers capabilities which are always advertised.
+func registerCapability(names ...string) {
+  registerCapabilityFunc(func(*fake) []string {
+    return names
+  })
+}
+
+// registerCapabilityFunc registers a function which returns the
+// capabilities to advertise, given the state of the session.
+func registerCapabilityFunc(fn func(f *fake) []string) {
+  capabilities = append(capabilities, fn)
+}
+
+func init() {
+  // Non-synchronizing literals are handled by the command decoder.
+  registerCapability("LITERAL+")
+}
+
+// capabilityList returns the capabilities advertised to the session,
+// not including IMAP4rev1, in the order they were registered.
+func (f *fake) capabilityList() []string {
+  var list []string
+  for _, fn := range capabilities {
+    list = append(list, fn(f)...)
+  }
+  return list
+}
+
+func (f *fake) Capability(cmd *imap.CapabilityCommand) {
+  imap.Capability(f.w, cmd.Tag, f.capabilityList())
+}
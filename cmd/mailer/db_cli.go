@@ -4,7 +4,6 @@ import (
   "github.com/buchanae/cli"
   "github.com/buchanae/mailer/model"
   "github.com/buchanae/mailer"
-  "github.com/buchanae/mailer/imap"
   "github.com/sanity-io/litter"
   "os"
 )
@@ -73,7 +72,7 @@ func CreateMessage(opt Opt, mailbox, path string) {
   fh := openFile(path)
   defer fh.Close()
 
-  _, err := db.CreateMessage(mailbox, fh, []imap.Flag{imap.Recent})
+  _, err := db.CreateMessage(mailbox, fh, nil)
   cli.Check(err)
 }
 
@@ -89,6 +88,13 @@ func ListMailboxes(opt Opt) {
   }
 }
 
+// Rebuild the sort keys and full-text search index from the stored messages.
+func RebuildIndex(opt Opt) {
+  db := initDB(opt.DB)
+  defer db.Close()
+  cli.Check(db.RebuildIndex())
+}
+
 func openFile(path string) *os.File {
   fh, err := os.Open(path)
   cli.Check(err)
@@ -26,6 +26,9 @@ func specs() []cli.Spec {
 		&listMailboxesSpec{
 			opt: DefaultOpt(),
 		},
+		&rebuildIndexSpec{
+			opt: DefaultOpt(),
+		},
 		&runSpec{
 			opt: mailer.DefaultServerOpt(),
 		},
@@ -355,6 +358,42 @@ func (cmd *listMailboxesSpec) Cmd() *cli.Cmd {
 	return cmd.cmd
 }
 
+type rebuildIndexSpec struct {
+	cmd  *cli.Cmd
+	opt  Opt
+	args struct {
+	}
+}
+
+func (cmd *rebuildIndexSpec) Run() {
+	RebuildIndex(
+		cmd.opt,
+	)
+}
+
+func (cmd *rebuildIndexSpec) Cmd() *cli.Cmd {
+	if cmd.cmd != nil {
+		return cmd.cmd
+	}
+	cmd.cmd = &cli.Cmd{
+		RawName: "RebuildIndex",
+		RawDoc:  "Rebuild the sort keys and full-text search index from the stored messages.\n",
+		Args:    []*cli.Arg{},
+		Opts: []*cli.Opt{
+			{
+				Key:          []string{"DB", "Path"},
+				RawDoc:       "",
+				Value:        &cmd.opt.DB.Path,
+				DefaultValue: cmd.opt.DB.Path,
+				Type:         "string",
+				Short:        "",
+			},
+		},
+	}
+	cli.Enrich(cmd.cmd)
+	return cmd.cmd
+}
+
 type runSpec struct {
 	cmd  *cli.Cmd
 	opt  mailer.ServerOpt
@@ -392,10 +431,45 @@ func (cmd *runSpec) Cmd() *cli.Cmd {
 				Type:         "time.Duration",
 				Short:        "",
 			}, {
-				Key:          []string{"IMAP", "Addr"},
+				Key:          []string{"IMAP", "Listeners"},
+				RawDoc:       "Addresses to listen on, e.g. a plaintext listener which offers\nSTARTTLS on port 143, and an implicit TLS listener on port 993.\n",
+				Value:        &cmd.opt.IMAP.Listeners,
+				DefaultValue: cmd.opt.IMAP.Listeners,
+				Type:         "[]github.com/buchanae/mailer.IMAPListenerOpt",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Name"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.Name,
+				DefaultValue: cmd.opt.IMAP.ID.Name,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Version"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.Version,
+				DefaultValue: cmd.opt.IMAP.ID.Version,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Vendor"},
 				RawDoc:       "",
-				Value:        &cmd.opt.IMAP.Addr,
-				DefaultValue: cmd.opt.IMAP.Addr,
+				Value:        &cmd.opt.IMAP.ID.Vendor,
+				DefaultValue: cmd.opt.IMAP.ID.Vendor,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "SupportURL"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.SupportURL,
+				DefaultValue: cmd.opt.IMAP.ID.SupportURL,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "SharedNamespace"},
+				RawDoc:       "Prefix of the shared mailboxes, e.g. \"Shared\", which the NAMESPACE\ncommand reports (RFC 2342). If empty, there's no shared namespace.\n",
+				Value:        &cmd.opt.IMAP.SharedNamespace,
+				DefaultValue: cmd.opt.IMAP.SharedNamespace,
 				Type:         "string",
 				Short:        "",
 			}, {
@@ -491,10 +565,45 @@ func (cmd *runDevSpec) Cmd() *cli.Cmd {
 				Type:         "time.Duration",
 				Short:        "",
 			}, {
-				Key:          []string{"IMAP", "Addr"},
+				Key:          []string{"IMAP", "Listeners"},
+				RawDoc:       "Addresses to listen on, e.g. a plaintext listener which offers\nSTARTTLS on port 143, and an implicit TLS listener on port 993.\n",
+				Value:        &cmd.opt.IMAP.Listeners,
+				DefaultValue: cmd.opt.IMAP.Listeners,
+				Type:         "[]github.com/buchanae/mailer.IMAPListenerOpt",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Name"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.Name,
+				DefaultValue: cmd.opt.IMAP.ID.Name,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Version"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.Version,
+				DefaultValue: cmd.opt.IMAP.ID.Version,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "Vendor"},
+				RawDoc:       "",
+				Value:        &cmd.opt.IMAP.ID.Vendor,
+				DefaultValue: cmd.opt.IMAP.ID.Vendor,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "ID", "SupportURL"},
 				RawDoc:       "",
-				Value:        &cmd.opt.IMAP.Addr,
-				DefaultValue: cmd.opt.IMAP.Addr,
+				Value:        &cmd.opt.IMAP.ID.SupportURL,
+				DefaultValue: cmd.opt.IMAP.ID.SupportURL,
+				Type:         "string",
+				Short:        "",
+			}, {
+				Key:          []string{"IMAP", "SharedNamespace"},
+				RawDoc:       "Prefix of the shared mailboxes, e.g. \"Shared\", which the NAMESPACE\ncommand reports (RFC 2342). If empty, there's no shared namespace.\n",
+				Value:        &cmd.opt.IMAP.SharedNamespace,
+				DefaultValue: cmd.opt.IMAP.SharedNamespace,
 				Type:         "string",
 				Short:        "",
 			}, {
@@ -1,12 +1,51 @@
 package main
 
 import (
+  "encoding/json"
   "github.com/buchanae/cli"
   "github.com/buchanae/mailer"
 )
 
+// main is cli.AutoCobra, with a loader which can also set
+// the list of IMAP listeners (see coerce).
 func main() {
-  cli.AutoCobra("mailer", specs())
+  b := cli.Cobra{}
+  b.Use = "mailer"
+  b.SilenceUsage = true
+
+  for _, spec := range specs() {
+    cmd := b.Add(spec)
+    opts := spec.Cmd().Opts
+    flags := cli.PFlags(cmd.Flags(), opts, cli.DotKey)
+
+    l := cli.NewLoader(opts,
+      cli.Env("mailer"),
+      flags,
+      cli.YAML(cli.DefaultYAML),
+    )
+    l.Coerce = coerce
+    b.SetRunner(cmd, spec, l)
+  }
+  b.Execute()
+}
+
+// coerce is cli.Coerce, which also decodes the IMAP listeners. In a config
+// file, they're a list of objects. In a flag or environment variable, they're
+// JSON, e.g. --imap.listeners '[{"Addr": "localhost:143", "StartTLS": true}]'.
+func coerce(dst, src interface{}) error {
+  if _, ok := dst.(*[]mailer.IMAPListenerOpt); !ok {
+    return cli.Coerce(dst, src)
+  }
+
+  data, ok := src.(string)
+  if !ok {
+    b, err := json.Marshal(src)
+    if err != nil {
+      return err
+    }
+    data = string(b)
+  }
+  return json.Unmarshal([]byte(data), dst)
 }
 
 func Run(opt mailer.ServerOpt) {
@@ -10,7 +10,12 @@ func DefaultDevServerOpt() DevServerOpt {
   // TODO generate certs in temp file?
   // https://golang.org/src/crypto/tls/generate_cert.go
   opt := mailer.DefaultServerOpt()
-  opt.IMAP.Addr = "localhost:9855"
+  opt.IMAP.Listeners = []mailer.IMAPListenerOpt{
+    {
+      Addr: "localhost:9855",
+      AllowPlaintextAuth: true,
+    },
+  }
   opt.SMTP.Addr = "localhost:9856"
   opt.User.NoAuth = true
   opt.User.Name = ""
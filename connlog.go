@@ -1,8 +1,12 @@
 package mailer
 
 import (
+  "fmt"
   "io"
+  "net"
   "os"
+  "sort"
+  "strings"
 )
 
 var connLog io.WriteCloser
@@ -35,6 +39,27 @@ func (cl *connectionLogger) Log(conn io.ReadWriteCloser) io.ReadWriteCloser {
   }
 }
 
+// LogID records the identity a client sent with the ID command (RFC 2971),
+// e.g. "# ID 127.0.0.1:5000: name=Mail version=16.0".
+func (cl *connectionLogger) LogID(addr net.Addr, params map[string]string) {
+  if params == nil {
+    fmt.Fprintf(cl.w, "# ID %s: NIL\n", addr)
+    return
+  }
+
+  var keys []string
+  for k := range params {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  var s []string
+  for _, k := range keys {
+    s = append(s, fmt.Sprintf("%s=%s", k, params[k]))
+  }
+  fmt.Fprintf(cl.w, "# ID %s: %s\n", addr, strings.Join(s, " "))
+}
+
 func (cl *connectionLogger) Close() error {
   return cl.w.Close()
 }
@@ -10,6 +10,10 @@ type Controller interface {
   Check(*imap.CheckCommand)
   Capability(*imap.CapabilityCommand)
   Expunge(*imap.ExpungeCommand)
+  Idle(*imap.IdleCommand)
+  Enable(*imap.EnableCommand)
+  Namespace(*imap.NamespaceCommand)
+  ID(*imap.IDCommand)
 
   Login(*imap.LoginCommand)
   Logout(*imap.LogoutCommand)
@@ -34,13 +38,20 @@ type Controller interface {
   Status(*imap.StatusCommand)
   Fetch(*imap.FetchCommand)
   Search(*imap.SearchCommand)
+  Sort(*imap.SortCommand)
+  Thread(*imap.ThreadCommand)
 
   Copy(*imap.CopyCommand)
+  Move(*imap.MoveCommand)
   Store(*imap.StoreCommand)
   Append(*imap.AppendCommand)
 
   UIDFetch(*imap.FetchCommand)
   UIDStore(*imap.StoreCommand)
   UIDCopy(*imap.CopyCommand)
+  UIDMove(*imap.MoveCommand)
+  UIDExpunge(*imap.UIDExpungeCommand)
   UIDSearch(*imap.SearchCommand)
+  UIDSort(*imap.SortCommand)
+  UIDThread(*imap.ThreadCommand)
 }
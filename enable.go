@@ -0,0 +1,60 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+// enablers maps the extensions which clients can turn on with ENABLE
+// (RFC 5161) to functions which turn them on for the session. Like
+// capabilities, each extension registers itself.
+var enablers = map[string]func(f *fake){}
+
+// registerEnable registers an extension which can be enabled. "fn" is
+// called when the extension is enabled, and may be nil if the session
+// only needs to check whether it's enabled.
+func registerEnable(name string, fn func(f *fake)) {
+  enablers[name] = fn
+}
+
+func init() {
+  registerCapability("ENABLE")
+}
+
+// Enable implements the ENABLE command from RFC 5161. Capabilities which
+// can't be enabled, or are already enabled, are ignored, and aren't
+// listed in the ENABLED response.
+func (f *fake) Enable(cmd *imap.EnableCommand) {
+  // Extensions which are enabled implicitly by another one in the same
+  // command, e.g. CONDSTORE by QRESYNC, are still listed.
+  before := map[string]bool{}
+  for name := range f.enabled {
+    before[name] = true
+  }
+
+  var enabled []string
+  for _, c := range cmd.Capabilities {
+    if _, ok := enablers[c]; !ok || before[c] {
+      continue
+    }
+    f.enable(c)
+    before[c] = true
+    enabled = append(enabled, c)
+  }
+  imap.Enabled(f.w, enabled)
+  imap.Complete(f.w, cmd.Tag, "ENABLE")
+}
+
+// enable turns on the extension for the session. Some commands enable
+// extensions implicitly, e.g. FETCH with MODSEQ enables CONDSTORE.
+func (f *fake) enable(name string) {
+  if f.enabled[name] {
+    return
+  }
+  if f.enabled == nil {
+    f.enabled = map[string]bool{}
+  }
+  f.enabled[name] = true
+  if fn := enablers[name]; fn != nil {
+    fn(f)
+  }
+}
@@ -0,0 +1,172 @@
+package mailer
+
+import (
+  "mime"
+  "net/mail"
+  "strings"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+// envelope builds the ENVELOPE fetch item from the message headers,
+// as described by RFC 3501 section 7.4.2.
+func envelope(h model.Headers) *imap.Envelope {
+  env := &imap.Envelope{
+    Date: h.Get("Date"),
+    Subject: h.Get("Subject"),
+    From: addressList(h.Get("From")),
+    Sender: addressList(h.Get("Sender")),
+    ReplyTo: addressList(h.Get("Reply-To")),
+    To: addressList(h.Get("To")),
+    Cc: addressList(h.Get("Cc")),
+    Bcc: addressList(h.Get("Bcc")),
+    InReplyTo: h.Get("In-Reply-To"),
+    MessageID: h.Get("Message-Id"),
+  }
+
+  // If the Sender or Reply-To lines are absent in the header,
+  // or are present but empty, the server sets the corresponding
+  // member of the envelope to be the same value as the from member.
+  if len(env.Sender) == 0 {
+    env.Sender = env.From
+  }
+  if len(env.ReplyTo) == 0 {
+    env.ReplyTo = env.From
+  }
+  return env
+}
+
+// addressList parses an address list header (e.g. To or Cc)
+// into envelope addresses. Invalid lists are treated as empty.
+//
+// Groups (e.g. "team: a@example.com, b@example.com;") are written
+// with the markers described by RFC 3501: an address with only the group
+// name as the mailbox before the members, and an empty address after them.
+func addressList(raw string) []*imap.Address {
+  if strings.TrimSpace(raw) == "" {
+    return nil
+  }
+
+  var addrs []*imap.Address
+  for _, g := range splitGroups(raw) {
+    if g.group {
+      addrs = append(addrs, &imap.Address{Mailbox: g.name})
+    }
+
+    if strings.TrimSpace(g.list) != "" {
+      list, err := mail.ParseAddressList(g.list)
+      if err != nil {
+        return nil
+      }
+      for _, a := range list {
+        addrs = append(addrs, envelopeAddress(a))
+      }
+    }
+
+    if g.group {
+      addrs = append(addrs, &imap.Address{})
+    }
+  }
+  return addrs
+}
+
+func envelopeAddress(a *mail.Address) *imap.Address {
+  addr := &imap.Address{
+    Name: encodeName(a.Name),
+    Mailbox: a.Address,
+  }
+  if i := strings.LastIndex(a.Address, "@"); i != -1 {
+    addr.Mailbox = a.Address[:i]
+    addr.Host = a.Address[i+1:]
+  }
+  return addr
+}
+
+// addressGroup is part of an address list: either a group,
+// or the addresses between groups.
+type addressGroup struct {
+  group bool
+  name string
+  list string
+}
+
+// splitGroups splits an address list into groups and the addresses
+// between them, in order. Colons, semicolons and commas are ignored
+// in quoted strings, comments and angle brackets.
+func splitGroups(raw string) []addressGroup {
+  var groups []addressGroup
+  // start is the start of the current part,
+  // and item is the start of the current address.
+  start, item := 0, 0
+  inGroup := false
+  name := ""
+  quoted, escaped := false, false
+  comment, angle := 0, 0
+
+  for i := 0; i < len(raw); i++ {
+    c := raw[i]
+    switch {
+    case escaped:
+      escaped = false
+    case c == '\\' && (quoted || comment > 0):
+      escaped = true
+    case quoted:
+      quoted = c != '"'
+    case c == '(':
+      comment++
+    case comment > 0:
+      if c == ')' {
+        comment--
+      }
+    case c == '"':
+      quoted = true
+    case c == '<':
+      angle++
+    case c == '>' && angle > 0:
+      angle--
+    case angle > 0:
+    case c == ',' && !inGroup:
+      item = i + 1
+    case c == ':' && !inGroup:
+      groups = append(groups, addressGroup{list: trimList(raw[start:item])})
+      name = groupName(raw[item:i])
+      inGroup = true
+      start = i + 1
+    case c == ';' && inGroup:
+      groups = append(groups, addressGroup{group: true, name: name, list: trimList(raw[start:i])})
+      inGroup = false
+      start, item = i + 1, i + 1
+    }
+  }
+
+  // An unterminated group ends with the list.
+  groups = append(groups, addressGroup{group: inGroup, name: name, list: trimList(raw[start:])})
+  return groups
+}
+
+// trimList trims the separators left around a part of an address list
+// by splitGroups.
+func trimList(s string) string {
+  return strings.Trim(s, ", \t\r\n")
+}
+
+// groupName returns the display name of a group,
+// without the quotes of a quoted string.
+func groupName(s string) string {
+  s = strings.TrimSpace(s)
+  if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+    s = strings.NewReplacer(`\\`, `\`, `\"`, `"`).Replace(s[1:len(s)-1])
+  }
+  return s
+}
+
+// encodeName encodes a display name containing non-ASCII characters
+// as an RFC 2047 encoded-word, since net/mail decodes them while parsing.
+func encodeName(name string) string {
+  for _, c := range name {
+    if c > 0x7f {
+      return mime.QEncoding.Encode("utf-8", name)
+    }
+  }
+  return name
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+  "bytes"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func TestEnvelope(t *testing.T) {
+  h := model.Headers{
+    "Date": {"Mon, 02 Jan 2006 15:04:05 -0700"},
+    "Subject": {`say "hi"`},
+    "From": {`"Alice Example" <alice@example.com>`},
+    "To": {"bob@example.com, =?utf-8?q?J=C3=B6rg?= <jorg@example.com>"},
+    "Message-Id": {"<1@example.com>"},
+  }
+
+  buf := &bytes.Buffer{}
+  imap.Encode(buf, envelope(h))
+
+  expected := `("Mon, 02 Jan 2006 15:04:05 -0700" "say \"hi\"" ` +
+    `(("Alice Example" NIL "alice" "example.com")) ` +
+    `(("Alice Example" NIL "alice" "example.com")) ` +
+    `(("Alice Example" NIL "alice" "example.com")) ` +
+    `((NIL NIL "bob" "example.com")("=?utf-8?q?J=C3=B6rg?=" NIL "jorg" "example.com")) ` +
+    `NIL NIL NIL "<1@example.com>")`
+
+  if buf.String() != expected {
+    t.Errorf("unexpected envelope\nexpected: %s\ngot:      %s", expected, buf.String())
+  }
+}
+
+func TestAddressList(t *testing.T) {
+  tests := []struct {
+    desc, raw, expected string
+  }{
+    {"empty", " ", ""},
+    {"invalid", "not an address", ""},
+    {
+      "addresses",
+      `a@example.com, "B, Example" <b@example.com>`,
+      `(NIL NIL "a" "example.com")("B, Example" NIL "b" "example.com")`,
+    },
+    {
+      "group",
+      "team: a@example.com, b@example.com;",
+      `(NIL NIL "team" NIL)(NIL NIL "a" "example.com")(NIL NIL "b" "example.com")(NIL NIL NIL NIL)`,
+    },
+    {
+      "empty group",
+      "undisclosed-recipients:;",
+      `(NIL NIL "undisclosed-recipients" NIL)(NIL NIL NIL NIL)`,
+    },
+    {
+      "group between addresses",
+      `a@example.com, "The Team": "C: Example" <c@example.com>; d@example.com`,
+      `(NIL NIL "a" "example.com")(NIL NIL "The Team" NIL)` +
+        `("C: Example" NIL "c" "example.com")(NIL NIL NIL NIL)(NIL NIL "d" "example.com")`,
+    },
+    {
+      "unterminated group",
+      "team: a@example.com",
+      `(NIL NIL "team" NIL)(NIL NIL "a" "example.com")(NIL NIL NIL NIL)`,
+    },
+  }
+
+  for _, test := range tests {
+    buf := &bytes.Buffer{}
+    for _, a := range addressList(test.raw) {
+      a.EncodeIMAP(buf)
+    }
+    if buf.String() != test.expected {
+      t.Errorf("%s: unexpected addresses\nexpected: %s\ngot:      %s", test.desc, test.expected, buf.String())
+    }
+  }
+}
@@ -3,6 +3,9 @@ package mailer
 import (
   "fmt"
   "io"
+  "net"
+  "crypto/tls"
+  "log"
   "github.com/buchanae/mailer/model"
   "github.com/buchanae/mailer/imap"
 )
@@ -11,17 +14,88 @@ type fake struct {
   mailbox string
   user UserOpt
   db *model.DB
-  done bool
+  state connState
   w io.Writer
+
+  // conn is the underlying network connection, which is replaced
+  // by a TLS connection after STARTTLS.
+  conn net.Conn
+  // d decodes commands from conn.
+  d *imap.CommandDecoder
+  connLog *connectionLogger
+  // tlsconf is used by STARTTLS. If nil, STARTTLS is not available.
+  tlsconf *tls.Config
+  isTLS bool
+  allowPlaintextAuth bool
+  // id is the server identity, for the ID command.
+  id IDOpt
+  // sharedNamespace is the prefix of the shared mailboxes, if any.
+  sharedNamespace string
+
+  // readOnly is true when the mailbox was selected by EXAMINE.
+  readOnly bool
+
+  // seqs maps the message sequence numbers of the selected mailbox to UIDs.
+  seqs *seqMap
+
+  // recent holds the UID ranges of the messages which are recent in this
+  // session. Only one session sees a message as recent (see ClaimRecent).
+  recent []imap.Sequence
+
+  // keywords are the keywords of the selected mailbox
+  // which the client was told about in the FLAGS response.
+  keywords []imap.Flag
+
+  // enabled holds the extensions the client has enabled,
+  // e.g. with ENABLE (see enable).
+  enabled map[string]bool
+
+  // listener receives changes made to the selected mailbox
+  // by other connections.
+  listener *model.Listener
+}
+
+func init() {
+  registerCapabilityFunc(func(f *fake) []string {
+    if f.tlsconf != nil && !f.isTLS && f.state == notAuthenticatedState {
+      return []string{"STARTTLS"}
+    }
+    return nil
+  })
+  // COPYUID and APPENDUID, UID EXPUNGE, and MOVE.
+  registerCapability("UIDPLUS", "MOVE", "CREATE-SPECIAL-USE")
 }
 
 func (f *fake) Start() {
-  // Tell the client that the server is ready to begin.
-  imap.Line(f.w, "* OK IMAP4rev1 server ready")
+  // Tell the client that the server is ready to begin,
+  // and save it from asking for the capabilities.
+  imap.Line(f.w, "* OK [%s] IMAP4rev1 server ready", imap.CapabilityCode(f.capabilityList()))
+}
+
+// setConn sets the network connection used by the controller,
+// and (re)builds the command decoder.
+func (f *fake) setConn(conn net.Conn, isTLS bool) {
+  // Set up some connection logging.
+  rw := f.connLog.Log(conn)
+  f.conn = conn
+  f.isTLS = isTLS
+  f.w = rw
+  f.d = imap.NewCommandDecoder(rw)
+}
+
+// loginDisabled returns true if the client must not log in
+// on this connection, because it isn't using TLS (RFC 3501 LOGINDISABLED).
+func (f *fake) loginDisabled() bool {
+  return !f.isTLS && !f.allowPlaintextAuth
+}
+
+// Stop releases resources held by the connection.
+func (f *fake) Stop() {
+  f.deselect()
 }
 
 func (f *fake) Ready() bool {
-  return !f.done
+  return f.state != logoutState
 }
 
 func (f *fake) Noop(cmd *imap.NoopCommand) {
@@ -32,49 +106,106 @@ func (f *fake) Check(cmd *imap.CheckCommand) {
   imap.Complete(f.w, cmd.Tag, "CHECK")
 }
 
-func (f *fake) Capability(cmd *imap.CapabilityCommand) {
-  imap.Capability(f.w, cmd.Tag, nil)
-}
-
 func (f *fake) Expunge(cmd *imap.ExpungeCommand) {
+  if f.readOnly {
+    imap.No(f.w, cmd.Tag, "mailbox is read-only")
+    return
+  }
+
+  uids, err := f.db.From(f.listener).Expunge(f.mailbox)
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
+
+  // The "* n EXPUNGE" responses are sent by update(), along with
+  // any changes made by other connections.
+  f.update(f.ownChanges(model.MessageExpunged, f.listener.MailboxID, uids)...)
   imap.Expunge(f.w, cmd.Tag, nil)
 }
 
+// UIDExpunge expunges only the deleted messages in the UID set (RFC 4315).
+func (f *fake) UIDExpunge(cmd *imap.UIDExpungeCommand) {
+  if f.readOnly {
+    imap.No(f.w, cmd.Tag, "mailbox is read-only")
+    return
+  }
+
+  var uids []int64
+  for _, seq := range f.seqs.UIDSeqs(cmd.Seqs) {
+    uid, _ := f.seqs.UID(seq)
+    uids = append(uids, uid)
+  }
+
+  expunged, err := f.db.From(f.listener).ExpungeUIDs(f.mailbox, uids)
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
+  f.update(f.ownChanges(model.MessageExpunged, f.listener.MailboxID, expunged)...)
+  imap.Complete(f.w, cmd.Tag, "UID EXPUNGE")
+}
+
 func (f *fake) Login(cmd *imap.LoginCommand) {
-  if f.user.NoAuth {
-    imap.Complete(f.w, cmd.Tag, "LOGIN")
+  if f.loginDisabled() {
+    imap.No(f.w, cmd.Tag, "[PRIVACYREQUIRED] LOGIN is disabled, use STARTTLS first")
     return
   }
-  if cmd.Username == f.user.Name && cmd.Password == f.user.Password {
-    imap.Complete(f.w, cmd.Tag, "LOGIN")
+  if f.user.NoAuth || cmd.Username == f.user.Name && cmd.Password == f.user.Password {
+    f.state = authenticatedState
+    // The capabilities change after authentication.
+    imap.CompleteCode(f.w, cmd.Tag, imap.CapabilityCode(f.capabilityList()), "LOGIN")
     return
   }
   imap.No(f.w, cmd.Tag, "auth error: invalid username or password")
 }
 
 func (f *fake) Logout(cmd *imap.LogoutCommand) {
-  f.done = true
+  f.state = logoutState
   imap.Logout(f.w, cmd.Tag)
 }
 
-func (f *fake) Authenticate(cmd *imap.AuthenticateCommand) {
-    /*
-    TODO auth is difficult because it's a multi-step
-         challenge/response
-    if z.authType == "PLAIN" {
-      wr("+")
-      tok := base64(r)
-      crlf(r)
-      log.Println("AUTH TOK", tok)
-    }
-    */
-}
+// StartTLS upgrades the connection to TLS, as described by RFC 3501 section 6.2.1.
+func (f *fake) StartTLS(cmd *imap.StartTLSCommand) {
+  if f.tlsconf == nil {
+    imap.Bad(f.w, cmd.Tag, "STARTTLS is not available")
+    return
+  }
+  if f.isTLS {
+    imap.Bad(f.w, cmd.Tag, "connection is already using TLS")
+    return
+  }
 
-// TODO https://stackoverflow.com/questions/13110713/upgrade-a-connection-to-tls-in-go
-func (f *fake) StartTLS(cmd *imap.StartTLSCommand) {}
+  imap.Line(f.w, "%s OK Begin TLS negotiation now", cmd.Tag)
 
+  // The TLS connection reads from the raw connection, so anything the
+  // client pipelined after STARTTLS (still sitting in the old decoder's
+  // buffer) is discarded, as required by the RFC.
+  conn := tls.Server(f.conn, f.tlsconf)
+  err := conn.Handshake()
+  if err != nil {
+    log.Printf("error: STARTTLS handshake: %v", err)
+    f.state = logoutState
+    return
+  }
+  f.setConn(conn, true)
+}
+
+// Create implements CREATE, including the USE parameter from RFC 6154,
+// which sets the special-use attributes of the new mailbox. \All and
+// \Flagged aren't supported, because they need virtual mailboxes.
 func (f *fake) Create(cmd *imap.CreateCommand) {
-  err := f.db.CreateMailbox(cmd.Mailbox)
+  var uses []imap.ListAttr
+  for _, a := range cmd.SpecialUse {
+    use, ok := imap.LookupSpecialUse(string(a))
+    if !ok || use == imap.UseAll || use == imap.UseFlagged {
+      imap.No(f.w, cmd.Tag, "[USEATTR] unsupported special-use attribute %s", a)
+      return
+    }
+    uses = append(uses, use)
+  }
+
+  err := f.db.CreateMailbox(cmd.Mailbox, uses...)
   if err != nil {
     imap.No(f.w, cmd.Tag, "database error: creating mailbox: %s", err)
     return
@@ -100,123 +231,218 @@ func (f *fake) Delete(cmd *imap.DeleteCommand) {
   imap.Complete(f.w, cmd.Tag, "DELETE")
 }
 
-func (f *fake) List(cmd *imap.ListCommand) {
-  // TODO mailbox hierarchy is not supported yet
-  switch cmd.Query {
-  case "":
-    imap.ListItem(f.w, "", "", imap.NoSelect)
-
-  case "*", "%":
-    boxes, err := f.db.ListMailboxes()
-    if err != nil {
-      imap.No(f.w, cmd.Tag, "database error: listing mailboxes: %v", err)
-      return
-    }
-
-    for _, box := range boxes {
-      imap.ListItem(f.w, box.Name, "")
-    }
-  }
-  imap.Complete(f.w, cmd.Tag, "LIST")
-}
-
-func (f *fake) Lsub(cmd *imap.LsubCommand) {
-  imap.LsubItem(f.w, "subone", "/")
-  imap.Complete(f.w, cmd.Tag, "LSUB")
-}
-
 func (f *fake) Subscribe(cmd *imap.SubscribeCommand) {
+  err := f.db.Subscribe(cmd.Mailbox)
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "%s", err)
+    return
+  }
   imap.Complete(f.w, cmd.Tag, "SUBSCRIBE")
 }
 
 func (f *fake) Unsubscribe(cmd *imap.UnsubscribeCommand) {
+  err := f.db.Unsubscribe(cmd.Mailbox)
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "%s", err)
+    return
+  }
   imap.Complete(f.w, cmd.Tag, "UNSUBSCRIBE")
 }
 
 func (f *fake) Select(cmd *imap.SelectCommand) {
-  f.mailbox = cmd.Mailbox
+  if cmd.QResync != nil && !f.enabled["QRESYNC"] {
+    imap.Bad(f.w, cmd.Tag, "QRESYNC is not enabled")
+    return
+  }
+  if cmd.CondStore {
+    f.enable("CONDSTORE")
+  }
 
-  box, err := f.db.MailboxByName(f.mailbox)
+  // A failed SELECT/EXAMINE leaves the connection
+  // in the authenticated state, with no mailbox selected.
+  f.closeMailbox()
+
+  box, err := f.db.MailboxByName(cmd.Mailbox)
   if err != nil {
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  exists, err := f.db.MessageCount(cmd.Mailbox)
+  unseen, err := f.db.UnseenCount(cmd.Mailbox)
   if err != nil {
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  recent, err := f.db.RecentCount(cmd.Mailbox)
+  // Start listening before loading the UIDs, so that no changes are
+  // missed. Changes which are already in the map are ignored by update().
+  listener := f.db.Listen(box.ID)
+  uids, err := f.db.MessageUIDs(cmd.Mailbox)
   if err != nil {
+    listener.Close()
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  unseen, err := f.db.UnseenCount(cmd.Mailbox)
+  seqs := newSeqMap(uids)
+  resync, err := f.resync(box, seqs, cmd.QResync)
   if err != nil {
+    listener.Close()
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  // TODO flags
+  recent, err := f.db.ClaimRecent(box.ID, seqs.Last())
+  if err != nil {
+    listener.Close()
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
+
+  keywords, err := f.db.Keywords(cmd.Mailbox)
+  if err != nil {
+    listener.Close()
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
+
+  f.mailbox = cmd.Mailbox
+  f.state = selectedState
+  f.listener = listener
+  f.seqs = seqs
+  f.keywords = keywords
+  f.recent = nil
+  f.addRecent(recent, seqs.Last())
   imap.Encode(f.w, &imap.SelectResponse{
     Tag: cmd.Tag,
-    Exists: exists,
-    Recent: recent,
+    Exists: f.seqs.Len(),
+    Recent: f.recentCount(),
     Unseen: unseen,
     UIDNext: box.NextMessageID,
     UIDValidity: box.ID,
+    Flags: mailboxFlags(keywords),
+    PermanentFlags: permanentFlags(keywords),
     ReadWrite: true,
+    HighestModSeq: box.HighestModSeq,
+    Resync: resync,
   })
 }
 
 func (f *fake) Examine(cmd *imap.ExamineCommand) {
-  f.mailbox = cmd.Mailbox
+  if cmd.QResync != nil && !f.enabled["QRESYNC"] {
+    imap.Bad(f.w, cmd.Tag, "QRESYNC is not enabled")
+    return
+  }
+  if cmd.CondStore {
+    f.enable("CONDSTORE")
+  }
 
-  box, err := f.db.MailboxByName(f.mailbox)
+  // A failed SELECT/EXAMINE leaves the connection
+  // in the authenticated state, with no mailbox selected.
+  f.closeMailbox()
+
+  box, err := f.db.MailboxByName(cmd.Mailbox)
   if err != nil {
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  exists, err := f.db.MessageCount(cmd.Mailbox)
+  unseen, err := f.db.UnseenCount(cmd.Mailbox)
   if err != nil {
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  recent, err := f.db.RecentCount(cmd.Mailbox)
+  listener := f.db.Listen(box.ID)
+  uids, err := f.db.MessageUIDs(cmd.Mailbox)
   if err != nil {
+    listener.Close()
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  unseen, err := f.db.UnseenCount(cmd.Mailbox)
+  seqs := newSeqMap(uids)
+  resync, err := f.resync(box, seqs, cmd.QResync)
   if err != nil {
+    listener.Close()
     imap.No(f.w, cmd.Tag, "error: %v", err)
     return
   }
 
-  // TODO flags
+  recent, err := f.db.PeekRecent(box.ID, seqs.Last())
+  if err != nil {
+    listener.Close()
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
 
+  keywords, err := f.db.Keywords(cmd.Mailbox)
+  if err != nil {
+    listener.Close()
+    imap.No(f.w, cmd.Tag, "error: %v", err)
+    return
+  }
+
+  f.mailbox = cmd.Mailbox
+  f.readOnly = true
+  f.state = selectedState
+  f.listener = listener
+  f.seqs = seqs
+  f.keywords = keywords
+  f.recent = nil
+  f.addRecent(recent, seqs.Last())
   imap.Encode(f.w, &imap.ExamineResponse{
     Tag: cmd.Tag,
-    Exists: exists,
-    Recent: recent,
+    Exists: f.seqs.Len(),
+    Recent: f.recentCount(),
     Unseen: unseen,
     UIDNext: box.NextMessageID,
     UIDValidity: box.ID,
+    Flags: mailboxFlags(keywords),
+    HighestModSeq: box.HighestModSeq,
+    Resync: resync,
   })
 }
 
 func (f *fake) Close(cmd *imap.CloseCommand) {
-  // TODO delete messages from current mailbox
-  f.mailbox = ""
+  // CLOSE expunges silently (no untagged EXPUNGE responses),
+  // and only if the mailbox was opened read-write.
+  if !f.readOnly {
+    _, err := f.db.From(f.listener).Expunge(f.mailbox)
+    if err != nil {
+      imap.No(f.w, cmd.Tag, "error: %v", err)
+      return
+    }
+  }
+  f.deselect()
   imap.Complete(f.w, cmd.Tag, "CLOSE")
 }
 
+// closeMailbox is deselect for SELECT and EXAMINE, which must send the
+// CLOSED response code when QRESYNC is enabled (RFC 7162), so that the
+// client knows which responses belong to the previous mailbox.
+func (f *fake) closeMailbox() {
+  if f.enabled["QRESYNC"] && f.mailbox != "" {
+    imap.Line(f.w, "* OK [CLOSED] Previous mailbox is now closed")
+  }
+  f.deselect()
+}
+
+// deselect closes the selected mailbox (if any) and returns the
+// connection to the authenticated state.
+func (f *fake) deselect() {
+  if f.listener != nil {
+    f.listener.Close()
+    f.listener = nil
+  }
+  f.mailbox = ""
+  f.seqs = nil
+  f.keywords = nil
+  f.recent = nil
+  f.readOnly = false
+  f.state = authenticatedState
+}
+
 func (f *fake) Status(cmd *imap.StatusCommand) {
 
   box, err := f.db.MailboxByName(cmd.Mailbox)
@@ -246,6 +472,9 @@ func (f *fake) Status(cmd *imap.StatusCommand) {
       num = box.ID
     case imap.UnseenStatus:
       num, err = f.db.UnseenCount(cmd.Mailbox)
+    case imap.HighestModSeqStatus:
+      f.enable("CONDSTORE")
+      num = int(box.HighestModSeq)
     }
 
     if err != nil {
@@ -259,194 +488,340 @@ func (f *fake) Status(cmd *imap.StatusCommand) {
 }
 
 func (f *fake) Store(cmd *imap.StoreCommand) {
-  // TODO should validate command flags, shouldn't contain recent
-
-  for _, seq := range cmd.Seqs {
-    // The range can be a single ID, a range of IDs (e.g. 1:100),
-    // or a range with a start and no end (e.g. 1:*).
-    //
-    // IMAP IDs are 1-based, meaning "1" is the first message (not "0").
-    offset := seq.Start - 1
-    limit := 1
-    if seq.IsRange && seq.End > seq.Start {
-      limit = seq.End - seq.Start + 1
-    }
-
-    // TODO could make this a streaming iterator if needed.
-    msgs, err := f.db.MessageRange(f.mailbox, offset, limit)
-    if err != nil {
-      imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
-      return
-    }
-
-    for i, msg := range msgs {
-      id := seq.Start + i
+  f.storeAll(cmd, "STORE", f.seqs.Seqs(cmd.Seqs), false)
+}
+func (f *fake) UIDStore(cmd *imap.StoreCommand) {
+  f.storeAll(cmd, "UID STORE", f.seqs.UIDSeqs(cmd.Seqs), true)
+}
 
-      err := f.store(id, msg, cmd)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: building store result: %v", err)
-        // TODO return or continue?
-      }
-    }
+// storeAll stores the flags of the messages with the given sequence numbers.
+// With UNCHANGEDSINCE (RFC 7162), messages modified since the given
+// mod-sequence aren't changed, and are listed in the MODIFIED response code.
+func (f *fake) storeAll(cmd *imap.StoreCommand, name string, seqs []int, uid bool) {
+  if f.readOnly {
+    imap.No(f.w, cmd.Tag, "mailbox is read-only")
+    return
   }
 
-  imap.Complete(f.w, cmd.Tag, "STORE")
-}
+  if cmd.HasUnchangedSince {
+    f.enable("CONDSTORE")
+  }
 
-func (f *fake) UIDStore(cmd *imap.StoreCommand) {
-  for _, seq := range cmd.Seqs {
-    msgs, err := f.db.MessageIDRange(f.mailbox, seq.Start, seq.End)
+  var modified []int64
+  for _, seq := range seqs {
+    msg, err := f.message(seq)
     if err != nil {
       imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
       return
     }
 
-    for i, msg := range msgs {
-      // TODO not sure what a message sequence number is in the context of UID fetch
-      id := i + 1
-      err := f.store(id, msg, cmd)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: storing result: %v", err)
-        // TODO return or continue?
+    err = f.store(seq, msg, cmd, uid)
+    if err == model.ErrModified {
+      if uid {
+        modified = append(modified, msg.ID)
+      } else {
+        modified = append(modified, int64(seq))
       }
+      continue
+    }
+    if err != nil {
+      imap.No(f.w, cmd.Tag, "error: storing result: %v", err)
+      return
     }
   }
 
-  imap.Complete(f.w, cmd.Tag, "UID STORE")
+  if len(modified) > 0 {
+    imap.CompleteCode(f.w, cmd.Tag, "MODIFIED " + imap.UIDSet(modified), name)
+    return
+  }
+  imap.Complete(f.w, cmd.Tag, name)
 }
 
-func (f *fake) store(id int, msg *model.Message, cmd *imap.StoreCommand) error {
-  switch cmd.Action {
+func (f *fake) store(id int, msg *model.Message, cmd *imap.StoreCommand, uid bool) error {
+  var remove, add []imap.Flag
 
+  switch cmd.Action {
   case imap.StoreAdd:
-    err := f.db.AddFlags(msg.RowID, cmd.Flags)
-    if err != nil {
-      return fmt.Errorf("database error: adding flags: %v", err)
-    }
-
+    add = cmd.Flags
   case imap.StoreRemove:
-    err := f.db.RemoveFlags(msg.RowID, cmd.Flags)
-    if err != nil {
-      return fmt.Errorf("database error: adding flags: %v", err)
-    }
-
+    remove = cmd.Flags
   case imap.StoreReplace:
-    // Remove all flags except Recent.
-    var remove []imap.Flag
-    for _, f := range msg.Flags {
-      if f != imap.Recent {
-        remove = append(remove, f)
-      }
-    }
-
-    err := f.db.ReplaceFlags(msg.RowID, remove, cmd.Flags)
-    if err != nil {
-      return fmt.Errorf("database error: adding flags: %v", err)
-    }
+    remove = msg.Flags
+    add = cmd.Flags
   }
 
-  if !cmd.Silent {
-    msg, err := f.db.Message(msg.RowID)
+  if cmd.HasUnchangedSince {
+    err := f.db.From(f.listener).ReplaceFlagsUnchangedSince(msg.RowID, remove, add, cmd.UnchangedSince)
+    if err == model.ErrModified {
+      return err
+    }
     if err != nil {
-      return fmt.Errorf("database error: loading message: %v", err)
+      return fmt.Errorf("database error: storing flags: %v", err)
     }
-    res := imap.FetchResult{ID: id}
-    res.AddString("flags", joinFlags(msg.Flags))
-
-    err = res.Encode(f.w)
+  } else {
+    err := f.db.From(f.listener).ReplaceFlags(msg.RowID, remove, add)
     if err != nil {
-      return err
+      return fmt.Errorf("database error: storing flags: %v", err)
     }
   }
-  return nil
+
+  // With UNCHANGEDSINCE, the new mod-sequence is sent even if
+  // the client asked for no response (RFC 7162 section 3.1.3).
+  if cmd.Silent && !cmd.HasUnchangedSince {
+    return nil
+  }
+
+  msg, err := f.db.Message(msg.RowID)
+  if err != nil {
+    return fmt.Errorf("database error: loading message: %v", err)
+  }
+  res := imap.FetchResult{ID: id}
+  if uid || f.enabled["CONDSTORE"] {
+    res.AddString("uid", fmt.Sprint(msg.ID))
+  }
+  if !cmd.Silent {
+    res.AddString("flags", f.flags(msg))
+  }
+  if f.enabled["CONDSTORE"] {
+    res.AddString("modseq", modSeqValue(msg))
+  }
+  return res.Encode(f.w)
 }
 
 func (f *fake) Append(cmd *imap.AppendCommand) {
-  _, err := f.db.CreateMessage(cmd.Mailbox, cmd.Message, cmd.Flags)
+  // The mailbox is checked first, so the client can create it and retry
+  // (RFC 3501 section 6.3.11) without sending the message data.
+  box, err := f.db.MailboxByName(cmd.Mailbox)
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "[TRYCREATE] error: %v", err)
+    return
+  }
+  msg, err := f.db.From(f.listener).CreateMessage(cmd.Mailbox, cmd.Message, cmd.Flags)
   if err != nil {
     imap.No(f.w, cmd.Tag, "creating message: %v", err)
     return
   }
-  imap.Complete(f.w, cmd.Tag, "APPEND")
+  // If the message was appended to the selected mailbox,
+  // the client should see the new EXISTS count.
+  f.update(f.ownChanges(model.MessageCreated, box.ID, []int64{msg.ID})...)
+  imap.CompleteCode(f.w, cmd.Tag, imap.AppendUID(box.ID, msg.ID), "APPEND")
 }
 
 func (f *fake) Copy(cmd *imap.CopyCommand) {
-  for _, seq := range cmd.Seqs {
-    // The range can be a single ID, a range of IDs (e.g. 1:100),
-    // or a range with a start and no end (e.g. 1:*).
-    //
-    // IMAP IDs are 1-based, meaning "1" is the first message (not "0").
-    offset := seq.Start - 1
-    limit := 1
-    if seq.IsRange && seq.End > seq.Start {
-      limit = seq.End - seq.Start + 1
-    }
+  f.copy_(cmd.Tag, "COPY", cmd.Mailbox, f.seqs.Seqs(cmd.Seqs))
+}
+func (f *fake) UIDCopy(cmd *imap.CopyCommand) {
+  f.copy_(cmd.Tag, "UID COPY", cmd.Mailbox, f.seqs.UIDSeqs(cmd.Seqs))
+}
 
-    // TODO could make this a streaming iterator if needed.
-    msgs, err := f.db.MessageRange(f.mailbox, offset, limit)
+// copy_ copies the messages with the given sequence numbers to the mailbox,
+// and responds with the COPYUID response code (RFC 4315).
+func (f *fake) copy_(tag, name, mailbox string, seqs []int) {
+  box, err := f.db.MailboxByName(mailbox)
+  if err != nil {
+    imap.No(f.w, tag, "[TRYCREATE] error: %v", err)
+    return
+  }
+
+  var src, dst []int64
+  for _, seq := range seqs {
+    msg, err := f.message(seq)
     if err != nil {
-      imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
+      imap.No(f.w, tag, "database error: retrieving message: %v", err)
       return
     }
 
-    for _, msg := range msgs {
-      err := f.copy_(msg, cmd)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: copying: %v", err)
-        // TODO return or continue?
-      }
+    res, err := f.db.From(f.listener).CopyMessage(msg, mailbox)
+    if err != nil {
+      imap.No(f.w, tag, "error: copying: %v", err)
+      return
     }
+    src = append(src, msg.ID)
+    dst = append(dst, res.ID)
   }
 
-  imap.Complete(f.w, cmd.Tag, "COPY")
+  f.update(f.ownChanges(model.MessageCreated, box.ID, dst)...)
+  if len(src) == 0 {
+    imap.Complete(f.w, tag, name)
+    return
+  }
+  imap.CompleteCode(f.w, tag, imap.CopyUID(box.ID, src, dst), name)
 }
 
-func (f *fake) UIDCopy(cmd *imap.CopyCommand) {
-  for _, seq := range cmd.Seqs {
-    msgs, err := f.db.MessageIDRange(f.mailbox, seq.Start, seq.End)
+func (f *fake) Move(cmd *imap.MoveCommand) {
+  f.move(cmd.Tag, "MOVE", cmd.Mailbox, f.seqs.Seqs(cmd.Seqs))
+}
+func (f *fake) UIDMove(cmd *imap.MoveCommand) {
+  f.move(cmd.Tag, "UID MOVE", cmd.Mailbox, f.seqs.UIDSeqs(cmd.Seqs))
+}
+
+// move moves the messages with the given sequence numbers to the mailbox,
+// as described by RFC 6851: the COPYUID response code is sent in an
+// untagged OK, followed by the EXPUNGE responses for the moved messages.
+func (f *fake) move(tag, name, mailbox string, seqs []int) {
+  if f.readOnly {
+    imap.No(f.w, tag, "mailbox is read-only")
+    return
+  }
+
+  box, err := f.db.MailboxByName(mailbox)
+  if err != nil {
+    imap.No(f.w, tag, "[TRYCREATE] error: %v", err)
+    return
+  }
+
+  var msgs []*model.Message
+  for _, seq := range seqs {
+    msg, err := f.message(seq)
     if err != nil {
-      imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
+      imap.No(f.w, tag, "database error: retrieving message: %v", err)
       return
     }
+    msgs = append(msgs, msg)
+  }
 
-    for _, msg := range msgs {
-      err := f.copy_(msg, cmd)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: copying: %v", err)
-        // TODO return or continue?
-      }
-    }
+  moved, err := f.db.From(f.listener).MoveMessages(f.mailbox, msgs, mailbox)
+  if err != nil {
+    imap.No(f.w, tag, "error: moving: %v", err)
+    return
   }
 
-  imap.Complete(f.w, cmd.Tag, "UID STORE")
+  var src, dst []int64
+  for i, msg := range msgs {
+    src = append(src, msg.ID)
+    dst = append(dst, moved[i].ID)
+  }
+  if len(msgs) > 0 {
+    imap.Line(f.w, "* OK [%s] Moved", imap.CopyUID(box.ID, src, dst))
+  }
+
+  // The "* n EXPUNGE" responses are sent by update().
+  own := f.ownChanges(model.MessageCreated, box.ID, dst)
+  own = append(own, f.ownChanges(model.MessageExpunged, f.listener.MailboxID, src)...)
+  f.update(own...)
+  imap.Complete(f.w, tag, name)
+}
+
+// ownChanges returns changes of the given kind to the messages with the
+// given UIDs, if "mailboxID" is the selected mailbox. The session isn't
+// notified of its own changes, so they're passed to update() directly.
+func (f *fake) ownChanges(kind model.ChangeKind, mailboxID int, uids []int64) []model.Change {
+  if f.listener == nil || f.listener.MailboxID != mailboxID {
+    return nil
+  }
+  var changes []model.Change
+  for _, uid := range uids {
+    changes = append(changes, model.Change{Kind: kind, MailboxID: mailboxID, UID: uid})
+  }
+  return changes
 }
 
-func (f *fake) copy_(msg *model.Message, cmd *imap.CopyCommand) error {
-  _, err := f.db.CopyMessage(msg, cmd.Mailbox)
-  return err
+// message loads the message with the given sequence number
+// from the selected mailbox.
+func (f *fake) message(seq int) (*model.Message, error) {
+  uid, ok := f.seqs.UID(seq)
+  if !ok {
+    return nil, fmt.Errorf("no message with sequence number %d", seq)
+  }
+  return f.db.MessageByUID(f.mailbox, uid)
 }
 
 func (f *fake) Search(cmd *imap.SearchCommand) {
+  uids, modseq, ok := f.search(cmd)
+  if !ok {
+    return
+  }
+
+  var ids []int64
+  for _, uid := range uids {
+    if seq, ok := f.seqs.Seq(uid); ok {
+      ids = append(ids, int64(seq))
+    }
+  }
+  imap.Search(f.w, ids, modseq)
+  imap.Complete(f.w, cmd.Tag, "SEARCH")
+}
+
+func (f *fake) UIDSearch(cmd *imap.SearchCommand) {
+  uids, modseq, ok := f.search(cmd)
+  if !ok {
+    return
+  }
+
+  var ids []int64
+  for _, uid := range uids {
+    // Only report messages the session knows about.
+    if _, ok := f.seqs.Seq(uid); ok {
+      ids = append(ids, uid)
+    }
+  }
+  imap.Search(f.w, ids, modseq)
+  imap.Complete(f.w, cmd.Tag, "UID SEARCH")
+}
+
+// search runs the search command against the selected mailbox, returning
+// the UIDs of the matching messages. If the search uses the MODSEQ key
+// (RFC 7162), the highest mod-sequence of the matching messages is returned
+// too, otherwise it's zero. If the search fails, a NO response is sent
+// and "ok" is false.
+func (f *fake) search(cmd *imap.SearchCommand) (uids []int64, modseq int64, ok bool) {
   // TODO is this possible?
   if len(cmd.Keys) == 0 {
     imap.No(f.w, cmd.Tag, "search error: empty search query")
-    return
+    return nil, 0, false
   }
 
-  ids, err := f.db.Search(cmd)
+  q := *cmd
+  q.Keys = f.uidKeys(cmd.Keys)
+
+  uids, modseq, err := f.db.Search(f.mailbox, &q)
   if err != nil {
     imap.No(f.w, cmd.Tag, "search error: %v", err)
-    return
+    return nil, 0, false
   }
 
-  for _, id := range ids {
-    imap.Line(f.w, "* SEARCH %d", id)
+  if !hasModSeqKey(cmd.Keys) {
+    return uids, 0, true
   }
+  f.enable("CONDSTORE")
+  return uids, modseq, true
+}
 
-  imap.Complete(f.w, cmd.Tag, "SEARCH")
+// uidKeys converts the sequence set keys in the search keys to UID keys,
+// since the database doesn't know about the session's sequence numbers,
+// or its recent messages.
+func (f *fake) uidKeys(keys []imap.SearchKey) []imap.SearchKey {
+  var out []imap.SearchKey
+  for _, k := range keys {
+    out = append(out, f.seqKeyToUIDs(k))
+  }
+  return out
 }
 
-func (f *fake) UIDSearch(cmd *imap.SearchCommand) {
-  // TODO what is UID search?
-  f.Search(cmd)
+// seqKeyToUIDs returns a copy of the search key, where sequence set keys
+// are replaced by UID keys listing the UIDs of the matching messages,
+// as ranges where possible.
+// The RECENT, NEW and OLD keys are replaced too (see recentKey).
+func (f *fake) seqKeyToUIDs(key imap.SearchKey) imap.SearchKey {
+  switch z := key.(type) {
+  case *imap.SequenceKey:
+    return &imap.UIDKey{Seqs: f.seqs.UIDRanges(f.seqs.Seqs(z.Seqs))}
+
+  case *imap.GroupKey:
+    g := &imap.GroupKey{}
+    for _, k := range z.Keys {
+      g.Keys = append(g.Keys, f.seqKeyToUIDs(k))
+    }
+    return g
+
+  case *imap.OrKey:
+    return &imap.OrKey{Arg1: f.seqKeyToUIDs(z.Arg1), Arg2: f.seqKeyToUIDs(z.Arg2)}
+
+  case *imap.NotKey:
+    return &imap.NotKey{Arg: f.seqKeyToUIDs(z.Arg)}
+
+  case *imap.StatusKey:
+    return f.recentKey(z)
+  }
+  return key
 }
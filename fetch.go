@@ -2,6 +2,8 @@ package mailer
 
 import (
   "fmt"
+  "io"
+  "io/ioutil"
   "time"
   "strings"
   "github.com/buchanae/mailer/model"
@@ -10,102 +12,127 @@ import (
 
 // TODO maybe fetch shouldn't return deleted messages?
 func (f *fake) Fetch(cmd *imap.FetchCommand) {
-  // TODO check connection state. must have a selected mailbox.
-
-  for _, seq := range cmd.Seqs {
-    // The range can be a single ID, a range of IDs (e.g. 1:100),
-    // or a range with a start and no end (e.g. 1:*).
-    //
-    // IMAP IDs are 1-based, meaning "1" is the first message (not "0").
-    offset := seq.Start - 1
-    limit := 1
-    if seq.IsRange && seq.End > seq.Start {
-      limit = seq.End - seq.Start + 1
-    }
+  if cmd.Vanished {
+    imap.Bad(f.w, cmd.Tag, "VANISHED is only allowed with UID FETCH")
+    return
+  }
+  f.fetchAll(cmd, "FETCH", f.seqs.Seqs(cmd.Seqs), false)
+}
 
-    // TODO could make this a streaming iterator if needed.
-    msgs, err := f.db.MessageRange(f.mailbox, offset, limit)
-    if err != nil {
-      imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
+func (f *fake) UIDFetch(cmd *imap.FetchCommand) {
+  if cmd.Vanished {
+    if !f.enabled["QRESYNC"] {
+      imap.Bad(f.w, cmd.Tag, "QRESYNC is not enabled")
       return
     }
-
-    for i, msg := range msgs {
-      id := seq.Start + i
-
-      err := f.fetch(id, msg, cmd, false)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: building fetch result: %v", err)
-        // TODO return or continue?
-      }
+    if !cmd.HasChangedSince {
+      imap.Bad(f.w, cmd.Tag, "VANISHED requires CHANGEDSINCE")
+      return
+    }
+    err := f.vanishedSince(cmd.Seqs, cmd.ChangedSince)
+    if err != nil {
+      imap.No(f.w, cmd.Tag, "error: %v", err)
+      return
     }
   }
-
-  imap.Complete(f.w, cmd.Tag, "FETCH")
+  f.fetchAll(cmd, "UID FETCH", f.seqs.UIDSeqs(cmd.Seqs), true)
 }
 
-func (f *fake) UIDFetch(cmd *imap.FetchCommand) {
-  // TODO check connection state. must have a selected mailbox.
-  for _, seq := range cmd.Seqs {
-    // TODO could make this a streaming iterator if needed.
-    msgs, err := f.db.MessageIDRange(f.mailbox, seq.Start, seq.End)
+// fetchAll fetches the messages with the given sequence numbers.
+// With CHANGEDSINCE (RFC 7162), only the messages modified since
+// the given mod-sequence are fetched.
+func (f *fake) fetchAll(cmd *imap.FetchCommand, name string, seqs []int, forceUID bool) {
+  if cmd.HasChangedSince {
+    f.enable("CONDSTORE")
+  }
+
+  for _, seq := range seqs {
+    msg, err := f.message(seq)
     if err != nil {
       imap.No(f.w, cmd.Tag, "database error: retrieving message: %v", err)
       return
     }
 
-    for i, msg := range msgs {
-      // TODO not sure what a message sequence number is in the context of UID fetch
-      id := i + 1
-      err := f.fetch(id, msg, cmd, true)
-      if err != nil {
-        imap.No(f.w, cmd.Tag, "error: building fetch result: %v", err)
-        // TODO return or continue?
-      }
+    if cmd.HasChangedSince && msg.ModSeq <= cmd.ChangedSince {
+      continue
+    }
+
+    err = f.fetch(seq, msg, cmd, forceUID)
+    if err != nil {
+      imap.No(f.w, cmd.Tag, "error: building fetch result: %v", err)
+      return
     }
   }
 
-  imap.Complete(f.w, cmd.Tag, "UID FETCH")
+  imap.Complete(f.w, cmd.Tag, name)
 }
 
 func (f *fake) fetch(id int, msg *model.Message, cmd *imap.FetchCommand, forceUID bool) error {
   res := imap.FetchResult{ID: id}
-  setSeen := false
+
+  // \Seen is set before the result is built, so that FLAGS shows it.
+  // The session isn't notified of its own changes, so FLAGS is
+  // added to the result if it wasn't requested (RFC 3501 section 6.4.5).
+  // A mailbox opened by EXAMINE is never changed.
+  setSeen := !f.readOnly && setsSeen(cmd) && !hasFlag(msg.Flags, imap.Seen)
+  if setSeen {
+    err := f.db.From(f.listener).AddFlags(msg.RowID, []imap.Flag{imap.Seen})
+    if err != nil {
+      return fmt.Errorf("database error: setting seen flag: %v", err)
+    }
+    msg, err = f.db.Message(msg.RowID)
+    if err != nil {
+      return fmt.Errorf("database error: loading message: %v", err)
+    }
+  }
 
   for _, attr := range cmd.Attrs {
+
+    // Sections of a message part, e.g. BODY[1.2] or BODY.PEEK[2.MIME]
+    if len(attr.Part) > 0 {
+      r, size, err := openPart(msg, attr)
+      if err != nil {
+        return err
+      }
+      defer r.Close()
+      err = addSection(&res, attr, size, r)
+      if err != nil {
+        return err
+      }
+      continue
+    }
+
     switch attr.Name {
 
     case "all":
       // Macro equivalent to: (FLAGS INTERNALDATE RFC822.SIZE ENVELOPE)
-      res.AddString("flags", joinFlags(msg.Flags))
+      res.AddString("flags", f.flags(msg))
       res.AddString("internaldate", quoteTime(msg.Created))
       res.AddString("rfc822.size", fmt.Sprint(msg.Size))
-      // TODO envelope
+      res.AddEncoder("envelope", envelope(msg.Headers))
 
     case "fast":
       // Macro equivalent to: (FLAGS INTERNALDATE RFC822.SIZE)
-      res.AddString("flags", joinFlags(msg.Flags))
+      res.AddString("flags", f.flags(msg))
       res.AddString("internaldate", quoteTime(msg.Created))
       res.AddString("rfc822.size", fmt.Sprint(msg.Size))
 
     case "full":
       // Macro equivalent to: (FLAGS INTERNALDATE RFC822.SIZE ENVELOPE BODY)
-      res.AddString("flags", joinFlags(msg.Flags))
+      res.AddString("flags", f.flags(msg))
       res.AddString("internaldate", quoteTime(msg.Created))
       res.AddString("rfc822.size", fmt.Sprint(msg.Size))
-      // TODO envelope
-      body, err := msg.Body()
+      res.AddEncoder("envelope", envelope(msg.Headers))
+      err := addBodyStructure(&res, msg, "body", false)
       if err != nil {
-        return fmt.Errorf("opening message body: %v", err)
+        return err
       }
-      defer body.Close()
-      res.AddReader("body[]", msg.Size, body)
 
     case "envelope":
-      // TODO
+      res.AddEncoder("envelope", envelope(msg.Headers))
 
     case "flags":
-      res.AddString("flags", joinFlags(msg.Flags))
+      res.AddString("flags", f.flags(msg))
 
     case "internaldate":
       res.AddString("internaldate", quoteTime(msg.Created))
@@ -113,8 +140,11 @@ func (f *fake) fetch(id int, msg *model.Message, cmd *imap.FetchCommand, forceUI
     case "uid":
       res.AddString("uid", fmt.Sprint(msg.ID))
 
+    case "modseq":
+      f.enable("CONDSTORE")
+      res.AddString("modseq", modSeqValue(msg))
+
     case "rfc822":
-      setSeen = true
       body, err := msg.Body()
       if err != nil {
         return fmt.Errorf("opening message body: %v", err)
@@ -126,83 +156,190 @@ func (f *fake) fetch(id int, msg *model.Message, cmd *imap.FetchCommand, forceUI
       res.AddLiteral("body[header]", msg.Headers.Format())
 
     case "rfc822.text":
-      setSeen = true
-      text, err := msg.Text()
+      text, size, err := msg.Text()
       if err != nil {
-        return err
+        return fmt.Errorf("opening message text: %v", err)
       }
       defer text.Close()
       // TODO should be rfc822.text?
-      res.AddReader("body[text]", msg.Size, text)
+      res.AddReader("body[text]", size, text)
 
     case "rfc822.size":
       res.AddString("rfc822.size", fmt.Sprint(msg.Size))
 
     case "bodystructure":
-      body, err := msg.Body()
+      err := addBodyStructure(&res, msg, "bodystructure", true)
       if err != nil {
-        return fmt.Errorf("opening message body: %v", err)
+        return err
       }
-      defer body.Close()
 
-      s, err := bodyStructure(body)
+    case "body":
+      err := addBodyStructure(&res, msg, "body", false)
       if err != nil {
-        return fmt.Errorf("building body structure: %v", err)
+        return err
       }
-      res.AddEncoder("bodystructure", s)
 
     case "body[]", "body.peek[]":
-      setSeen = attr.Name == "body[]"
       body, err := msg.Body()
       if err != nil {
         return fmt.Errorf("opening message body: %v", err)
       }
       defer body.Close()
-      res.AddReader("body[]", msg.Size, body)
+      err = addSection(&res, attr, msg.Size, body)
+      if err != nil {
+        return err
+      }
 
     case "body[text]", "body.peek[text]":
-      setSeen = attr.Name == "body[text]"
-      text, err := msg.Text()
+      text, size, err := msg.Text()
       if err != nil {
-        return err
+        return fmt.Errorf("opening message text: %v", err)
       }
       defer text.Close()
-      res.AddReader("body[text]", msg.Size, text)
+      err = addSection(&res, attr, size, text)
+      if err != nil {
+        return err
+      }
 
     case "body[header]", "body.peek[header]":
-      setSeen = attr.Name == "body[header]"
-      res.AddLiteral("body[header]", msg.Headers.Format())
+      err := addStringSection(&res, attr, msg.Headers.Format())
+      if err != nil {
+        return err
+      }
 
     case "body[header.fields]", "body.peek[header.fields]":
-      setSeen = attr.Name == "body[header.fields]"
       h := msg.Headers.Include(attr.Headers)
-      l := strings.Join(attr.Headers, " ")
-      f := fmt.Sprintf("body[header.fields (%s)]", l)
-      res.AddLiteral(f, h.Format())
+      err := addStringSection(&res, attr, h.Format())
+      if err != nil {
+        return err
+      }
 
     case "body[header.fields.not]", "body.peek[header.fields.not]":
-      setSeen = attr.Name == "body[header.fields.not]"
       h := msg.Headers.Exclude(attr.Headers)
-      l := strings.Join(attr.Headers, " ")
-      f := fmt.Sprintf("body[header.fields.not (%s)]", l)
-      res.AddLiteral(f, h.Format())
+      err := addStringSection(&res, attr, h.Format())
+      if err != nil {
+        return err
+      }
     }
   }
 
   if forceUID {
     res.AddString("uid", fmt.Sprint(msg.ID))
   }
+  // CHANGEDSINCE implies MODSEQ (RFC 7162).
+  if cmd.HasChangedSince && !hasFetchAttr(cmd, "modseq") {
+    res.AddString("modseq", modSeqValue(msg))
+  }
 
-  if setSeen {
-    err := f.db.AddFlags(msg.RowID, []imap.Flag{imap.Seen})
-    if err != nil {
-      return fmt.Errorf("database error: setting seen flag: %v", err)
-    }
+  if setSeen && !fetchesFlags(cmd) {
+    res.AddString("flags", f.flags(msg))
   }
 
   return res.Encode(f.w)
 }
 
+// addSection adds a body section to the fetch result, applying the partial
+// range (e.g. BODY[]<0.2048>), if any. In that case, the key in the response
+// has the origin octet appended, e.g. "body[]<0>".
+func addSection(res *imap.FetchResult, attr *imap.FetchAttr, size int, r io.Reader) error {
+  p := attr.Partial
+  if p == nil {
+    res.AddReader(attr.Key(), size, r)
+    return nil
+  }
+
+  key := fmt.Sprintf("%s<%d>", attr.Key(), p.Offset)
+  if p.Offset >= size {
+    res.AddLiteral(key, "")
+    return nil
+  }
+
+  n := size - p.Offset
+  if n > p.Limit {
+    n = p.Limit
+  }
+
+  // Skip to the start of the range, without reading
+  // the skipped bytes if possible (e.g. message body files).
+  var err error
+  if s, ok := r.(io.Seeker); ok {
+    _, err = s.Seek(int64(p.Offset), io.SeekCurrent)
+  } else {
+    _, err = io.CopyN(ioutil.Discard, r, int64(p.Offset))
+  }
+  if err != nil {
+    return fmt.Errorf("skipping to offset %d: %v", p.Offset, err)
+  }
+
+  res.AddReader(key, n, r)
+  return nil
+}
+
+// addBodyStructure adds the BODYSTRUCTURE, or the non-extensible BODY,
+// of the message to the fetch result.
+func addBodyStructure(res *imap.FetchResult, msg *model.Message, key string, extended bool) error {
+  body, err := msg.Body()
+  if err != nil {
+    return fmt.Errorf("opening message body: %v", err)
+  }
+  defer body.Close()
+
+  s, err := bodyStructure(body, extended)
+  if err != nil {
+    return fmt.Errorf("building body structure: %v", err)
+  }
+  res.AddEncoder(key, s)
+  return nil
+}
+
+func addStringSection(res *imap.FetchResult, attr *imap.FetchAttr, s string) error {
+  return addSection(res, attr, len(s), strings.NewReader(s))
+}
+
+// setsSeen returns true if the fetch implicitly sets the \Seen flag,
+// i.e. it fetches a body section without .PEEK, or RFC822 or RFC822.TEXT.
+func setsSeen(cmd *imap.FetchCommand) bool {
+  for _, attr := range cmd.Attrs {
+    switch {
+    case attr.Name == "rfc822", attr.Name == "rfc822.text":
+      return true
+    case strings.HasPrefix(attr.Name, "body["):
+      return true
+    }
+  }
+  return false
+}
+
+// fetchesFlags returns true if the fetch includes FLAGS, directly or by a macro.
+func fetchesFlags(cmd *imap.FetchCommand) bool {
+  for _, attr := range cmd.Attrs {
+    switch attr.Name {
+    case "flags", "all", "fast", "full":
+      return true
+    }
+  }
+  return false
+}
+
+func hasFlag(flags []imap.Flag, flag imap.Flag) bool {
+  for _, f := range flags {
+    if f == flag {
+      return true
+    }
+  }
+  return false
+}
+
+// flags formats the FLAGS fetch item of the message,
+// which includes \Recent if the message is recent in this session.
+func (f *fake) flags(msg *model.Message) string {
+  flags := msg.Flags
+  if f.isRecent(msg.ID) {
+    flags = append([]imap.Flag{imap.Recent}, flags...)
+  }
+  return joinFlags(flags)
+}
+
 func joinFlags(flags []imap.Flag) string {
   var s []string
   for _, flag := range flags {
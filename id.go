@@ -0,0 +1,18 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+func init() {
+  registerCapability("ID")
+}
+
+// ID implements the ID command from RFC 2971. The client's identity is
+// written to the connection log, which helps to debug client quirks,
+// and the server's identity comes from the options.
+func (f *fake) ID(cmd *imap.IDCommand) {
+  f.connLog.LogID(f.conn.RemoteAddr(), cmd.Params)
+  imap.ID(f.w, f.id.params())
+  imap.Complete(f.w, cmd.Tag, "ID")
+}
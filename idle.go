@@ -0,0 +1,197 @@
+package mailer
+
+import (
+  "fmt"
+  "log"
+  "sort"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func init() {
+  registerCapability("IDLE")
+}
+
+// Idle implements the IDLE command from RFC 2177. Changes made to the
+// selected mailbox by other connections are pushed to the client
+// as they happen, until the client sends "DONE".
+func (f *fake) Idle(cmd *imap.IdleCommand) {
+  imap.Line(f.w, "+ idling")
+
+  done := make(chan error, 1)
+  go func() {
+    done <- cmd.Wait()
+  }()
+
+  // A nil channel blocks forever, which is useful when
+  // no mailbox is selected and there's nothing to listen to.
+  var ready <-chan struct{}
+  if f.listener != nil {
+    ready = f.listener.Ready()
+  }
+
+  for {
+    select {
+    case err := <-done:
+      if err != nil {
+        imap.Bad(f.w, cmd.Tag, "error: waiting for DONE: %v", err)
+        return
+      }
+      f.update()
+      imap.Complete(f.w, cmd.Tag, "IDLE")
+      return
+
+    case <-ready:
+      f.update()
+    }
+  }
+}
+
+// update sends untagged responses describing the changes made to the
+// selected mailbox since the last update, e.g. "* 5 EXISTS" and
+// "* 1 RECENT" when a message is delivered, "* 2 FETCH (FLAGS (\Seen))" when
+// another connection changes a message's flags, or "* 3 EXPUNGE"
+// (or "* VANISHED 7" with QRESYNC) when a message is expunged.
+//
+// The session isn't notified of its own changes, so commands which
+// add or remove messages in the selected mailbox pass them in "own".
+// Flag changes aren't passed: the command reports them itself, if at all.
+func (f *fake) update(own ...model.Change) {
+  if f.listener == nil {
+    return
+  }
+
+  // New messages are added in UID order, since changes made by
+  // concurrent transactions might arrive out of order.
+  var created, added []int64
+  // With QRESYNC, expunged messages are reported by UID (RFC 7162),
+  // in one VANISHED response for the whole batch.
+  var vanished []int64
+  flagged := map[int64]bool{}
+  // New messages and flags may bring new keywords.
+  keywords := false
+
+  for _, c := range append(f.listener.Changes(), own...) {
+    switch c.Kind {
+    case model.MessageCreated:
+      created = append(created, c.UID)
+      keywords = true
+    case model.FlagsChanged:
+      flagged[c.UID] = true
+      keywords = true
+    case model.MessageExpunged:
+      delete(flagged, c.UID)
+
+      if f.enabled["QRESYNC"] {
+        if _, ok := f.seqs.Remove(c.UID); ok {
+          vanished = append(vanished, c.UID)
+        }
+        // A new message which is expunged in the same batch
+        // is never reported at all.
+        if i := indexOf(created, c.UID); i >= 0 {
+          created = append(created[:i], created[i+1:]...)
+        }
+        continue
+      }
+
+      // The client must know about a new message before it's expunged.
+      added = append(added, f.addMessages(created)...)
+      created = nil
+      seq, ok := f.seqs.Remove(c.UID)
+      if ok {
+        imap.Line(f.w, "* %d EXPUNGE", seq)
+      }
+    }
+  }
+
+  // VANISHED comes before EXISTS, which counts
+  // the messages left after the expunge.
+  if len(vanished) > 0 {
+    sort.Slice(vanished, func(i, j int) bool {
+      return vanished[i] < vanished[j]
+    })
+    imap.Vanished(f.w, vanished, false)
+  }
+  added = append(added, f.addMessages(created)...)
+
+  if len(added) > 0 {
+    err := f.updateRecent()
+    if err != nil {
+      log.Printf("error: sending mailbox update: %v", err)
+    }
+  }
+
+  // The client must know about new keywords
+  // before it sees them in a FETCH response.
+  if keywords {
+    err := f.updateKeywords()
+    if err != nil {
+      log.Printf("error: sending mailbox update: %v", err)
+    }
+  }
+
+  for uid := range flagged {
+    err := f.updateFlags(uid)
+    if err != nil {
+      log.Printf("error: sending mailbox update: %v", err)
+    }
+  }
+}
+
+// addMessages adds new messages to the sequence map, sends "* n EXISTS",
+// and returns the UIDs of the messages which weren't already in the map.
+func (f *fake) addMessages(uids []int64) []int64 {
+  sort.Slice(uids, func(i, j int) bool {
+    return uids[i] < uids[j]
+  })
+
+  var added []int64
+  for _, uid := range uids {
+    ok, err := f.seqs.Add(uid)
+    if err != nil {
+      log.Printf("error: adding new message: %v", err)
+      continue
+    }
+    if ok {
+      added = append(added, uid)
+    }
+  }
+
+  if len(added) > 0 {
+    imap.Line(f.w, "* %d EXISTS", f.seqs.Len())
+  }
+  return added
+}
+
+func (f *fake) updateFlags(uid int64) error {
+  seq, ok := f.seqs.Seq(uid)
+  if !ok {
+    // The message was removed before the update was sent.
+    return nil
+  }
+
+  msg, err := f.db.MessageByUID(f.mailbox, uid)
+  if err != nil {
+    return fmt.Errorf("database error: retrieving message: %v", err)
+  }
+
+  res := imap.FetchResult{ID: seq}
+  if f.enabled["CONDSTORE"] {
+    res.AddString("uid", fmt.Sprint(msg.ID))
+  }
+  res.AddString("flags", f.flags(msg))
+  if f.enabled["CONDSTORE"] {
+    res.AddString("modseq", modSeqValue(msg))
+  }
+  return res.Encode(f.w)
+}
+
+// indexOf returns the index of "uid" in "uids", or -1.
+func indexOf(uids []int64, uid int64) int {
+  for i, u := range uids {
+    if u == uid {
+      return i
+    }
+  }
+  return -1
+}
@@ -20,6 +20,14 @@ type CheckCommand struct { Tag string }
 type CloseCommand struct { Tag string }
 type ExpungeCommand struct { Tag string }
 
+// IdleCommand is the IDLE command from RFC 2177.
+// The handler should send a continuation request,
+// and then call Wait to block until the client sends "DONE".
+type IdleCommand struct {
+  Tag string
+  r *reader
+}
+
 type Sequence struct {
 	Start, End int
   IsRange bool
@@ -37,6 +45,15 @@ type UIDSearchCommand struct {
 type UIDCopyCommand struct {
   *CopyCommand
 }
+type UIDMoveCommand struct {
+  *MoveCommand
+}
+type UIDSortCommand struct {
+  *SortCommand
+}
+type UIDThreadCommand struct {
+  *ThreadCommand
+}
 
 type LoginCommand struct {
   Tag string
@@ -46,11 +63,18 @@ type LoginCommand struct {
 type AuthenticateCommand struct {
   Tag string
   AuthType string
+  // InitialResponse is the decoded SASL initial response (RFC 4959),
+  // if HasInitialResponse is true. The client sends "=" for an empty response.
+  InitialResponse []byte
+  HasInitialResponse bool
 }
 
 type CreateCommand struct {
   Tag string
   Mailbox string
+  // SpecialUse holds the attributes from the USE parameter (RFC 6154),
+  // as the client sent them.
+  SpecialUse []ListAttr
 }
 
 type RenameCommand struct {
@@ -66,7 +90,13 @@ type DeleteCommand struct {
 type ListCommand struct {
   Tag string
   Mailbox string
-  Query string
+  // Queries holds the patterns. There's more than one only
+  // in the extended syntax from RFC 5258.
+  Queries []string
+  // Select and Return hold the lower case selection and return
+  // options from RFC 5258, e.g. "subscribed".
+  Select []string
+  Return []string
 }
 
 type LsubCommand struct {
@@ -88,11 +118,26 @@ type UnsubscribeCommand struct {
 type SelectCommand struct {
   Tag string
   Mailbox string
+  // CondStore is true if the CONDSTORE parameter was given (RFC 7162).
+  CondStore bool
+  // QResync holds the QRESYNC parameter (RFC 7162), if given.
+  QResync *QResyncParam
 }
 
 type ExamineCommand struct {
   Tag string
   Mailbox string
+  CondStore bool
+  QResync *QResyncParam
+}
+
+// QResyncParam is the QRESYNC parameter of SELECT and EXAMINE (RFC 7162),
+// which describes the state of the mailbox known to the client.
+type QResyncParam struct {
+  UIDValidity int
+  ModSeq int64
+  // KnownUIDs is the optional set of UIDs known to the client.
+  KnownUIDs []Sequence
 }
 
 type StatusAttr string
@@ -102,6 +147,7 @@ const (
   UIDNextStatus = "uidnext"
   UIDValidityStatus = "uidvalidity"
   UnseenStatus = "unseen"
+  HighestModSeqStatus = "highestmodseq"
 )
 
 type StatusCommand struct {
@@ -114,6 +160,12 @@ type FetchCommand struct {
   Tag string
   Seqs []Sequence
   Attrs []*FetchAttr
+  // ChangedSince is the CHANGEDSINCE modifier (RFC 7162),
+  // if HasChangedSince is true.
+  ChangedSince int64
+  HasChangedSince bool
+  // Vanished is true if the VANISHED modifier was given (RFC 7162).
+  Vanished bool
 }
 
 type SearchCommand struct {
@@ -122,12 +174,50 @@ type SearchCommand struct {
   Keys []SearchKey
 }
 
+// SortCommand is the SORT command from RFC 5256.
+type SortCommand struct {
+  Tag string
+  Criteria []SortCriterion
+  Charset string
+  Keys []SearchKey
+}
+
+// SortCriterion is a sort key, e.g. "date" or "subject",
+// optionally reversed, e.g. "REVERSE DATE".
+type SortCriterion struct {
+  Key string
+  Reverse bool
+}
+
+// ThreadCommand is the THREAD command from RFC 5256.
+type ThreadCommand struct {
+  Tag string
+  // Algorithm is "orderedsubject" or "references".
+  Algorithm string
+  Charset string
+  Keys []SearchKey
+}
+
 type CopyCommand struct {
   Tag string
   Mailbox string
   Seqs []Sequence
 }
 
+// MoveCommand is the MOVE command from RFC 6851.
+type MoveCommand struct {
+  Tag string
+  Mailbox string
+  Seqs []Sequence
+}
+
+// UIDExpungeCommand is the UID EXPUNGE command from RFC 4315 (UIDPLUS),
+// which only expunges deleted messages with the given UIDs.
+type UIDExpungeCommand struct {
+  Tag string
+  Seqs []Sequence
+}
+
 type StoreAction int
 const (
   StoreReplace StoreAction = iota
@@ -142,6 +232,28 @@ type StoreCommand struct {
   Seqs []Sequence
   Silent bool
   Flags []Flag
+  // UnchangedSince is the UNCHANGEDSINCE modifier (RFC 7162),
+  // if HasUnchangedSince is true.
+  UnchangedSince int64
+  HasUnchangedSince bool
+}
+
+// EnableCommand is the ENABLE command from RFC 5161.
+type EnableCommand struct {
+  Tag string
+  // Capabilities are the capabilities to enable, in uppercase.
+  Capabilities []string
+}
+
+// NamespaceCommand is the NAMESPACE command from RFC 2342.
+type NamespaceCommand struct { Tag string }
+
+// IDCommand is the ID command from RFC 2971.
+type IDCommand struct {
+  Tag string
+  // Params are the fields the client sent to identify itself, e.g. "name".
+  // Params is nil if the client sent NIL. NIL values are empty.
+  Params map[string]string
 }
 
 type AppendCommand struct {
@@ -153,11 +265,19 @@ type AppendCommand struct {
   Message io.Reader
 }
 func (a *AppendCommand) finish() error {
+  r := a.Message.(*appendMessageReader)
+
+  // If the command was rejected before reading a synchronizing literal,
+  // the continuation request was never sent, so the client won't send
+  // the message data.
+  if r.sync && !r.started {
+    return nil
+  }
+
   _, err := io.Copy(ioutil.Discard, a.Message)
   if err != nil && err != io.EOF {
     return err
   }
-  r := a.Message.(*appendMessageReader)
 
   s, err := r.r.peek(2)
   if err != nil {
@@ -169,6 +289,23 @@ func (a *AppendCommand) finish() error {
 	return r.r.discard(2)
 }
 
+// Wait blocks until the client ends the IDLE command by sending "DONE".
+func (i *IdleCommand) Wait() (err error) {
+  defer func() {
+    if e := recover(); e != nil {
+      var ok bool
+      err, ok = e.(error)
+      if !ok {
+        err = fmt.Errorf("%v", e)
+      }
+    }
+  }()
+
+  require(i.r, "done")
+  crlf(i.r)
+  return nil
+}
+
 func (x *UnknownCommand) IMAPTag() string { return x.Tag }
 func (x *CapabilityCommand) IMAPTag() string { return x.Tag }
 func (x *LogoutCommand) IMAPTag() string { return x.Tag }
@@ -177,6 +314,7 @@ func (x *StartTLSCommand) IMAPTag() string { return x.Tag }
 func (x *CheckCommand) IMAPTag() string { return x.Tag }
 func (x *CloseCommand) IMAPTag() string { return x.Tag }
 func (x *ExpungeCommand) IMAPTag() string { return x.Tag }
+func (x *IdleCommand) IMAPTag() string { return x.Tag }
 func (x *LoginCommand) IMAPTag() string { return x.Tag }
 func (x *CreateCommand) IMAPTag() string { return x.Tag }
 func (x *DeleteCommand) IMAPTag() string { return x.Tag }
@@ -191,6 +329,13 @@ func (x *StatusCommand) IMAPTag() string { return x.Tag }
 func (x *AuthenticateCommand) IMAPTag() string { return x.Tag }
 func (x *FetchCommand) IMAPTag() string { return x.Tag }
 func (x *CopyCommand) IMAPTag() string { return x.Tag }
+func (x *MoveCommand) IMAPTag() string { return x.Tag }
+func (x *EnableCommand) IMAPTag() string { return x.Tag }
+func (x *NamespaceCommand) IMAPTag() string { return x.Tag }
+func (x *IDCommand) IMAPTag() string { return x.Tag }
+func (x *UIDExpungeCommand) IMAPTag() string { return x.Tag }
 func (x *StoreCommand) IMAPTag() string { return x.Tag }
 func (x *SearchCommand) IMAPTag() string { return x.Tag }
+func (x *SortCommand) IMAPTag() string { return x.Tag }
+func (x *ThreadCommand) IMAPTag() string { return x.Tag }
 func (x *AppendCommand) IMAPTag() string { return x.Tag }
@@ -0,0 +1,103 @@
+package imap
+
+import (
+  "fmt"
+  "io"
+)
+
+// Address is an address in an envelope, as described by RFC 3501:
+//
+//   address = "(" addr-name SP addr-adl SP addr-mailbox SP addr-host ")"
+type Address struct {
+  Name string
+  ADL string
+  Mailbox string
+  Host string
+}
+
+func (a *Address) EncodeIMAP(w io.Writer) {
+  fmt.Fprint(w, "(")
+  NString(w, a.Name)
+  fmt.Fprint(w, " ")
+  NString(w, a.ADL)
+  fmt.Fprint(w, " ")
+  NString(w, a.Mailbox)
+  fmt.Fprint(w, " ")
+  NString(w, a.Host)
+  fmt.Fprint(w, ")")
+}
+
+// Envelope is the ENVELOPE fetch item, which describes
+// the envelope structure of a message.
+type Envelope struct {
+  Date string
+  Subject string
+  From []*Address
+  Sender []*Address
+  ReplyTo []*Address
+  To []*Address
+  Cc []*Address
+  Bcc []*Address
+  InReplyTo string
+  MessageID string
+}
+
+func (e *Envelope) EncodeIMAP(w io.Writer) {
+  fmt.Fprint(w, "(")
+  NString(w, e.Date)
+  fmt.Fprint(w, " ")
+  NString(w, e.Subject)
+
+  for _, list := range [][]*Address{e.From, e.Sender, e.ReplyTo, e.To, e.Cc, e.Bcc} {
+    fmt.Fprint(w, " ")
+    addressList(w, list)
+  }
+
+  fmt.Fprint(w, " ")
+  NString(w, e.InReplyTo)
+  fmt.Fprint(w, " ")
+  NString(w, e.MessageID)
+  fmt.Fprint(w, ")")
+}
+
+func addressList(w io.Writer, list []*Address) {
+  if len(list) == 0 {
+    fmt.Fprint(w, "NIL")
+    return
+  }
+  fmt.Fprint(w, "(")
+  for _, a := range list {
+    a.EncodeIMAP(w)
+  }
+  fmt.Fprint(w, ")")
+}
+
+// NString writes an IMAP nstring: NIL if the string is empty,
+// a quoted string if possible, otherwise a literal.
+func NString(w io.Writer, s string) {
+  if s == "" {
+    fmt.Fprint(w, "NIL")
+    return
+  }
+  String(w, s)
+}
+
+// String writes an IMAP string, which is quoted unless it contains
+// characters which aren't allowed in a quoted string (e.g. CR, LF,
+// or 8-bit characters), in which case it's written as a literal.
+func String(w io.Writer, s string) {
+  quoted := ""
+  for i := 0; i < len(s); i++ {
+    c := s[i]
+    switch {
+    case c == '\r' || c == '\n' || c == 0 || c > 0x7f:
+      Literal(w, s)
+      return
+    case c == '"' || c == '\\':
+      quoted += `\` + string(c)
+    default:
+      quoted += string(c)
+    }
+  }
+  fmt.Fprintf(w, `"%s"`, quoted)
+}
@@ -1,6 +1,8 @@
 package imap
 
 import (
+  "fmt"
+  "strings"
   "time"
 )
 
@@ -12,10 +14,32 @@ type Partial struct {
 type FetchAttr struct {
 	Name string
   Headers []string
+  // Part is the part path of a body section, e.g. [1, 2] for BODY[1.2.TEXT].
   Part []int
+  // Section is the section text of a body section,
+  // e.g. "header.fields" or "mime". Empty for the whole part/message.
+  Section string
   Partial *Partial
 }
 
+// Key returns the name of a body section item in the FETCH response,
+// e.g. "body[1.2.header]" for BODY.PEEK[1.2.HEADER].
+func (a *FetchAttr) Key() string {
+  var spec []string
+  for _, p := range a.Part {
+    spec = append(spec, fmt.Sprint(p))
+  }
+  if a.Section != "" {
+    spec = append(spec, a.Section)
+  }
+
+  key := "body[" + strings.Join(spec, ".")
+  if a.Section == "header.fields" || a.Section == "header.fields.not" {
+    key += " (" + strings.Join(a.Headers, " ") + ")"
+  }
+  return key + "]"
+}
+
 type SearchKey interface {
   isSearchKey()
 }
@@ -64,6 +88,13 @@ type SequenceKey struct {
   Seqs []Sequence
 }
 
+// ModSeqKey matches messages with a mod-sequence greater than
+// or equal to ModSeq (RFC 7162). The optional metadata item name
+// and type are parsed, but ignored.
+type ModSeqKey struct {
+  ModSeq int64
+}
+
 func (*FieldKey) isSearchKey() {}
 func (*StatusKey) isSearchKey() {}
 func (*OrKey) isSearchKey() {}
@@ -73,4 +104,5 @@ func (*DateKey) isSearchKey() {}
 func (*SizeKey) isSearchKey() {}
 func (*UIDKey) isSearchKey() {}
 func (*SequenceKey) isSearchKey() {}
+func (*ModSeqKey) isSearchKey() {}
 func (*GroupKey) isSearchKey() {}
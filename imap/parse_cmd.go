@@ -12,6 +12,8 @@ import (
   "fmt"
   "io"
   "time"
+  "strings"
+  b64 "encoding/base64"
 )
 
 func command(r *reader) (cmd Command, err error) {
@@ -63,6 +65,14 @@ func command(r *reader) (cmd Command, err error) {
   case "expunge":
 		crlf(r)
     cmd = &ExpungeCommand{Tag: tag}
+  case "idle":
+		crlf(r)
+    cmd = &IdleCommand{Tag: tag, r: r}
+  case "namespace":
+		crlf(r)
+    cmd = &NamespaceCommand{Tag: tag}
+	case "id":
+		cmd = id(r, tag)
 	case "create":
 		cmd = create(r, tag)
 	case "delete":
@@ -91,8 +101,18 @@ func command(r *reader) (cmd Command, err error) {
 		cmd = fetch(r, tag)
 	case "copy":
 		cmd = copy_(r, tag)
+	case "enable":
+		cmd = enable(r, tag)
+	case "move":
+		cmd = move(r, tag)
 	case "store":
 		cmd = store(r, tag)
+	case "search":
+		cmd = search(r, tag)
+	case "sort":
+		cmd = sort_(r, tag)
+	case "thread":
+		cmd = thread(r, tag)
   case "append":
     cmd = append_(r, tag)
   case "uid":
@@ -121,9 +141,10 @@ func append_(r *reader, tag string) *AppendCommand {
     space(r)
   }
 
-  size := literalHeader(r)
+  size, sync := literalHeader(r)
   msg := &appendMessageReader{
     left:    size,
+    sync: sync,
     // TODO this is exposing the reader to code outside the CommandDecoder,
     //      which could mess with position information unexpectedly?
     r: r,
@@ -142,6 +163,9 @@ func append_(r *reader, tag string) *AppendCommand {
 type appendMessageReader struct {
   // number of bytes remaining
   left int
+  // is this a synchronizing literal, which needs a continuation
+  // request before the client sends the data?
+  sync bool
   // has reading started? has the continuation signal been sent?
   started bool
   r *reader
@@ -149,9 +173,11 @@ type appendMessageReader struct {
 
 func (l *appendMessageReader) Read(p []byte) (int, error) {
   if !l.started {
-    _, err := fmt.Fprint(l.r, "+\r\n")
-    if err != nil {
-      return 0, fmt.Errorf("sending continuation: %v", err)
+    if l.sync {
+      err := l.r.continue_()
+      if err != nil {
+        return 0, fmt.Errorf("sending continuation: %v", err)
+      }
     }
     l.started = true
   }
@@ -182,20 +208,49 @@ func uidcmd(r *reader, tag string) Command {
     return &UIDSearchCommand{search(r, tag)}
   case "copy":
     return &UIDCopyCommand{copy_(r, tag)}
+  case "move":
+    return &UIDMoveCommand{move(r, tag)}
+  case "expunge":
+    space(r)
+    seqs := seqSet(r)
+    crlf(r)
+    return &UIDExpungeCommand{Tag: tag, Seqs: seqs}
+  case "sort":
+    return &UIDSortCommand{sort_(r, tag)}
+  case "thread":
+    return &UIDThreadCommand{thread(r, tag)}
   default:
     panic("expected uid command")
   }
   return nil
 }
 
+/*
+authenticate    = "AUTHENTICATE" SP auth-type [SP (base64 / "=")] CRLF
+*/
 func authenticate(r *reader, tag string) *AuthenticateCommand {
 	space(r)
 	a := atom(r)
-	crlf(r)
-	return &AuthenticateCommand{
+	cmd := &AuthenticateCommand{
 		Tag:      tag,
-		AuthType: a,
+		AuthType: strings.ToUpper(a),
 	}
+
+  // SASL-IR initial response.
+  if discard(r, " ") {
+    cmd.HasInitialResponse = true
+    if !discard(r, "=") {
+      str := base64(r)
+      ir, err := b64.StdEncoding.DecodeString(str)
+      if err != nil {
+        panic(fmt.Errorf("decoding initial response: %v", err))
+      }
+      cmd.InitialResponse = ir
+    }
+  }
+
+	crlf(r)
+	return cmd
 }
 
 func login(r *reader, tag string) *LoginCommand {
@@ -211,11 +266,40 @@ func login(r *reader, tag string) *LoginCommand {
 	}
 }
 
+/*
+create          = "CREATE" SP mailbox [create-params]
+create-params   = SP "(" create-param *(SP create-param) ")"
+create-param    = "USE" SP "(" [use-attr *(SP use-attr)] ")"
+*/
 func create(r *reader, tag string) *CreateCommand {
 	space(r)
 	mailbox := requireAstring(r)
+  cmd := &CreateCommand{Tag: tag, Mailbox: mailbox}
+
+  if discard(r, " (") {
+    for {
+      if keyword(r) != "use" {
+        panic("expected create parameter")
+      }
+      space(r)
+      require(r, "(")
+      for i := 0; !discard(r, ")"); i++ {
+        if i > 0 {
+          space(r)
+        }
+        require(r, `\`)
+        cmd.SpecialUse = append(cmd.SpecialUse, ListAttr(`\` + atom(r)))
+      }
+
+      if !discard(r, " ") {
+        break
+      }
+    }
+    require(r, ")")
+  }
+
 	crlf(r)
-	return &CreateCommand{Tag: tag, Mailbox: mailbox}
+	return cmd
 }
 
 func delete_(r *reader, tag string) *DeleteCommand {
@@ -231,10 +315,13 @@ func delete_(r *reader, tag string) *DeleteCommand {
 func examine(r *reader, tag string) *ExamineCommand {
 	space(r)
 	mailbox := requireAstring(r)
+  condstore, qresync := selectParams(r)
 	crlf(r)
 	return &ExamineCommand{
     Tag: tag,
     Mailbox: mailbox,
+    CondStore: condstore,
+    QResync: qresync,
   }
 }
 
@@ -250,11 +337,80 @@ func rename(r *reader, tag string) *RenameCommand {
 func select_(r *reader, tag string) *SelectCommand {
 	space(r)
 	mailbox := requireAstring(r)
+  condstore, qresync := selectParams(r)
 	crlf(r)
 	return &SelectCommand{
     Tag: tag,
     Mailbox: mailbox,
+    CondStore: condstore,
+    QResync: qresync,
+  }
+}
+
+/*
+select-params   = SP "(" select-param *(SP select-param) ")"
+select-param    = "CONDSTORE" / "QRESYNC" SP qresync-param
+*/
+func selectParams(r *reader) (condstore bool, qresync *QResyncParam) {
+  if !discard(r, " (") {
+    return false, nil
   }
+
+  for {
+    k := keyword(r)
+    switch k {
+    case "condstore":
+      condstore = true
+    case "qresync":
+      space(r)
+      qresync = qresyncParam(r)
+    default:
+      panic("expected select parameter")
+    }
+
+    if !discard(r, " ") {
+      break
+    }
+  }
+
+  require(r, ")")
+  return condstore, qresync
+}
+
+/*
+qresync-param   = "(" uidvalidity SP mod-sequence-value [SP known-uids]
+                  [SP seq-match-data] ")"
+seq-match-data  = "(" known-sequence-set SP known-uid-set ")"
+*/
+func qresyncParam(r *reader) *QResyncParam {
+  require(r, "(")
+  p := &QResyncParam{}
+
+  v, ok := nzNumber(r)
+  if !ok {
+    panic("expected uidvalidity")
+  }
+  p.UIDValidity = v
+  space(r)
+  p.ModSeq = modSeq(r)
+
+  if discard(r, " ") {
+    if !peek(r, "(") {
+      p.KnownUIDs = seqSet(r)
+      discard(r, " ")
+    }
+    // The sequence match data only helps the server find the messages
+    // the client knows about, which it doesn't need, so it's ignored.
+    if discard(r, "(") {
+      seqSet(r)
+      space(r)
+      seqSet(r)
+      require(r, ")")
+    }
+  }
+
+  require(r, ")")
+  return p
 }
 
 func subscribe(r *reader, tag string) *SubscribeCommand {
@@ -277,24 +433,75 @@ func unsubscribe(r *reader, tag string) *UnsubscribeCommand {
   }
 }
 
+// list parses LIST, including the extended syntax from RFC 5258:
+//
+//   list = "LIST" [SP list-select-opts] SP mailbox SP mbox-or-pat
+//          [SP list-return-opts]
+//   mbox-or-pat = list-mailbox / patterns
+//   patterns = "(" list-mailbox *(SP list-mailbox) ")"
 func list(r *reader, tag string) *ListCommand {
 	space(r)
+
+  var sel []string
+  if peek(r, "(") {
+    sel = listOptions(r)
+    space(r)
+  }
+
 	mailbox := requireAstring(r)
 	space(r)
 
-	q, ok := listMailbox(r)
-	if !ok {
-		panic("parsing list query")
-	}
+  var queries []string
+  if discard(r, "(") {
+    for {
+      queries = append(queries, requireListMailbox(r))
+      if !discard(r, " ") {
+        break
+      }
+    }
+    require(r, ")")
+  } else {
+    queries = append(queries, requireListMailbox(r))
+  }
+
+  var ret []string
+  if discard(r, " ") {
+    if keyword(r) != "return" {
+      panic("expected RETURN")
+    }
+    space(r)
+    ret = listOptions(r)
+  }
 
 	crlf(r)
 	return &ListCommand{
     Tag: tag,
     Mailbox: mailbox,
-    Query: q,
+    Queries: queries,
+    Select: sel,
+    Return: ret,
   }
 }
 
+// listOptions parses a list of LIST selection or return options,
+// e.g. "(SUBSCRIBED RECURSIVEMATCH)". The options are lower case.
+func listOptions(r *reader) []string {
+  require(r, "(")
+  var opts []string
+  if discard(r, ")") {
+    return opts
+  }
+  for {
+    // Options may contain "-", e.g. SPECIAL-USE (RFC 6154).
+    opts = append(opts, strings.ToLower(atom(r)))
+    if !discard(r, " ") {
+      break
+    }
+  }
+  require(r, ")")
+  return opts
+}
+
 func listMailbox(r *reader) (string, bool) {
 	s, ok := takeChars(r, listChar)
 	if ok {
@@ -303,12 +510,24 @@ func listMailbox(r *reader) (string, bool) {
 	return string_(r)
 }
 
+func requireListMailbox(r *reader) string {
+	q, ok := listMailbox(r)
+	if !ok {
+		panic("parsing list query")
+	}
+  return q
+}
+
 func lsub(r *reader, tag string) *LsubCommand {
-	l := list(r, tag)
+	space(r)
+	mailbox := requireAstring(r)
+	space(r)
+	q := requireListMailbox(r)
+	crlf(r)
 	return &LsubCommand{
-    Tag: l.Tag,
-    Mailbox: l.Mailbox,
-    Query: l.Query,
+    Tag: tag,
+    Mailbox: mailbox,
+    Query: q,
   }
 }
 
@@ -323,7 +542,7 @@ func status(r *reader, tag string) *StatusCommand {
 	for {
     k := keyword(r)
     switch k {
-    case "messages", "recent", "uidnext", "uidvalidity", "unseen":
+    case "messages", "recent", "uidnext", "uidvalidity", "unseen", "highestmodseq":
 		  attrs = append(attrs, StatusAttr(k))
     default:
 			panic("parsing status attribute, unknown keyword")
@@ -369,38 +588,81 @@ func partial(r *reader) *Partial {
   return &Partial{Offset: offset, Limit: limit}
 }
 
+/*
+section         = "[" [section-spec] "]"
+section-spec    = section-msgtext / (section-part ["." section-text])
+section-part    = nz-number *("." nz-number)
+section-text    = section-msgtext / "MIME"
+*/
 func section(r *reader, name string) *FetchAttr {
   if !discard(r, "[") {
-    // TODO seems like this should be an error
-    // TODO can you have a partial with no section?
-    return &FetchAttr{Name: name + "[]"}
+    // BODY without a section is the non-extensible form of BODYSTRUCTURE.
+    if name != "body" {
+      panic("expected section")
+    }
+    return &FetchAttr{Name: "body"}
   }
 
   if discard(r, "]") {
     return &FetchAttr{Name: name + "[]", Partial: partial(r)}
 	}
 
-  // TODO also missing section-part
-  // section-part    = nz-number *("." nz-number
-  // section-spec    = section-msgtext / (section-part ["." section-text])
   attr := &FetchAttr{}
 
+  if contains(digit, peekN(r, 1)) {
+    attr.Part = sectionPart(r)
+
+    // A part with no section text, e.g. BODY[1.2]
+    if discard(r, "]") {
+      attr.Name = name + "[]"
+      attr.Partial = partial(r)
+      return attr
+    }
+  }
+
 	k := keyword(r)
 	switch k {
 	case "header.fields", "header.fields.not":
 		space(r)
     attr.Headers = headerList(r)
   case "header", "text":
+  case "mime":
+    if attr.Part == nil {
+      panic("MIME section requires a part number")
+    }
   default:
 		panic("expected section keyword")
 	}
 
   require(r, "]")
   attr.Name = fmt.Sprintf("%s[%s]", name, k)
+  attr.Section = k
   attr.Partial = partial(r)
   return attr
 }
 
+// sectionPart parses a part path, such as "1.2.3", including the
+// trailing "." which separates the part from the section text, if any.
+func sectionPart(r *reader) []int {
+  var part []int
+  for {
+    n, ok := nzNumber(r)
+    if !ok {
+      panic("expected part number")
+    }
+    part = append(part, n)
+
+    if !discard(r, ".") {
+      break
+    }
+    // The dot might precede section text, e.g. "1.HEADER".
+    if !contains(digit, peekN(r, 1)) {
+      break
+    }
+  }
+  return part
+}
+
 func headerList(r *reader) []string {
   require(r, "(")
 
@@ -426,7 +688,7 @@ func fetchAttr(r *reader) *FetchAttr {
     return section(r, k)
   case "all", "full", "fast", "envelope", "flags",
        "internaldate", "rfc822", "rfc822.header",
-       "rfc822.size", "rfc822.text", "bodystructure", "uid":
+       "rfc822.size", "rfc822.text", "bodystructure", "uid", "modseq":
     return &FetchAttr{Name: k}
   default:
 	  panic("expected fetch keyword")
@@ -457,12 +719,43 @@ func fetch(r *reader, tag string) *FetchCommand {
 		attrs = append(attrs, a)
 	}
 
-	crlf(r)
-	return &FetchCommand{
+	cmd := &FetchCommand{
 		Tag:   tag,
 		Seqs:  seqs,
 		Attrs: attrs,
 	}
+  fetchModifiers(r, cmd)
+	crlf(r)
+  return cmd
+}
+
+/*
+fetch-modifiers = SP "(" fetch-modifier *(SP fetch-modifier) ")"
+fetch-modifier  = "CHANGEDSINCE" SP mod-sequence-value / "VANISHED"
+*/
+func fetchModifiers(r *reader, cmd *FetchCommand) {
+  if !discard(r, " (") {
+    return
+  }
+
+  for {
+    k := keyword(r)
+    switch k {
+    case "changedsince":
+      space(r)
+      cmd.ChangedSince = modSeq(r)
+      cmd.HasChangedSince = true
+    case "vanished":
+      cmd.Vanished = true
+    default:
+      panic("expected fetch modifier")
+    }
+
+    if !discard(r, " ") {
+      break
+    }
+  }
+  require(r, ")")
 }
 
 func copy_(r *reader, tag string) *CopyCommand {
@@ -479,6 +772,75 @@ func copy_(r *reader, tag string) *CopyCommand {
 	}
 }
 
+/*
+id              = "ID" SP id_params_list
+id_params_list  = "(" #(string SP nstring) ")" / nil
+*/
+func id(r *reader, tag string) *IDCommand {
+  space(r)
+  cmd := &IDCommand{Tag: tag}
+  if discard(r, "nil") {
+    crlf(r)
+    return cmd
+  }
+
+  cmd.Params = map[string]string{}
+  require(r, "(")
+  for i := 0; !discard(r, ")"); i++ {
+    if i > 0 {
+      space(r)
+    }
+    k, ok := string_(r)
+    if !ok {
+      panic("expected ID field name")
+    }
+    space(r)
+
+    var v string
+    if !discard(r, "nil") {
+      v, ok = string_(r)
+      if !ok {
+        panic("expected ID field value")
+      }
+    }
+    cmd.Params[k] = v
+  }
+	crlf(r)
+  return cmd
+}
+
+/*
+enable          = "ENABLE" 1*(SP capability)
+*/
+func enable(r *reader, tag string) *EnableCommand {
+  var caps []string
+  for discard(r, " ") {
+    caps = append(caps, strings.ToUpper(atom(r)))
+  }
+  if len(caps) == 0 {
+    panic("expected capability")
+  }
+	crlf(r)
+  return &EnableCommand{Tag: tag, Capabilities: caps}
+}
+
+/*
+move            = "MOVE" SP sequence-set SP mailbox
+*/
+func move(r *reader, tag string) *MoveCommand {
+	space(r)
+	seqs := seqSet(r)
+	space(r)
+  mailbox := requireAstring(r)
+	crlf(r)
+
+	return &MoveCommand{
+		Tag:     tag,
+		Mailbox: mailbox,
+		Seqs:    seqs,
+	}
+}
+
 func flagList(r *reader) []Flag {
   require(r, "(")
   if discard(r, ")") {
@@ -493,13 +855,13 @@ func flags(r *reader) []Flag {
 	var list []Flag
 
 	for {
-    // TODO not true? only system flags have backslash?
-    require(r, `\`)
-
-    if discard(r, "*") {
-			list = append(list, Flag("\\*"))
+    // System flags start with a backslash, keywords don't.
+    if !discard(r, `\`) {
+      list = append(list, LookupFlag(atom(r)))
+    } else if discard(r, "*") {
+			list = append(list, NewKeywords)
 		} else {
-			list = append(list, Flag("\\" + atom(r)))
+			list = append(list, LookupFlag(`\` + atom(r)))
 		}
 
     if !discard(r, " ") {
@@ -514,6 +876,20 @@ func store(r *reader, tag string) *StoreCommand {
 	seqs := seqSet(r)
 	space(r)
 
+  // store-modifiers = "(" "UNCHANGEDSINCE" SP mod-sequence-valzer ")" SP
+  var unchangedSince int64
+  var hasUnchangedSince bool
+  if discard(r, "(") {
+    if keyword(r) != "unchangedsince" {
+      panic("expected store modifier")
+    }
+    space(r)
+    unchangedSince = modSeq(r)
+    hasUnchangedSince = true
+    require(r, ")")
+    space(r)
+  }
+
   var action StoreAction
   if discard(r, "+") {
     action = StoreAdd
@@ -547,6 +923,8 @@ func store(r *reader, tag string) *StoreCommand {
     Silent: silent,
 		Seqs:      seqs,
 		Flags:     f,
+    UnchangedSince: unchangedSince,
+    HasUnchangedSince: hasUnchangedSince,
 	}
 }
 
@@ -579,6 +957,89 @@ func search(r *reader, tag string) *SearchCommand {
   }
 }
 
+/*
+sort            = ["UID" SP] "SORT" SP sort-criteria SP search-criteria
+sort-criteria   = "(" sort-criterion *(SP sort-criterion) ")"
+sort-criterion  = ["REVERSE" SP] sort-key
+sort-key        = "ARRIVAL" / "CC" / "DATE" / "FROM" / "SIZE" /
+                  "SUBJECT" / "TO"
+search-criteria = charset 1*(SP search-key)
+*/
+func sort_(r *reader, tag string) *SortCommand {
+  space(r)
+  require(r, "(")
+
+  var criteria []SortCriterion
+  for {
+    var c SortCriterion
+    if discard(r, "reverse ") {
+      c.Reverse = true
+    }
+
+    c.Key = keyword(r)
+    switch c.Key {
+    case "arrival", "cc", "date", "from", "size", "subject", "to":
+    default:
+      panic("expected sort key")
+    }
+    criteria = append(criteria, c)
+
+    if !discard(r, " ") {
+      break
+    }
+  }
+  require(r, ")")
+  space(r)
+
+  charset, keys := searchCriteria(r)
+  return &SortCommand{
+    Tag: tag,
+    Criteria: criteria,
+    Charset: charset,
+    Keys: keys,
+  }
+}
+
+/*
+thread          = ["UID" SP] "THREAD" SP thread-alg SP search-criteria
+thread-alg      = "ORDEREDSUBJECT" / "REFERENCES" / thread-alg-ext
+*/
+func thread(r *reader, tag string) *ThreadCommand {
+  space(r)
+  alg := keyword(r)
+  switch alg {
+  case "orderedsubject", "references":
+  default:
+    panic("expected thread algorithm")
+  }
+  space(r)
+
+  charset, keys := searchCriteria(r)
+  return &ThreadCommand{
+    Tag: tag,
+    Algorithm: alg,
+    Charset: charset,
+    Keys: keys,
+  }
+}
+
+// searchCriteria parses the charset (which is required, unlike SEARCH)
+// and search keys of SORT and THREAD.
+func searchCriteria(r *reader) (string, []SearchKey) {
+  charset := requireAstring(r)
+
+  var keys []SearchKey
+  for discard(r, " ") {
+    keys = append(keys, searchKey(r))
+  }
+  if len(keys) == 0 {
+    panic("expected search key")
+  }
+
+	crlf(r)
+  return charset, keys
+}
+
 func searchKeyGroup(r *reader) SearchKey {
   require(r, "(")
   var keys []SearchKey
@@ -598,6 +1059,11 @@ func searchKey(r *reader) SearchKey {
     return searchKeyGroup(r)
   }
 
+  // A bare sequence set, e.g. "2:4,7" or "*".
+  if peek(r, "*") || contains(digit, peekN(r, 1)) {
+    return &SequenceKey{Seqs: seqSet(r)}
+  }
+
   k := keyword(r)
   switch k {
   case "all", "answered", "deleted", "flagged", "new", "old", "recent", "seen",
@@ -651,8 +1117,22 @@ func searchKey(r *reader) SearchKey {
     arg := seqSet(r)
     return &UIDKey{Seqs: arg}
 
+  // search-modsequence = "MODSEQ" [search-modseq-ext] SP mod-sequence-valzer
+  // search-modseq-ext  = SP entry-name SP entry-type-req
+  case "modseq":
+    space(r)
+    if _, ok := quoted(r); ok {
+      space(r)
+      switch keyword(r) {
+      case "priv", "shared", "all":
+      default:
+        panic("expected entry type")
+      }
+      space(r)
+    }
+    return &ModSeqKey{ModSeq: modSeq(r)}
+
   default:
-    // TODO try sequence set
     panic("expected search key keyword")
   }
   return nil
@@ -148,6 +148,22 @@ func nzNumber(r *reader) (int, bool) {
 	return number(r)
 }
 
+// modSeq parses a mod-sequence value (RFC 7162),
+// an unsigned 63-bit integer.
+func modSeq(r *reader) int64 {
+	str, ok := takeChars(r, digit)
+	if !ok {
+		panic("expected mod-sequence")
+	}
+
+	i, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		m := fmt.Errorf("converting %q to mod-sequence: %s", str, err)
+		panic(m)
+	}
+  return i
+}
+
 func crlf(r *reader) {
   if !discard(r, "\r\n") {
 		panic("expect CRLF")
@@ -174,28 +190,36 @@ func string_(r *reader) (string, bool) {
 }
 
 func shortLiteral(r *reader) string {
-  size := literalHeader(r)
+  size, sync := literalHeader(r)
   if size > MaxShortLiteralSize {
     panic(fmt.Errorf("max short literal size reached: %d > %d",
       size, MaxShortLiteralSize))
   }
 
-	crlf(r)
-  r.continue_()
+  // The client waits for a continuation request before
+  // sending the data of a synchronizing literal.
+  if sync {
+    r.continue_()
+  }
   return takeN(r, size)
 }
 
-func literalHeader(r *reader) int {
+// literalHeader parses the "{n}" CRLF header of a literal, returning the size
+// of the literal. Non-synchronizing literals (RFC 7888 LITERAL+), "{n+}",
+// are also allowed, in which case "sync" is false and the caller
+// must not send a continuation request.
+func literalHeader(r *reader) (size int, sync bool) {
   require(r, "{")
 
 	num, ok := number(r)
   if !ok {
 		panic("failed to parse character count from literal")
-	}
+  }
 
+  sync = !discard(r, "+")
   require(r, "}")
 	crlf(r)
-  return num
+  return num, sync
 }
 
 func astring(r *reader) (string, bool) {
@@ -243,15 +267,20 @@ func keyword(r *reader) string {
   return strings.ToLower(s)
 }
 
+// base64 parses base64 encoded data, including the padding, if any.
+// The data is not decoded.
 func base64(r *reader) string {
-  str, ok := takeChars(r, base64Char)
-  if !ok {
-		panic("parsing base64, empty")
-  }
+  str, _ := takeChars(r, base64Char)
 
-  require(r, "=")
-  discard(r, "=")
+  if discard(r, "==") {
+    str += "=="
+  } else if discard(r, "=") {
+    str += "="
+  }
 
+  if str == "" {
+		panic("parsing base64, empty")
+  }
 	return str
 }
 
@@ -288,13 +317,17 @@ func seqNumber(r *reader) int {
 }
 
 func date(r *reader) time.Time {
-  quoted := false
-  if !discard(r, "\"") {
-    quoted = true
+  // date = date-text / DQUOTE date-text DQUOTE
+  quoted := discard(r, "\"")
+
+  // date-day = 1*2DIGIT
+  day := takeN(r, 1)
+  if contains(digit, peekN(r, 1)) {
+    day += takeN(r, 1)
   }
+  s := day + takeN(r, len("-Jan-2006"))
 
-  s := takeN(r, len(DateFormat))
-  dt, err := time.Parse(DateFormat, s)
+  dt, err := time.Parse("2-Jan-2006", s)
   if err != nil {
     panic(err)
   }
@@ -6,6 +6,7 @@ import (
   "bytes"
   "bufio"
   "strings"
+  b64 "encoding/base64"
 )
 
 func NewCommandDecoder(r io.ReadWriter) *CommandDecoder {
@@ -102,6 +103,48 @@ func (s *CommandDecoder) Debug() string {
   return fmt.Sprintf("%s\n%s^\n", quoted, pad)
 }
 
+// ErrCanceled is returned by Challenge when the client cancels
+// the exchange by sending "*" instead of a response.
+var ErrCanceled = fmt.Errorf("canceled by client")
+
+// Challenge sends a continuation request containing the base64 encoded
+// challenge (e.g. "+ PDE4OTYu...") and reads the client's base64 encoded
+// response line. This is used by multi-step commands such as AUTHENTICATE.
+func (s *CommandDecoder) Challenge(challenge []byte) (resp []byte, err error) {
+  defer func() {
+    if e := recover(); e != nil {
+      var ok bool
+      err, ok = e.(error)
+      if !ok {
+        err = fmt.Errorf("%v", e)
+      }
+    }
+  }()
+
+  s.r.buf.Reset()
+  s.r.pos = 0
+  fmt.Fprintf(s.r, "+ %s\r\n", b64.StdEncoding.EncodeToString(challenge))
+
+  if discard(s.r, "*") {
+    crlf(s.r)
+    return nil, ErrCanceled
+  }
+
+  // An empty line is an empty response.
+  if discard(s.r, "\r\n") {
+    return []byte{}, nil
+  }
+
+  str := base64(s.r)
+  crlf(s.r)
+
+  resp, err = b64.StdEncoding.DecodeString(str)
+  if err != nil {
+    return nil, fmt.Errorf("decoding base64 response: %v", err)
+  }
+  return resp, nil
+}
+
 // finisher is implemented by commands which need to
 // do more parsing/reading *after* the command handled.
 //
@@ -127,8 +170,11 @@ func newReader(r io.ReadWriter) *reader {
   }
 }
 
-func (r *reader) continue_() {
-  fmt.Fprint(r.Writer, "+\r\n")
+// continue_ sends a continuation request, which tells the client
+// to send the data of a synchronizing literal.
+func (r *reader) continue_() error {
+  _, err := fmt.Fprint(r.Writer, "+ Ready for literal data\r\n")
+  return err
 }
 
 func (r *reader) peek(n int) (string, error) {
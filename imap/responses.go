@@ -1,8 +1,10 @@
 package imap
 
 import (
+  "bytes"
   "fmt"
   "io"
+  "sort"
   "strings"
 )
 
@@ -25,6 +27,13 @@ func No(w io.Writer, tag string, msg string, args ...interface{}) {
   fmt.Fprintf(w, msg + "\r\n", args...)
 }
 
+// IMAP "BAD" is the response for a protocol error, such as an unknown
+// command or a command which is not valid in the current state.
+func Bad(w io.Writer, tag string, msg string, args ...interface{}) {
+  fmt.Fprintf(w, "%s BAD ", tag)
+  fmt.Fprintf(w, msg + "\r\n", args...)
+}
+
 // Line writes a formatted string to the underlying writer,
 // with an IMAP-style newline (carriage return + line feed) appended.
 func Line(w io.Writer, msg string, args ...interface{}) {
@@ -37,19 +46,145 @@ func Complete(w io.Writer, tag, name string) {
   Line(w, "%s OK %s Completed", tag, name)
 }
 
+// CompleteCode writes a "{tag} OK [{code}] {command name} Completed" line,
+// e.g. "a.001 OK [APPENDUID 38505 3955] APPEND Completed"
+func CompleteCode(w io.Writer, tag, code, name string) {
+  Line(w, "%s OK [%s] %s Completed", tag, code, name)
+}
+
+// AppendUID returns the APPENDUID response code (RFC 4315).
+func AppendUID(validity int, uid int64) string {
+  return fmt.Sprintf("APPENDUID %d %d", validity, uid)
+}
+
+// CopyUID returns the COPYUID response code (RFC 4315), which maps the
+// source UIDs to the UIDs of the copies, in the same order.
+func CopyUID(validity int, src, dst []int64) string {
+  return fmt.Sprintf("COPYUID %d %s %s", validity, UIDSet(src), UIDSet(dst))
+}
+
+// UIDSet formats a list of UIDs as a sequence set, where runs of
+// consecutive UIDs are written as ranges, e.g. "1:3,5".
+func UIDSet(ids []int64) string {
+  var s []string
+  for i := 0; i < len(ids); {
+    j := i
+    for j + 1 < len(ids) && ids[j + 1] == ids[j] + 1 {
+      j++
+    }
+    if j > i {
+      s = append(s, fmt.Sprintf("%d:%d", ids[i], ids[j]))
+    } else {
+      s = append(s, fmt.Sprint(ids[i]))
+    }
+    i = j + 1
+  }
+  return strings.Join(s, ",")
+}
+
+// Namespace is a mailbox name prefix and its hierarchy delimiter,
+// in the NAMESPACE response from RFC 2342.
+type Namespace struct {
+  Prefix, Delimiter string
+}
+
+// Namespaces writes the NAMESPACE response, which lists the personal
+// namespaces, those of other users, and the shared namespaces.
+// An empty list is written as NIL.
+func Namespaces(w io.Writer, personal, other, shared []Namespace) {
+  var s []string
+  for _, list := range [][]Namespace{personal, other, shared} {
+    if len(list) == 0 {
+      s = append(s, "NIL")
+      continue
+    }
+    b := &bytes.Buffer{}
+    b.WriteString("(")
+    for _, ns := range list {
+      b.WriteString("(")
+      String(b, ns.Prefix)
+      b.WriteString(" ")
+      String(b, ns.Delimiter)
+      b.WriteString(")")
+    }
+    b.WriteString(")")
+    s = append(s, b.String())
+  }
+  Line(w, "* NAMESPACE %s", strings.Join(s, " "))
+}
+
+// ID writes the ID response from RFC 2971, which identifies the server.
+// The fields are sorted by name. No fields are written as NIL.
+func ID(w io.Writer, params map[string]string) {
+  if len(params) == 0 {
+    Line(w, "* ID NIL")
+    return
+  }
+
+  var keys []string
+  for k := range params {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+
+  b := &bytes.Buffer{}
+  for i, k := range keys {
+    if i > 0 {
+      b.WriteString(" ")
+    }
+    String(b, k)
+    b.WriteString(" ")
+    NString(b, params[k])
+  }
+  Line(w, "* ID (%s)", b.String())
+}
+
+// Capability writes the CAPABILITY response. IMAP4rev1 is always included,
+// before the capabilities in the list.
 func Capability(w io.Writer, tag string, list []string) {
-  Line(w, "* CAPABILITY IMAP4rev1 %s", strings.Join(list, " "))
+  Line(w, "* %s", CapabilityCode(list))
   Complete(w, tag, "CAPABILITY")
 }
 
+// CapabilityCode returns the CAPABILITY response code, which may be sent
+// in the greeting and after authentication, e.g. "CAPABILITY IMAP4rev1 IDLE".
+func CapabilityCode(list []string) string {
+  return strings.Join(append([]string{"CAPABILITY", "IMAP4rev1"}, list...), " ")
+}
+
 type ListAttr string
 const (
   NoSelect ListAttr  = `\Noselect`
-  NoInferiors = `\Noinferiors`
-  Marked = `\Marked`
-  Unmarked = `\Unmarked`
+  NoInferiors ListAttr = `\Noinferiors`
+  Marked ListAttr = `\Marked`
+  Unmarked ListAttr = `\Unmarked`
+  // HasChildren and HasNoChildren are from RFC 3348.
+  HasChildren ListAttr = `\HasChildren`
+  HasNoChildren ListAttr = `\HasNoChildren`
+  // Subscribed and NonExistent are from RFC 5258.
+  Subscribed ListAttr = `\Subscribed`
+  NonExistent ListAttr = `\NonExistent`
+  // The special-use attributes are from RFC 6154.
+  UseAll ListAttr = `\All`
+  UseArchive ListAttr = `\Archive`
+  UseDrafts ListAttr = `\Drafts`
+  UseFlagged ListAttr = `\Flagged`
+  UseJunk ListAttr = `\Junk`
+  UseSent ListAttr = `\Sent`
+  UseTrash ListAttr = `\Trash`
 )
 
+// LookupSpecialUse returns the special-use attribute named "s",
+// ignoring case, e.g. `\sent`.
+func LookupSpecialUse(s string) (ListAttr, bool) {
+  for _, a := range []ListAttr{UseAll, UseArchive, UseDrafts, UseFlagged, UseJunk, UseSent, UseTrash} {
+    if strings.EqualFold(string(a), s) {
+      return a, true
+    }
+  }
+  return "", false
+}
+
 type Flag string
 const (
   Seen Flag = `\seen`
@@ -58,8 +193,18 @@ const (
   Deleted = `\deleted`
   Draft = `\draft`
   Recent = `\recent`
+  // NewKeywords is only used in PERMANENTFLAGS, to say that
+  // clients may create new keywords by storing them.
+  NewKeywords = `\*`
 )
 
+// SystemFlags are the flags which are always defined, and which clients
+// may change, in the order they're listed in the FLAGS response.
+var SystemFlags = []Flag{Answered, Flagged, Deleted, Seen, Draft}
+
+// LookupFlag returns the flag named "s". System flags, which start with
+// a backslash, are lower case. Keywords keep their case, because clients
+// show them to users, but like all flags they're compared ignoring case.
 func LookupFlag(s string) Flag {
   switch Flag(strings.ToLower(s)) {
   case Seen:
@@ -74,9 +219,11 @@ func LookupFlag(s string) Flag {
     return Draft
   case Recent:
     return Recent
-  default:
+  }
+  if strings.HasPrefix(s, `\`) {
     return Flag(strings.ToLower(s))
   }
+  return Flag(s)
 }
 
 func FlagsLine(w io.Writer, flags ...Flag) {
@@ -87,6 +234,16 @@ func FlagsLine(w io.Writer, flags ...Flag) {
   Line(w, "* FLAGS (%s)", strings.Join(s, " "))
 }
 
+// PermanentFlags writes the PERMANENTFLAGS response code,
+// which lists the flags the client can change permanently.
+func PermanentFlags(w io.Writer, flags ...Flag) {
+  var s []string
+  for _, flag := range flags {
+    s = append(s, string(flag))
+  }
+  Line(w, "* OK [PERMANENTFLAGS (%s)] Flags permitted", strings.Join(s, " "))
+}
+
 func LsubItem(w io.Writer, name, delimiter string, attrs ...ListAttr) {
   var s []string
   for _, attr := range attrs {
@@ -101,15 +258,27 @@ func LsubItem(w io.Writer, name, delimiter string, attrs ...ListAttr) {
 }
 
 func ListItem(w io.Writer, name, delimiter string, attrs ...ListAttr) {
+  listItem(w, name, delimiter, "", attrs)
+}
+
+// ListItemSubscribedChildren writes a LIST response with the CHILDINFO
+// extended data item from RFC 5258, which tells the client that
+// the mailbox has subscribed children, for RECURSIVEMATCH.
+func ListItemSubscribedChildren(w io.Writer, name, delimiter string, attrs ...ListAttr) {
+  listItem(w, name, delimiter, ` ("CHILDINFO" ("SUBSCRIBED"))`, attrs)
+}
+
+func listItem(w io.Writer, name, delimiter, ext string, attrs []ListAttr) {
   var s []string
   for _, attr := range attrs {
     s = append(s, string(attr))
   }
 
-  Line(w, `* LIST (%s) "%s" "%s"`,
+  Line(w, `* LIST (%s) "%s" "%s"%s`,
     strings.Join(s, " "),
     delimiter,
     name,
+    ext,
   )
 }
 
@@ -121,7 +290,11 @@ type SelectResponse struct {
   UIDNext int
   UIDValidity int
   Flags []Flag
+  PermanentFlags []Flag
   ReadWrite bool
+  // HighestModSeq is sent if non-zero (RFC 7162).
+  HighestModSeq int64
+  Resync
 }
 
 func (s *SelectResponse) EncodeIMAP(w io.Writer) {
@@ -129,10 +302,13 @@ func (s *SelectResponse) EncodeIMAP(w io.Writer) {
   Line(w, "* %d RECENT", s.Recent)
   FlagsLine(w, s.Flags...)
   Line(w, "* OK [UNSEEN %d]", s.Unseen)
-  // TODO determine the best permanent flags.
-  Line(w, `* OK [PERMANENTFLAGS (\Seen \Deleted)]`)
+  PermanentFlags(w, s.PermanentFlags...)
   Line(w, "* OK [UIDNEXT %d]", s.UIDNext)
   Line(w, "* OK [UIDVALIDITY %d]", s.UIDValidity)
+  if s.HighestModSeq != 0 {
+    Line(w, "* OK [HIGHESTMODSEQ %d]", s.HighestModSeq)
+  }
+  s.Resync.EncodeIMAP(w)
 
   if s.ReadWrite {
     Line(w, "%s OK [READ-WRITE] SELECT Completed", s.Tag)
@@ -149,6 +325,8 @@ type ExamineResponse struct {
   UIDNext int
   UIDValidity int
   Flags []Flag
+  HighestModSeq int64
+  Resync
 }
 
 func (s *ExamineResponse) EncodeIMAP(w io.Writer) {
@@ -156,12 +334,54 @@ func (s *ExamineResponse) EncodeIMAP(w io.Writer) {
   Line(w, "* %d RECENT", s.Recent)
   FlagsLine(w, s.Flags...)
   Line(w, "* OK [UNSEEN %d]", s.Unseen)
-  Line(w, `* OK [PERMANENTFLAGS ()`)
+  // No flags can be changed in a read-only mailbox.
+  PermanentFlags(w)
   Line(w, "* OK [UIDNEXT %d]", s.UIDNext)
   Line(w, "* OK [UIDVALIDITY %d]", s.UIDValidity)
+  if s.HighestModSeq != 0 {
+    Line(w, "* OK [HIGHESTMODSEQ %d]", s.HighestModSeq)
+  }
+  s.Resync.EncodeIMAP(w)
   Line(w, "%s OK [READ-ONLY] SELECT Completed", s.Tag)
 }
 
+// Resync holds the responses to the QRESYNC parameter of SELECT and
+// EXAMINE (RFC 7162): the UIDs expunged since the client's mod-sequence,
+// and FETCH responses for the messages changed since then.
+type Resync struct {
+  Vanished []int64
+  Changed []*FetchResult
+}
+
+func (r *Resync) EncodeIMAP(w io.Writer) {
+  if len(r.Vanished) > 0 {
+    Vanished(w, r.Vanished, true)
+  }
+  for _, res := range r.Changed {
+    res.Encode(w)
+  }
+}
+
+// Vanished writes the VANISHED response (RFC 7162), which replaces
+// EXPUNGE when QRESYNC is enabled. "earlier" is true when the UIDs
+// were expunged before the current command, e.g. "* VANISHED (EARLIER) 3:5".
+func Vanished(w io.Writer, uids []int64, earlier bool) {
+  if earlier {
+    Line(w, "* VANISHED (EARLIER) %s", UIDSet(uids))
+    return
+  }
+  Line(w, "* VANISHED %s", UIDSet(uids))
+}
+
+// Enabled writes the untagged ENABLED response (RFC 5161).
+func Enabled(w io.Writer, caps []string) {
+  if len(caps) == 0 {
+    Line(w, "* ENABLED")
+    return
+  }
+  Line(w, "* ENABLED %s", strings.Join(caps, " "))
+}
+
 type StatusResponse struct {
   Tag string
   Mailbox string
@@ -240,6 +460,88 @@ func (f *FetchResult) Encode(w io.Writer) error {
   return nil
 }
 
+// Search writes the untagged SEARCH response, which lists
+// all the matching message numbers (or UIDs) on one line.
+// If modseq is non-zero, it's appended as the highest mod-sequence
+// of the results (RFC 7162), e.g. "* SEARCH 2 5 (MODSEQ 917)".
+func Search(w io.Writer, ids []int64, modseq int64) {
+  var s []string
+  for _, id := range ids {
+    s = append(s, fmt.Sprint(id))
+  }
+  if len(s) == 0 {
+    Line(w, "* SEARCH")
+    return
+  }
+  if modseq != 0 {
+    s = append(s, fmt.Sprintf("(MODSEQ %d)", modseq))
+  }
+  Line(w, "* SEARCH %s", strings.Join(s, " "))
+}
+
+// Sort writes the untagged SORT response (RFC 5256).
+func Sort(w io.Writer, ids []int64) {
+  var s []string
+  for _, id := range ids {
+    s = append(s, fmt.Sprint(id))
+  }
+  if len(s) == 0 {
+    Line(w, "* SORT")
+    return
+  }
+  Line(w, "* SORT %s", strings.Join(s, " "))
+}
+
+// Thread is a message in a thread tree, built by the THREAD command.
+// ID is the message's sequence number (or UID), or zero if the message
+// is missing, e.g. a parent which was deleted or not in the search results.
+type Thread struct {
+  ID int64
+  Children []*Thread
+}
+
+// ThreadResponse writes the untagged THREAD response (RFC 5256),
+// e.g. "* THREAD (2)(3 6 (4 23)(44 7 96))".
+func ThreadResponse(w io.Writer, threads []*Thread) {
+  var b bytes.Buffer
+  b.WriteString("* THREAD")
+  for i, t := range threads {
+    if i == 0 {
+      b.WriteString(" ")
+    }
+    b.WriteString("(")
+    writeThread(&b, t)
+    b.WriteString(")")
+  }
+  Line(w, "%s", b.String())
+}
+
+// writeThread writes a thread node and its descendants. A chain of single
+// children is written as a list of IDs, e.g. "3 6", and multiple children
+// as a list of parenthesized subthreads, e.g. "(4 23)(44 7 96)".
+func writeThread(b *bytes.Buffer, t *Thread) {
+  if t.ID != 0 {
+    fmt.Fprint(b, t.ID)
+  }
+  switch len(t.Children) {
+  case 0:
+  case 1:
+    if t.ID != 0 {
+      b.WriteString(" ")
+    }
+    writeThread(b, t.Children[0])
+  default:
+    if t.ID != 0 {
+      b.WriteString(" ")
+    }
+    for _, c := range t.Children {
+      b.WriteString("(")
+      writeThread(b, c)
+      b.WriteString(")")
+    }
+  }
+}
+
 func Expunge(w io.Writer, tag string, ids []int) {
   for _, id := range ids {
     Line(w, "* %d EXPUNGE", id)
@@ -266,11 +568,19 @@ type Bodystructure interface {
 }
 func (*MultipartStructure) isBodystructure() {}
 func (*PartStructure) isBodystructure() {}
+func (*MessageStructure) isBodystructure() {}
 
+// MultipartStructure is the body structure of a multipart/* body part.
 type MultipartStructure struct {
   Subtype string
   Params map[string]string
-  Parts []*PartStructure
+  Parts []Bodystructure
+  Disposition *Disposition
+  Language []string
+  Location string
+  // Extended includes the extension data, which is sent for BODYSTRUCTURE
+  // but not for BODY.
+  Extended bool
 }
 
 func (m *MultipartStructure) EncodeIMAP(w io.Writer) {
@@ -280,39 +590,91 @@ func (m *MultipartStructure) EncodeIMAP(w io.Writer) {
   }
   fmt.Fprint(w, " ")
   stringOr(w, m.Subtype, "NIL")
+
+  if m.Extended {
+    fmt.Fprint(w, " ")
+    paramList(w, m.Params)
+    fmt.Fprint(w, " ")
+    m.Disposition.EncodeIMAP(w)
+    fmt.Fprint(w, " ")
+    languageList(w, m.Language)
+    fmt.Fprint(w, " ")
+    stringOr(w, m.Location, "NIL")
+  }
+  fmt.Fprint(w, ")")
+}
+
+// Disposition is the parsed Content-Disposition of a body part (RFC 2183).
+type Disposition struct {
+  Type string
+  Params map[string]string
+}
+
+func (d *Disposition) EncodeIMAP(w io.Writer) {
+  if d == nil {
+    fmt.Fprint(w, "NIL")
+    return
+  }
+  fmt.Fprint(w, "(")
+  String(w, d.Type)
   fmt.Fprint(w, " ")
-  paramList(w, m.Params)
-  fmt.Fprint(w, " NIL NIL")
+  paramList(w, d.Params)
   fmt.Fprint(w, ")")
 }
 
 func paramList(w io.Writer, params map[string]string) {
-  if params == nil {
+  if len(params) == 0 {
     fmt.Fprint(w, "NIL")
     return
   }
 
-  fmt.Fprint(w, "(")
+  // Sort the keys so the output is stable.
+  var keys []string
+  for k := range params {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
 
-  started := false
-  for k, v := range params {
-    if started {
+  fmt.Fprint(w, "(")
+  for i, k := range keys {
+    if i > 0 {
       fmt.Fprint(w, " ")
     }
-    fmt.Fprintf(w, "%q %q", k, v)
-    started = true
+    String(w, k)
+    fmt.Fprint(w, " ")
+    String(w, params[k])
   }
   fmt.Fprint(w, ")")
 }
 
+func languageList(w io.Writer, langs []string) {
+  switch len(langs) {
+  case 0:
+    fmt.Fprint(w, "NIL")
+  case 1:
+    String(w, langs[0])
+  default:
+    fmt.Fprint(w, "(")
+    for i, l := range langs {
+      if i > 0 {
+        fmt.Fprint(w, " ")
+      }
+      String(w, l)
+    }
+    fmt.Fprint(w, ")")
+  }
+}
+
 func stringOr(w io.Writer, s string, x string) {
   if s == "" {
     fmt.Fprint(w, x)
     return
   }
-  fmt.Fprintf(w, "%q", s)
+  String(w, s)
 }
 
+// PartStructure is the body structure of a non-multipart body part,
+// such as text/plain or image/png.
 type PartStructure struct {
   Type string
   Subtype string
@@ -321,15 +683,37 @@ type PartStructure struct {
   Description string
   Encoding string
   Size int
+  // Lines is only sent for text/* parts (and message/rfc822 parts,
+  // see MessageStructure).
   Lines int
   MD5 string
-  // TODO Disposition 
-  Language string
+  Disposition *Disposition
+  Language []string
   Location string
+  // Extended includes the extension data, which is sent for BODYSTRUCTURE
+  // but not for BODY.
+  Extended bool
 }
 
 func (p *PartStructure) EncodeIMAP(w io.Writer) {
-  fmt.Fprintf(w, "(%q %q ", p.Type, p.Subtype)
+  fmt.Fprint(w, "(")
+  p.encodeFields(w)
+  if strings.ToLower(p.Type) == "text" {
+    fmt.Fprintf(w, " %d", p.Lines)
+  }
+  p.encodeExtension(w)
+  fmt.Fprint(w, ")")
+}
+
+// encodeFields writes the media type and body fields:
+//
+//   media-type SP body-fld-param SP body-fld-id SP body-fld-desc SP
+//   body-fld-enc SP body-fld-octets
+func (p *PartStructure) encodeFields(w io.Writer) {
+  String(w, p.Type)
+  fmt.Fprint(w, " ")
+  String(w, p.Subtype)
+  fmt.Fprint(w, " ")
   paramList(w, p.Params)
   fmt.Fprint(w, " ")
   stringOr(w, p.ID, "NIL")
@@ -337,14 +721,42 @@ func (p *PartStructure) EncodeIMAP(w io.Writer) {
   stringOr(w, p.Description, "NIL")
   fmt.Fprint(w, " ")
   stringOr(w, p.Encoding, "NIL")
-  fmt.Fprintf(w, " %d %d ", p.Size, p.Lines)
+  fmt.Fprintf(w, " %d", p.Size)
+}
+
+// encodeExtension writes the single part extension data, if Extended is true:
+//
+//   body-fld-md5 SP body-fld-dsp SP body-fld-lang SP body-fld-loc
+func (p *PartStructure) encodeExtension(w io.Writer) {
+  if !p.Extended {
+    return
+  }
+  fmt.Fprint(w, " ")
   stringOr(w, p.MD5, "NIL")
   fmt.Fprint(w, " ")
-  // TODO disposition
-  fmt.Fprint(w, "NIL")
+  p.Disposition.EncodeIMAP(w)
   fmt.Fprint(w, " ")
-  stringOr(w, p.Language, "NIL")
+  languageList(w, p.Language)
   fmt.Fprint(w, " ")
   stringOr(w, p.Location, "NIL")
+}
+
+// MessageStructure is the body structure of a message/rfc822 body part,
+// which includes the envelope and body structure of the encapsulated message.
+type MessageStructure struct {
+  PartStructure
+  Envelope *Envelope
+  Body Bodystructure
+}
+
+func (m *MessageStructure) EncodeIMAP(w io.Writer) {
+  fmt.Fprint(w, "(")
+  m.encodeFields(w)
+  fmt.Fprint(w, " ")
+  m.Envelope.EncodeIMAP(w)
+  fmt.Fprint(w, " ")
+  m.Body.EncodeIMAP(w)
+  fmt.Fprintf(w, " %d", m.Lines)
+  m.encodeExtension(w)
   fmt.Fprint(w, ")")
 }
@@ -0,0 +1,40 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+// mailboxFlags returns the flags for the FLAGS response:
+// the system flags and the keywords used in the mailbox.
+func mailboxFlags(keywords []imap.Flag) []imap.Flag {
+  var flags []imap.Flag
+  flags = append(flags, imap.SystemFlags...)
+  return append(flags, keywords...)
+}
+
+// permanentFlags returns the flags for the PERMANENTFLAGS response code
+// of a mailbox opened read-write. Clients may create new keywords.
+func permanentFlags(keywords []imap.Flag) []imap.Flag {
+  return append(mailboxFlags(keywords), imap.NewKeywords)
+}
+
+// updateKeywords sends the FLAGS response again when a new keyword was
+// used in the selected mailbox, e.g. by STORE or APPEND in another
+// connection. Keywords are never removed from a mailbox, so only
+// the number of keywords needs to be compared.
+func (f *fake) updateKeywords() error {
+  keywords, err := f.db.Keywords(f.mailbox)
+  if err != nil {
+    return err
+  }
+  if len(keywords) == len(f.keywords) {
+    return nil
+  }
+
+  f.keywords = keywords
+  imap.FlagsLine(f.w, mailboxFlags(keywords)...)
+  if !f.readOnly {
+    imap.PermanentFlags(f.w, permanentFlags(keywords)...)
+  }
+  return nil
+}
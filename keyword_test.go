@@ -0,0 +1,99 @@
+package mailer
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func TestMailboxFlags(t *testing.T) {
+  tests := []struct {
+    keywords []imap.Flag
+    flags, permanent string
+  }{
+    {
+      nil,
+      "* FLAGS (\\answered \\flagged \\deleted \\seen \\draft)\r\n",
+      "* OK [PERMANENTFLAGS (\\answered \\flagged \\deleted \\seen \\draft \\*)] Flags permitted\r\n",
+    },
+    {
+      []imap.Flag{"$Junk", "project-x"},
+      "* FLAGS (\\answered \\flagged \\deleted \\seen \\draft $Junk project-x)\r\n",
+      "* OK [PERMANENTFLAGS (\\answered \\flagged \\deleted \\seen \\draft $Junk project-x \\*)] Flags permitted\r\n",
+    },
+  }
+
+  for _, test := range tests {
+    buf := &bytes.Buffer{}
+    imap.FlagsLine(buf, mailboxFlags(test.keywords)...)
+    if buf.String() != test.flags {
+      t.Errorf("flags for %v: expected %q, got %q", test.keywords, test.flags, buf.String())
+    }
+
+    buf.Reset()
+    imap.PermanentFlags(buf, permanentFlags(test.keywords)...)
+    if buf.String() != test.permanent {
+      t.Errorf("permanent flags for %v: expected %q, got %q", test.keywords, test.permanent, buf.String())
+    }
+  }
+}
+
+func TestUpdateKeywords(t *testing.T) {
+  dir, err := ioutil.TempDir("", "mailer-keyword-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  db, err := model.Open(dir)
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer db.Close()
+
+  add := func(flags ...imap.Flag) {
+    _, err := db.CreateMessage("INBOX", strings.NewReader("Subject: test\r\n\r\n"), flags)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  add("$Junk")
+
+  tests := []struct {
+    desc string
+    readOnly bool
+    flags []imap.Flag
+    expect string
+  }{
+    {"new keyword", false, []imap.Flag{"$Forwarded"},
+      "* FLAGS (\\answered \\flagged \\deleted \\seen \\draft $Junk $Forwarded)\r\n" +
+        "* OK [PERMANENTFLAGS (\\answered \\flagged \\deleted \\seen \\draft $Junk $Forwarded \\*)] Flags permitted\r\n"},
+    {"known keyword", false, []imap.Flag{"$junk", imap.Seen}, ""},
+    // PERMANENTFLAGS isn't sent for a mailbox opened by EXAMINE.
+    {"read-only", true, []imap.Flag{"project-x"},
+      "* FLAGS (\\answered \\flagged \\deleted \\seen \\draft $Junk $Forwarded project-x)\r\n"},
+  }
+
+  for _, test := range tests {
+    buf := &bytes.Buffer{}
+    f := &fake{db: db, mailbox: "INBOX", w: buf, readOnly: test.readOnly}
+    f.keywords, err = db.Keywords("INBOX")
+    if err != nil {
+      t.Fatal(err)
+    }
+
+    add(test.flags...)
+    err := f.updateKeywords()
+    if err != nil {
+      t.Errorf("%s: %v", test.desc, err)
+      continue
+    }
+    if buf.String() != test.expect {
+      t.Errorf("%s: expected %q, got %q", test.desc, test.expect, buf.String())
+    }
+  }
+}
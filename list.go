@@ -0,0 +1,297 @@
+package mailer
+
+import (
+  "sort"
+  "strings"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func init() {
+  registerCapability("CHILDREN", "LIST-EXTENDED", "SPECIAL-USE")
+}
+
+// List implements LIST (RFC 3501 section 6.3.8) and the extended LIST
+// from RFC 5258. The reference and each pattern are joined, and matched
+// against the mailbox hierarchy, where "*" matches any characters and
+// "%" matches any characters except the hierarchy delimiter.
+//
+// The SUBSCRIBED selection option lists the subscriptions instead,
+// including those to mailboxes which don't exist. The SPECIAL-USE option
+// (RFC 6154) lists only the mailboxes with special-use attributes, which
+// are always returned.
+func (f *fake) List(cmd *imap.ListCommand) {
+  selectSubscribed := hasOption(cmd.Select, "subscribed")
+  selectSpecialUse := hasOption(cmd.Select, "special-use")
+  recursive := hasOption(cmd.Select, "recursivematch")
+  returnSubscribed := hasOption(cmd.Return, "subscribed")
+
+  if recursive && !selectSubscribed && !selectSpecialUse {
+    imap.Bad(f.w, cmd.Tag, "RECURSIVEMATCH requires another selection option")
+    return
+  }
+
+  // An empty pattern asks for the delimiter and the root of the reference.
+  if len(cmd.Queries) == 1 && cmd.Queries[0] == "" {
+    imap.ListItem(f.w, "", model.Delimiter, imap.NoSelect)
+    imap.Complete(f.w, cmd.Tag, "LIST")
+    return
+  }
+
+  boxes, err := f.db.ListMailboxes()
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "database error: listing mailboxes: %v", err)
+    return
+  }
+
+  var names []string
+  uses := map[string][]imap.ListAttr{}
+  for _, box := range boxes {
+    names = append(names, box.Name)
+    uses[strings.ToLower(box.Name)] = box.SpecialUse
+  }
+  tree := mailboxTree(names)
+
+  if selectSubscribed || returnSubscribed {
+    subs, err := f.db.Subscriptions()
+    if err != nil {
+      imap.No(f.w, cmd.Tag, "%s", err)
+      return
+    }
+    tree = addSubscriptions(tree, subs)
+  }
+
+  var patterns []string
+  for _, q := range cmd.Queries {
+    patterns = append(patterns, listPattern(cmd.Mailbox, q))
+  }
+
+  for _, node := range tree {
+    if !listMatchAny(patterns, node.name) {
+      continue
+    }
+
+    show := !node.nonexistent
+    childInfo := false
+    if selectSubscribed {
+      childInfo = recursive && node.subscribedChildren
+      show = node.subscribed || childInfo
+    }
+    use := uses[strings.ToLower(node.name)]
+    if selectSpecialUse && len(use) == 0 {
+      show = false
+    }
+    if !show {
+      continue
+    }
+
+    attrs := node.attrs()
+    if node.subscribed {
+      attrs = append(attrs, imap.Subscribed)
+    }
+    attrs = append(attrs, use...)
+    if childInfo {
+      imap.ListItemSubscribedChildren(f.w, node.name, model.Delimiter, attrs...)
+    } else {
+      imap.ListItem(f.w, node.name, model.Delimiter, attrs...)
+    }
+  }
+  imap.Complete(f.w, cmd.Tag, "LIST")
+}
+
+// Lsub implements LSUB (RFC 3501 section 6.3.9), which lists the
+// subscriptions matching the pattern. When a pattern matches the parent
+// of a subscription, but not the subscription itself, e.g. "%" and "a/b",
+// the parent is listed as \Noselect, unless it's subscribed too.
+func (f *fake) Lsub(cmd *imap.LsubCommand) {
+  subs, err := f.db.Subscriptions()
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "%s", err)
+    return
+  }
+
+  pattern := listPattern(cmd.Mailbox, cmd.Query)
+  for _, node := range addSubscriptions(nil, subs) {
+    if !listMatch(pattern, node.name) {
+      continue
+    }
+    if node.subscribed {
+      imap.LsubItem(f.w, node.name, model.Delimiter)
+    } else if !matchesChild(pattern, node.name, subs) {
+      imap.LsubItem(f.w, node.name, model.Delimiter, imap.NoSelect)
+    }
+  }
+  imap.Complete(f.w, cmd.Tag, "LSUB")
+}
+
+// listPattern joins the LIST reference and pattern. A pattern which
+// starts with the delimiter is absolute, so the reference is ignored.
+func listPattern(ref, pattern string) string {
+  if ref == "" || strings.HasPrefix(pattern, model.Delimiter) {
+    return pattern
+  }
+  if !strings.HasSuffix(ref, model.Delimiter) {
+    ref += model.Delimiter
+  }
+  return ref + pattern
+}
+
+// listMatch returns true if the mailbox name matches the LIST pattern.
+// Like the database, names are compared ignoring case.
+func listMatch(pattern, name string) bool {
+  return match(strings.ToLower(pattern), strings.ToLower(name))
+}
+
+func listMatchAny(patterns []string, name string) bool {
+  for _, p := range patterns {
+    if listMatch(p, name) {
+      return true
+    }
+  }
+  return false
+}
+
+// matchesChild returns true if the pattern matches any of the names
+// below the given parent.
+func matchesChild(pattern, parent string, names []string) bool {
+  prefix := strings.ToLower(parent + model.Delimiter)
+  for _, name := range names {
+    if strings.HasPrefix(strings.ToLower(name), prefix) && listMatch(pattern, name) {
+      return true
+    }
+  }
+  return false
+}
+
+func hasOption(opts []string, name string) bool {
+  for _, o := range opts {
+    if o == name {
+      return true
+    }
+  }
+  return false
+}
+
+func match(pattern, name string) bool {
+  for pattern != "" {
+    c := pattern[0]
+    if c == '*' || c == '%' {
+      rest := pattern[1:]
+      for i := 0; i <= len(name); i++ {
+        if match(rest, name[i:]) {
+          return true
+        }
+        // "%" doesn't match the delimiter.
+        if c == '%' && strings.HasPrefix(name[i:], model.Delimiter) {
+          return false
+        }
+      }
+      return false
+    }
+    if name == "" || name[0] != c {
+      return false
+    }
+    pattern, name = pattern[1:], name[1:]
+  }
+  return name == ""
+}
+
+// listNode is a mailbox in the hierarchy. A node which isn't a mailbox,
+// e.g. "a" when only "a/b" exists, is a \Noselect parent. A node which
+// isn't in the hierarchy at all only comes from a subscription.
+type listNode struct {
+  name string
+  noselect bool
+  children bool
+  nonexistent bool
+  subscribed bool
+  subscribedChildren bool
+}
+
+func (n *listNode) attrs() []imap.ListAttr {
+  // \NonExistent implies \Noselect, and the children of
+  // a mailbox which doesn't exist aren't known.
+  if n.nonexistent {
+    return []imap.ListAttr{imap.NonExistent}
+  }
+
+  var attrs []imap.ListAttr
+  if n.noselect {
+    attrs = append(attrs, imap.NoSelect)
+  }
+  if n.children {
+    attrs = append(attrs, imap.HasChildren)
+  } else {
+    attrs = append(attrs, imap.HasNoChildren)
+  }
+  return attrs
+}
+
+// mailboxTree returns the nodes of the mailbox hierarchy formed by the
+// mailbox names, including \Noselect parents, sorted by name.
+func mailboxTree(names []string) []*listNode {
+  nodes := map[string]*listNode{}
+  for _, name := range names {
+    nodes[strings.ToLower(name)] = &listNode{name: name}
+  }
+
+  for _, name := range names {
+    parts := strings.Split(name, model.Delimiter)
+    for i := 1; i < len(parts); i++ {
+      parent := strings.Join(parts[:i], model.Delimiter)
+      key := strings.ToLower(parent)
+      n, ok := nodes[key]
+      if !ok {
+        n = &listNode{name: parent, noselect: true}
+        nodes[key] = n
+      }
+      n.children = true
+    }
+  }
+
+  var list []*listNode
+  for _, n := range nodes {
+    list = append(list, n)
+  }
+  sortNodes(list)
+  return list
+}
+
+// addSubscriptions marks the subscribed nodes of the hierarchy, and the
+// nodes with subscribed children. Subscriptions to mailboxes which don't
+// exist, and their parents, are added as nonexistent nodes.
+func addSubscriptions(tree []*listNode, subs []string) []*listNode {
+  nodes := map[string]*listNode{}
+  for _, n := range tree {
+    nodes[strings.ToLower(n.name)] = n
+  }
+
+  node := func(name string) *listNode {
+    key := strings.ToLower(name)
+    n, ok := nodes[key]
+    if !ok {
+      n = &listNode{name: name, nonexistent: true}
+      nodes[key] = n
+      tree = append(tree, n)
+    }
+    return n
+  }
+
+  for _, name := range subs {
+    node(name).subscribed = true
+
+    parts := strings.Split(name, model.Delimiter)
+    for i := 1; i < len(parts); i++ {
+      node(strings.Join(parts[:i], model.Delimiter)).subscribedChildren = true
+    }
+  }
+
+  sortNodes(tree)
+  return tree
+}
+
+func sortNodes(list []*listNode) {
+  sort.Slice(list, func(i, j int) bool {
+    return list[i].name < list[j].name
+  })
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestListMatch(t *testing.T) {
+  tests := []struct {
+    pattern, name string
+    match bool
+  }{
+    {"*", "a", true},
+    {"*", "a/b/c", true},
+    {"%", "a", true},
+    {"%", "a/b", false},
+    {"a/%", "a/b", true},
+    {"a/%", "a/b/c", false},
+    {"a/*", "a/b/c", true},
+    {"a/*", "a", false},
+    {"a*", "ab/c", true},
+    {"a%", "ab/c", false},
+    {"%/b", "a/b", true},
+    {"inbox", "INBOX", true},
+    {"a", "ab", false},
+  }
+
+  for _, test := range tests {
+    if listMatch(test.pattern, test.name) != test.match {
+      t.Errorf("listMatch(%q, %q) should be %v", test.pattern, test.name, test.match)
+    }
+  }
+
+  if p := listPattern("a/b", "%"); p != "a/b/%" {
+    t.Errorf("unexpected pattern %q", p)
+  }
+  if p := listPattern("a/", "/c"); p != "/c" {
+    t.Errorf("unexpected pattern %q", p)
+  }
+}
+
+func TestAddSubscriptions(t *testing.T) {
+  tree := addSubscriptions(mailboxTree([]string{"a/b", "c"}), []string{"A/b", "x/y"})
+
+  var got []string
+  for _, n := range tree {
+    s := n.name
+    if n.subscribed {
+      s += " subscribed"
+    }
+    if n.subscribedChildren {
+      s += " children"
+    }
+    if n.nonexistent {
+      s += " nonexistent"
+    }
+    got = append(got, s)
+  }
+
+  expect := []string{
+    "a children",
+    "a/b subscribed",
+    "c",
+    "x children nonexistent",
+    "x/y subscribed nonexistent",
+  }
+  if strings.Join(got, ",") != strings.Join(expect, ",") {
+    t.Errorf("unexpected nodes: %q", got)
+  }
+}
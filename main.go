@@ -4,7 +4,7 @@ import (
   "fmt"
   "net"
   "log"
-  "io"
+  "sync"
   "crypto/tls"
   "github.com/buchanae/mailer/model"
   "github.com/buchanae/mailer/imap"
@@ -28,6 +28,10 @@ func Run(opt ServerOpt) {
   }
   defer db.Close()
 
+  if !db.FullTextSearch() {
+    log.Println(`WARNING: mailer was built without the full-text search index, so BODY and TEXT searches read every message. Build it with "-tags sqlite_fts5", e.g. by "make install".`)
+  }
+
 /*
   go func() {
 
@@ -54,9 +58,19 @@ func Run(opt ServerOpt) {
   }()
 */
 
-  ln := listenIMAP(opt)
-  defer ln.Close()
-  log.Println("listening on " + opt.IMAP.Addr)
+  listeners := opt.IMAP.enabledListeners()
+  if len(listeners) == 0 {
+    log.Fatalln("no IMAP listeners are configured")
+  }
+
+  // Load the TLS certificates, if needed.
+  var tlsconf *tls.Config
+  for _, l := range listeners {
+    if l.usesTLS() {
+      tlsconf = loadTLSConfig(opt.TLS)
+      break
+    }
+  }
 
   // Set up some connection logging.
   connLogger, err := logConnectionToFile(opt.Debug.ConnLog)
@@ -65,75 +79,121 @@ func Run(opt ServerOpt) {
   }
   defer connLogger.Close()
 
+  var wg sync.WaitGroup
+  for _, l := range listeners {
+    var ln net.Listener
+    if l.ImplicitTLS {
+      ln = listenIMAPTLS(l, tlsconf)
+    } else {
+      ln = listenIMAP(l)
+    }
+    defer ln.Close()
+    log.Println("listening on " + l.Addr)
+
+    wg.Add(1)
+    go func(ln net.Listener, l IMAPListenerOpt) {
+      defer wg.Done()
+      serveIMAP(ln, l, opt, db, tlsconf, connLogger)
+    }(ln, l)
+  }
+  wg.Wait()
+}
+
+func serveIMAP(ln net.Listener, l IMAPListenerOpt, opt ServerOpt, db *model.DB, tlsconf *tls.Config, connLogger *connectionLogger) {
   for {
     conn, err := ln.Accept()
     if err != nil {
       log.Fatalln("failed to accept", err)
     }
-    // Set up some connection logging.
-    c := connLogger.Log(conn)
-    go handleConn(c, opt, db)
+
+    ctrl := &fake{
+      db: db,
+      user: opt.User,
+      allowPlaintextAuth: l.AllowPlaintextAuth,
+      connLog: connLogger,
+      id: opt.IMAP.ID,
+      sharedNamespace: opt.IMAP.SharedNamespace,
+    }
+    if l.StartTLS {
+      ctrl.tlsconf = tlsconf
+    }
+    go handleConn(conn, ctrl)
+  }
+}
+
+func listenIMAP(opt IMAPListenerOpt) net.Listener {
+  ln, err := net.Listen("tcp", opt.Addr)
+  if err != nil {
+    log.Fatalln("failed to listen", err)
   }
+  return ln
 }
 
-func listenIMAP(opt ServerOpt) net.Listener {
-  ln, err := net.Listen("tcp", opt.IMAP.Addr)
+func listenIMAPTLS(opt IMAPListenerOpt, tlsconf *tls.Config) net.Listener {
+  ln, err := tls.Listen("tcp", opt.Addr, tlsconf)
   if err != nil {
     log.Fatalln("failed to listen", err)
   }
   return ln
 }
 
-func listenIMAPTLS(opt ServerOpt) net.Listener {
-  cert, err := tls.LoadX509KeyPair(opt.TLS.Cert, opt.TLS.Key)
+func loadTLSConfig(opt TLSOpt) *tls.Config {
+  cert, err := tls.LoadX509KeyPair(opt.Cert, opt.Key)
   if err != nil {
     log.Fatalln("loading TLS certs", err)
   }
 
-  tlsconf := &tls.Config{
+  return &tls.Config{
     Certificates: []tls.Certificate{cert},
   }
-  ln, err := tls.Listen("tcp", opt.IMAP.Addr, tlsconf)
-  if err != nil {
-    log.Fatalln("failed to listen", err)
-  }
-  return ln
 }
 
-func handleConn(conn io.ReadWriteCloser, opt ServerOpt, db *model.DB) {
-  defer conn.Close()
-
-  // Decode IMAP commands from the connection.
-  d := imap.NewCommandDecoder(conn)
+func handleConn(conn net.Conn, ctrl *fake) {
+  // The connection may be replaced during STARTTLS,
+  // so close whichever connection is current at the end.
+  defer func() {
+    ctrl.conn.Close()
+  }()
 
-  ctrl := &fake{
-    db: db,
-    w: conn,
-    user: opt.User,
-  }
+  _, isTLS := conn.(*tls.Conn)
+  ctrl.setConn(conn, isTLS)
   ctrl.Start()
+  defer ctrl.Stop()
 
-  for ctrl.Ready() && d.Next() {
+  // ctrl.d decodes IMAP commands from the connection.
+  // It's rebuilt when the connection is upgraded by STARTTLS.
+  for ctrl.Ready() && ctrl.d.Next() {
     // cmd is expected to always be non-nil;
     // if nothing else, it's *imap.UnknownCommand{Tag: "*"}
-    cmd := d.Command()
+    cmd := ctrl.d.Command()
+
+    // Reject commands which aren't valid in the current state,
+    // e.g. FETCH before LOGIN, or FETCH before SELECT.
+    if err := checkState(cmd, ctrl.state); err != nil {
+      imap.Bad(ctrl.w, cmd.IMAPTag(), "%v", err)
+      continue
+    }
+
+    // Tell the client about changes made to the selected mailbox
+    // by other connections since the last command.
+    ctrl.update()
 
     // TODO command handling should probably be async?
     //      but only some commands are async?
     switchCommand(cmd, ctrl)
   }
 
-  err := d.Err()
+  err := ctrl.d.Err()
   if err != nil {
     log.Println(err)
 
     // Log the line received and the last position of the parser.
     // Useful while writing/debugging the command parser.
-    log.Print(d.Debug())
+    log.Print(ctrl.d.Debug())
 
     // IMAP "BAD" is the response for a bad command (unparseable, unrecognized, etc).
     // TODO get last command tag?
-    fmt.Fprintf(conn, "* BAD %s\r\n", err)
+    fmt.Fprintf(ctrl.w, "* BAD %s\r\n", err)
   }
 }
 
@@ -152,6 +212,9 @@ func switchCommand(cmd imap.Command, ctrl Controller) {
   case *imap.ExpungeCommand:
     ctrl.Expunge(z)
 
+  case *imap.IdleCommand:
+    ctrl.Idle(z)
+
   case *imap.LoginCommand:
     ctrl.Login(z)
 
@@ -203,14 +266,30 @@ func switchCommand(cmd imap.Command, ctrl Controller) {
   case *imap.SearchCommand:
     ctrl.Search(z)
 
+  case *imap.SortCommand:
+    ctrl.Sort(z)
+
+  case *imap.ThreadCommand:
+    ctrl.Thread(z)
+
   case *imap.CopyCommand:
     ctrl.Copy(z)
 
+  case *imap.MoveCommand:
+    ctrl.Move(z)
+
+  case *imap.EnableCommand:
+    ctrl.Enable(z)
+
+  case *imap.NamespaceCommand:
+    ctrl.Namespace(z)
+
+  case *imap.IDCommand:
+    ctrl.ID(z)
+
   case *imap.StoreCommand:
     ctrl.Store(z)
 
-  // TODO server needs to send command in order to accept
-  //      literal data for some commands, such as append.
   case *imap.AppendCommand:
     ctrl.Append(z)
 
@@ -223,7 +302,19 @@ func switchCommand(cmd imap.Command, ctrl Controller) {
   case *imap.UIDSearchCommand:
     ctrl.UIDSearch(z.SearchCommand)
 
+  case *imap.UIDSortCommand:
+    ctrl.UIDSort(z.SortCommand)
+
+  case *imap.UIDThreadCommand:
+    ctrl.UIDThread(z.ThreadCommand)
+
   case *imap.UIDCopyCommand:
     ctrl.UIDCopy(z.CopyCommand)
+
+  case *imap.UIDMoveCommand:
+    ctrl.UIDMove(z.MoveCommand)
+
+  case *imap.UIDExpungeCommand:
+    ctrl.UIDExpunge(z)
   }
 }
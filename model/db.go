@@ -7,8 +7,8 @@ import (
   "os"
   "database/sql"
   "net/mail"
-  _ "github.com/mattn/go-sqlite3"
   "fmt"
+  "log"
   "github.com/buchanae/mailer/imap"
   "path/filepath"
 )
@@ -27,7 +27,7 @@ func Open(path string) (*DB, error) {
   }
 
   // Open the sqlite database.
-	db, err := sql.Open("sqlite3", filepath.Join(path, "mailer.db"))
+	db, err := sql.Open(driverName, filepath.Join(path, "mailer.db"))
 	if err != nil {
     return nil, fmt.Errorf("opening database connection: %s", err)
 	}
@@ -44,12 +44,30 @@ func Open(path string) (*DB, error) {
     return nil, fmt.Errorf("configuring database connection: %s", err)
 	}
 
-  return &DB{path: path, db: db}, nil
+  d := &DB{
+    path: path,
+    db: db,
+    notify: &notifier{listeners: map[*Listener]bool{}},
+  }
+  d.initFTS()
+
+  err = d.provision()
+  if err != nil {
+    db.Close()
+    return nil, err
+  }
+  return d, nil
 }
 
 type DB struct {
   path string
   db *sql.DB
+  notify *notifier
+  // fts is true if the full-text search index is available.
+  fts bool
+  // origin is the listener which isn't notified of changes made
+  // through this DB. See From.
+  origin *Listener
 }
 
 func (db *DB) Close() error {
@@ -164,8 +182,11 @@ func (db *DB) Message(rowID int) (*Message, error) {
     id,
     size,
     created,
-    path
-  from message where row_id = ?`
+    path,
+    coalesce(mm.modseq, 1)
+  from message
+  left join message_modseq as mm on mm.message_row_id = message.row_id
+  where row_id = ?`
 
   row := db.db.QueryRow(q, rowID)
   err := row.Scan(
@@ -174,6 +195,7 @@ func (db *DB) Message(rowID int) (*Message, error) {
     &msg.Size,
     &msg.Created,
     &msg.Path,
+    &msg.ModSeq,
   )
   if err != nil {
     return nil, fmt.Errorf("loading message from database: %v", err)
@@ -192,6 +214,26 @@ func (db *DB) Message(rowID int) (*Message, error) {
   return msg, nil
 }
 
+// MessageByUID loads the message with the given UID from the mailbox.
+func (db *DB) MessageByUID(mailbox string, uid int64) (*Message, error) {
+  var rowID int
+
+  row := db.db.QueryRow(
+    `select m.row_id
+    from message as m
+    join mailbox as b
+    on m.mailbox_id = b.id
+    where b.name = ?
+    and m.id = ?`,
+    mailbox, uid)
+
+  err := row.Scan(&rowID)
+  if err != nil {
+    return nil, fmt.Errorf("loading message from database: %v", err)
+  }
+  return db.Message(rowID)
+}
+
 func (db *DB) messageBodyPath(boxID, msgID int) (string, error) {
   boxDir := filepath.Join(db.path, "messages", fmt.Sprint(boxID))
   // Split the files into groups of 1000.
@@ -238,10 +280,13 @@ func (db *DB) addHeaders(tx *sql.Tx, rowID int, headers Headers) error {
 
 func (db *DB) CreateMessage(mailbox string, body io.Reader, flags []imap.Flag) (*Message, error) {
   var msg *Message
+  var boxID int
 
   dberr := db.withTx(func(tx *sql.Tx) error {
 
-    boxID, msgID, err := db.nextID(tx, mailbox)
+    var msgID int
+    var err error
+    boxID, msgID, err = db.nextID(tx, mailbox)
     if err != nil {
       return err
     }
@@ -278,50 +323,267 @@ func (db *DB) CreateMessage(mailbox string, body io.Reader, flags []imap.Flag) (
       return fmt.Errorf("database error: inserting message: %v", err)
     }
 
+    err = db.indexMessage(tx, msg.RowID, msg.Path)
+    if err != nil {
+      return err
+    }
     return nil
   })
 
+  if dberr == nil {
+    db.publish(Change{Kind: MessageCreated, MailboxID: boxID, UID: msg.ID})
+  }
   return msg, dberr
 }
 
 func (db *DB) CopyMessage(msg *Message, to string) (*Message, error) {
   var res *Message
+  var boxID int
 
   dberr := db.withTx(func(tx *sql.Tx) error {
+    var err error
+    res, boxID, err = db.copyMessage(tx, msg, to)
+    return err
+  })
+  if dberr != nil {
+    if res != nil {
+      os.Remove(res.Path)
+    }
+    return nil, dberr
+  }
+
+  db.publish(Change{Kind: MessageCreated, MailboxID: boxID, UID: res.ID})
+  return res, nil
+}
+
+// copyMessage adds a copy of the message to the "to" mailbox.
+// If the copy is added, but the transaction fails later, the caller
+// must remove the copy's body file.
+func (db *DB) copyMessage(tx *sql.Tx, msg *Message, to string) (*Message, int, error) {
+  boxID, msgID, err := db.nextID(tx, to)
+  if err != nil {
+    return nil, 0, err
+  }
+
+  path, err := db.messageBodyPath(boxID, msgID)
+  if err != nil {
+    return nil, 0, err
+  }
+  // The copy shares the body file with the original via a hard link,
+  // so the file is only freed when all messages linked to it are expunged.
+  err = os.Link(msg.Path, path)
+  if err != nil {
+    return nil, 0, fmt.Errorf("linking message body file: %v", err)
+  }
+
+  res := &Message{
+    ID: int64(msgID),
+    Size: msg.Size,
+    Headers: msg.Headers,
+    Flags: append([]imap.Flag(nil), msg.Flags...),
+    Created: msg.Created,
+    Path: path,
+  }
+
+  err = db.insertMessage(tx, boxID, res)
+  if err != nil {
+    os.Remove(path)
+    return nil, 0, fmt.Errorf("database error: inserting message: %v", err)
+  }
+
+  err = db.indexMessage(tx, res.RowID, res.Path)
+  if err != nil {
+    os.Remove(path)
+    return nil, 0, err
+  }
+  return res, boxID, nil
+}
+
+// MoveMessages moves messages from one mailbox to another (RFC 6851),
+// and returns the moved messages, in the same order, with their new UIDs.
+// The move is atomic: either all the messages are moved, or none are.
+//
+// The body files aren't copied. The new path is linked to the original
+// file, and the original path is removed.
+func (db *DB) MoveMessages(from string, msgs []*Message, to string) ([]*Message, error) {
+  src, err := db.MailboxByName(from)
+  if err != nil {
+    return nil, err
+  }
+
+  var moved []*Message
+  var boxID int
+
+  dberr := db.withTx(func(tx *sql.Tx) error {
+    for _, msg := range msgs {
+      res, id, err := db.copyMessage(tx, msg, to)
+      if err != nil {
+        return err
+      }
+      boxID = id
+      moved = append(moved, res)
+
+      err = db.deleteMessage(tx, msg.RowID)
+      if err != nil {
+        return err
+      }
+    }
+    return db.pruneExpunged(tx, src.ID)
+  })
+  if dberr != nil {
+    for _, res := range moved {
+      os.Remove(res.Path)
+    }
+    return nil, dberr
+  }
 
-    boxID, msgID, err := db.nextID(tx, to)
+  for _, msg := range msgs {
+    err := db.removeMessageFile(msg.Path)
     if err != nil {
-      return err
+      log.Printf("error: move: %v", err)
     }
+  }
+
+  for _, res := range moved {
+    db.publish(Change{Kind: MessageCreated, MailboxID: boxID, UID: res.ID})
+  }
+  for _, msg := range msgs {
+    db.publish(Change{Kind: MessageExpunged, MailboxID: src.ID, UID: msg.ID})
+  }
+  return moved, nil
+}
+
+// Expunge permanently removes the messages in the mailbox which have
+// the \Deleted flag, and returns the UIDs of the removed messages.
+func (db *DB) Expunge(mailbox string) ([]int64, error) {
+  return db.expunge(mailbox, func(int64) bool { return true })
+}
 
-    path, err := db.messageBodyPath(boxID, msgID)
+// ExpungeUIDs is like Expunge, but only removes the deleted messages
+// with the given UIDs (the UID EXPUNGE command of RFC 4315).
+func (db *DB) ExpungeUIDs(mailbox string, uids []int64) ([]int64, error) {
+  set := map[int64]bool{}
+  for _, uid := range uids {
+    set[uid] = true
+  }
+  return db.expunge(mailbox, func(uid int64) bool { return set[uid] })
+}
+
+// expunge removes the deleted messages in the mailbox for which
+// "match" returns true.
+func (db *DB) expunge(mailbox string, match func(uid int64) bool) ([]int64, error) {
+  var uids []int64
+  var paths []string
+  var boxID int
+
+  dberr := db.withTx(func(tx *sql.Tx) error {
+    var err error
+    boxID, err = db.mailboxID(tx, mailbox)
     if err != nil {
       return err
     }
-    os.Link(msg.Path, path)
-    defer func() {
+
+    rows, err := tx.Query(`
+      select row_id, id, path from message
+      where mailbox_id = ? and deleted = 1`, boxID)
+    if err != nil {
+      return fmt.Errorf("loading deleted messages: %v", err)
+    }
+    defer rows.Close()
+
+    var rowIDs []int
+    for rows.Next() {
+      var rowID int
+      var uid int64
+      var path string
+      err := rows.Scan(&rowID, &uid, &path)
       if err != nil {
-        os.Remove(path)
+        return fmt.Errorf("loading deleted messages: %v", err)
       }
-    }()
+      if !match(uid) {
+        continue
+      }
+      rowIDs = append(rowIDs, rowID)
+      uids = append(uids, uid)
+      paths = append(paths, path)
+    }
+    if err := rows.Err(); err != nil {
+      return fmt.Errorf("loading deleted messages: %v", err)
+    }
+    rows.Close()
 
-    res = &Message{
-      ID: int64(msgID),
-      Size: msg.Size,
-      Headers: msg.Headers,
-      Flags: msg.Flags,
-      Created: msg.Created,
-      Path: path,
+    for _, rowID := range rowIDs {
+      err := db.deleteMessage(tx, rowID)
+      if err != nil {
+        return err
+      }
     }
-    res.SetFlag(imap.Recent)
+    return db.pruneExpunged(tx, boxID)
+  })
+  if dberr != nil {
+    return nil, dberr
+  }
 
-    err = db.insertMessage(tx, boxID, res)
+  // Remove the body files only after the transaction commits, so a failed
+  // expunge never leaves a message without a body.
+  //
+  // Copies are hard links, so removing one message's path only removes that
+  // link, and the data stays on disk until the last linked message is gone.
+  for _, path := range paths {
+    err := db.removeMessageFile(path)
     if err != nil {
-      return fmt.Errorf("database error: inserting message: %v", err)
+      log.Printf("error: expunge: %v", err)
+    }
+  }
+
+  for _, uid := range uids {
+    db.publish(Change{Kind: MessageExpunged, MailboxID: boxID, UID: uid})
+  }
+  return uids, nil
+}
+
+// deleteMessage deletes a message and the rows which refer to it,
+// but not its body file.
+func (db *DB) deleteMessage(tx *sql.Tx, rowID int) error {
+  // Headers and flags are deleted explicitly, rather than relying on
+  // "on delete cascade", because the foreign_keys pragma is only set on
+  // one of the pooled connections.
+  for _, q := range []string{
+    "delete from header where message_row_id = ?",
+    "delete from flag where message_row_id = ?",
+    "delete from message_sort where message_row_id = ?",
+    "delete from message where row_id = ?",
+  } {
+    _, err := tx.Exec(q, rowID)
+    if err != nil {
+      return fmt.Errorf("deleting message: %v", err)
     }
+  }
+  return db.unindexMessage(tx, rowID)
+}
+
+// removeMessageFile removes a message body file, unless another message
+// still refers to the same path.
+func (db *DB) removeMessageFile(path string) error {
+  if path == "" {
     return nil
-  })
-  return res, dberr
+  }
+
+  var count int
+  row := db.db.QueryRow("select count(*) from message where path = ?", path)
+  err := row.Scan(&count)
+  if err != nil {
+    return fmt.Errorf("checking message body file references: %v", err)
+  }
+  if count > 0 {
+    return nil
+  }
+
+  err = os.Remove(path)
+  if err != nil && !os.IsNotExist(err) {
+    return fmt.Errorf("removing message body file: %v", err)
+  }
+  return nil
 }
 
 func (db *DB) insertMessage(tx *sql.Tx, boxID int, msg *Message) error {
@@ -355,17 +617,41 @@ func (db *DB) insertMessage(tx *sql.Tx, boxID int, msg *Message) error {
   if err != nil {
     return err
   }
+
+  err = db.addSortKeys(tx, msg)
+  if err != nil {
+    return err
+  }
   return nil
 }
 
+// nextID returns the ID of the mailbox and the next message ID (UID)
+// in the mailbox. It reads through the transaction, so that it sees
+// messages added earlier in the same transaction.
 func (db *DB) nextID(tx *sql.Tx, mailbox string) (boxID, msgID int, err error) {
-  // TODO this is going outside the transaction. how exactly does transaction
-  //      timing work in sqlite? does this block all other transactions from starting?
-  box, err := db.MailboxByName(mailbox)
+  row := tx.QueryRow("select id, next_message_id from mailbox where name = ?", mailbox)
+  err = row.Scan(&boxID, &msgID)
+  if err == sql.ErrNoRows {
+    return 0, 0, fmt.Errorf("no mailbox named %q", mailbox)
+  }
+  if err != nil {
+    return 0, 0, fmt.Errorf("finding mailbox by name: %v", err)
+  }
+  return boxID, msgID, nil
+}
+
+// mailboxID returns the ID of the mailbox, reading through the transaction,
+// so that it sees the same mailbox as the rest of the transaction.
+func (db *DB) mailboxID(tx *sql.Tx, mailbox string) (int, error) {
+  var id int
+  err := tx.QueryRow("select id from mailbox where name = ?", mailbox).Scan(&id)
+  if err == sql.ErrNoRows {
+    return 0, fmt.Errorf("no mailbox named %q", mailbox)
+  }
   if err != nil {
-    return 0, 0, err
+    return 0, fmt.Errorf("finding mailbox by name: %v", err)
   }
-  return box.ID, box.NextMessageID, nil
+  return id, nil
 }
 
 func (db *DB) withTx(f func(*sql.Tx) error) error {
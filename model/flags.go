@@ -7,19 +7,27 @@ import (
 )
 
 func (db *DB) AddFlags(rowID int, flags []imap.Flag) error {
-  return db.withTx(func(tx *sql.Tx) error {
+  err := db.withTx(func(tx *sql.Tx) error {
     return db.addFlags(tx, rowID, flags)
   })
+  if err != nil {
+    return err
+  }
+  return db.flagsChanged(rowID)
 }
 
 func (db *DB) RemoveFlags(rowID int, flags []imap.Flag) error {
-  return db.withTx(func(tx *sql.Tx) error {
+  err := db.withTx(func(tx *sql.Tx) error {
     return db.removeFlags(tx, rowID, flags)
   })
+  if err != nil {
+    return err
+  }
+  return db.flagsChanged(rowID)
 }
 
 func (db *DB) ReplaceFlags(rowID int, remove, add []imap.Flag) error {
-  return db.withTx(func(tx *sql.Tx) error {
+  err := db.withTx(func(tx *sql.Tx) error {
     err := db.removeFlags(tx, rowID, remove)
     if err != nil {
       return err
@@ -31,10 +39,30 @@ func (db *DB) ReplaceFlags(rowID int, remove, add []imap.Flag) error {
     }
     return nil
   })
+  if err != nil {
+    return err
+  }
+  return db.flagsChanged(rowID)
+}
+
+// flagsChanged notifies listeners that the flags of a message have changed.
+func (db *DB) flagsChanged(rowID int) error {
+  c := Change{Kind: FlagsChanged}
+  row := db.db.QueryRow("select mailbox_id, id from message where row_id = ?", rowID)
+  err := row.Scan(&c.MailboxID, &c.UID)
+  if err != nil {
+    return fmt.Errorf("loading message for change notification: %v", err)
+  }
+  db.publish(c)
+  return nil
 }
 
 func (db *DB) addFlags(tx *sql.Tx, rowID int, flags []imap.Flag) error {
   for _, flag := range flags {
+    // \Recent is specific to a session, so it isn't stored (see ClaimRecent).
+    if flag == imap.Recent {
+      continue
+    }
     _, err := tx.Exec(
       "insert or ignore into flag (message_row_id, value) values (?, ?)",
       rowID, flag)
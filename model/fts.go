@@ -0,0 +1,184 @@
+package model
+
+import (
+  "database/sql"
+  "encoding/hex"
+  "fmt"
+  "log"
+  "strings"
+)
+
+// ftsSchema creates the full-text search index used by the BODY and TEXT
+// search keys. The rowid of each row is the row_id of the message.
+//
+// IMAP searches match substrings, not words, so the index stores the
+// trigrams of the text (see trigrams) rather than its words. It replaces
+// an earlier index of words, message_text.
+//
+// FTS5 is only available when go-sqlite3 is built with the "sqlite_fts5"
+// build tag (see the Makefile), so the index is created separately from
+// the main schema. Without it, searches fall back to reading the message files.
+const ftsSchema = `
+drop table if exists message_text;
+create virtual table if not exists message_trigram
+using fts5(header, body, tokenize = 'unicode61')`
+
+// initFTS creates the full-text search index, if FTS5 is available,
+// and warns if it's missing messages, e.g. those delivered by a build
+// without FTS5.
+func (db *DB) initFTS() {
+  _, err := db.db.Exec(ftsSchema)
+  if err == nil {
+    // The table may have been created by a build with FTS5,
+    // in which case only a query finds that the module is missing.
+    _, err = db.db.Exec("select rowid from message_trigram limit 1")
+  }
+  if err != nil {
+    if !strings.Contains(err.Error(), "no such module") {
+      log.Printf("error: creating full-text search index: %v", err)
+    }
+    return
+  }
+  db.fts = true
+
+  var missing int
+  err = db.db.QueryRow(
+    "select count(*) from message where row_id not in (select rowid from message_trigram)").Scan(&missing)
+  if err != nil {
+    log.Printf("error: checking full-text search index: %v", err)
+    return
+  }
+  if missing > 0 {
+    log.Printf(`warning: %d messages aren't in the full-text search index, so BODY and TEXT searches read them. Run "mailer rebuild index" to add them.`, missing)
+  }
+}
+
+// FullTextSearch returns true if the full-text search index is available.
+func (db *DB) FullTextSearch() bool {
+  return db.fts
+}
+
+// indexMessage adds the decoded text of the message to the full-text index.
+// Errors decoding the message are logged rather than returned,
+// so that malformed messages can still be delivered.
+func (db *DB) indexMessage(tx *sql.Tx, rowID int, path string) error {
+  if !db.fts {
+    return nil
+  }
+
+  header, body, err := messageText(path)
+  if err != nil {
+    log.Printf("error: indexing message text: %v", err)
+  }
+
+  _, err = tx.Exec(
+    "insert into message_trigram(rowid, header, body) values (?, ?, ?)",
+    rowID, strings.Join(trigrams(header), " "), strings.Join(trigrams(body), " "))
+  if err != nil {
+    return fmt.Errorf("indexing message text: %v", err)
+  }
+  return nil
+}
+
+func (db *DB) unindexMessage(tx *sql.Tx, rowID int) error {
+  if !db.fts {
+    return nil
+  }
+  _, err := tx.Exec("delete from message_trigram where rowid = ?", rowID)
+  if err != nil {
+    return fmt.Errorf("removing message from text index: %v", err)
+  }
+  return nil
+}
+
+// RebuildIndex rebuilds the sort keys and the full-text search index
+// from the stored messages, e.g. for messages stored before they existed.
+func (db *DB) RebuildIndex() error {
+  err := db.rebuildSortKeys()
+  if err != nil {
+    return err
+  }
+
+  if !db.fts {
+    return fmt.Errorf("full-text search is not available: mailer must be built with \"-tags sqlite_fts5\", e.g. by \"make install\"")
+  }
+
+  type entry struct {
+    rowID int
+    path string
+  }
+  var entries []entry
+
+  rows, err := db.db.Query("select row_id, path from message")
+  if err != nil {
+    return fmt.Errorf("loading messages: %v", err)
+  }
+  defer rows.Close()
+
+  for rows.Next() {
+    var e entry
+    err := rows.Scan(&e.rowID, &e.path)
+    if err != nil {
+      return fmt.Errorf("loading messages: %v", err)
+    }
+    entries = append(entries, e)
+  }
+  if err := rows.Err(); err != nil {
+    return fmt.Errorf("loading messages: %v", err)
+  }
+  rows.Close()
+
+  return db.withTx(func(tx *sql.Tx) error {
+    _, err := tx.Exec("delete from message_trigram")
+    if err != nil {
+      return fmt.Errorf("clearing text index: %v", err)
+    }
+
+    for _, e := range entries {
+      err := db.indexMessage(tx, e.rowID, e.path)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+// maxQueryTrigrams limits the number of trigrams looked up for a search.
+// Any of the trigrams of a search narrow it correctly, and more of them
+// rarely narrow it further.
+const maxQueryTrigrams = 32
+
+// trigrams returns the distinct trigrams (sequences of three characters)
+// of the text, lowercased the same way as containsFold. A substring of
+// the text has only trigrams of the text, so they can be looked up in
+// the index. Each trigram is hex encoded, so the FTS5 tokenizer keeps it
+// as one token, whatever characters it contains.
+func trigrams(s string) []string {
+  r := []rune(strings.ToLower(s))
+  seen := map[string]bool{}
+  var out []string
+  for i := 0; i + 3 <= len(r); i++ {
+    t := hex.EncodeToString([]byte(string(r[i:i+3])))
+    if !seen[t] {
+      seen[t] = true
+      out = append(out, t)
+    }
+  }
+  return out
+}
+
+// ftsQuery builds an FTS5 query which matches every message whose text
+// contains "s", and possibly others, so the caller must still check the
+// text. It returns false if "s" is shorter than a trigram, in which case
+// the index can't narrow the search.
+func ftsQuery(s string) (string, bool) {
+  t := trigrams(s)
+  if len(t) == 0 {
+    return "", false
+  }
+  if len(t) > maxQueryTrigrams {
+    t = t[:maxQueryTrigrams]
+  }
+  return `"` + strings.Join(t, `" AND "`) + `"`, true
+}
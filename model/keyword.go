@@ -0,0 +1,38 @@
+package model
+
+import (
+  "fmt"
+  "github.com/buchanae/mailer/imap"
+)
+
+// Keywords returns the keywords which have been used in the mailbox,
+// in the order they first appeared.
+func (db *DB) Keywords(mailbox string) ([]imap.Flag, error) {
+  rows, err := db.db.Query(
+    `select keyword.value
+    from keyword
+    join mailbox
+    on keyword.mailbox_id = mailbox.id
+    where mailbox.name = ?
+    order by keyword.rowid`,
+    mailbox)
+  if err != nil {
+    return nil, fmt.Errorf("database error: loading keywords: %v", err)
+  }
+  defer rows.Close()
+
+  var keywords []imap.Flag
+  for rows.Next() {
+    var value string
+    err := rows.Scan(&value)
+    if err != nil {
+      return nil, fmt.Errorf("database error: loading keywords: %v", err)
+    }
+    keywords = append(keywords, imap.LookupFlag(value))
+  }
+
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("database error: loading keywords: %v", err)
+  }
+  return keywords, nil
+}
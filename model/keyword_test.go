@@ -0,0 +1,70 @@
+package model
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestKeywords(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  err := db.CreateMailbox("other")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  add := func(mailbox string, flags ...imap.Flag) *Message {
+    msg, err := db.CreateMessage(mailbox, strings.NewReader("Subject: test\r\n\r\n"), flags)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return msg
+  }
+
+  add("INBOX", imap.Seen, "$Junk")
+  msg := add("INBOX", imap.Flagged)
+  add("other", "$Forwarded")
+
+  err = db.AddFlags(msg.RowID, []imap.Flag{"project-x", "$junk", imap.Answered})
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Keywords stay after the last message with them is expunged.
+  err = db.AddFlags(msg.RowID, []imap.Flag{imap.Deleted})
+  if err != nil {
+    t.Fatal(err)
+  }
+  _, err = db.Expunge("INBOX")
+  if err != nil {
+    t.Fatal(err)
+  }
+  // Copied messages bring their keywords.
+  _, err = db.CopyMessage(add("other", "$Copied"), "INBOX")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  tests := []struct {
+    mailbox string
+    expect []imap.Flag
+  }{
+    // System flags aren't keywords, and keywords are compared
+    // ignoring case, keeping the case they first appeared with.
+    {"INBOX", []imap.Flag{"$Junk", "project-x", "$Copied"}},
+    {"other", []imap.Flag{"$Forwarded", "$Copied"}},
+  }
+
+  for _, test := range tests {
+    keywords, err := db.Keywords(test.mailbox)
+    if err != nil {
+      t.Errorf("keywords of %s: %v", test.mailbox, err)
+      continue
+    }
+    if !reflect.DeepEqual(keywords, test.expect) {
+      t.Errorf("keywords of %s: expected %v, got %v", test.mailbox, test.expect, keywords)
+    }
+  }
+}
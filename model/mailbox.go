@@ -3,28 +3,183 @@ package model
 import (
   "database/sql"
   "fmt"
+  "log"
+  "strings"
+  "unicode/utf8"
+  "github.com/buchanae/mailer/imap"
 )
 
-func (db *DB) CreateMailbox(name string) error {
-  _, err := db.db.Exec("insert into mailbox(name, next_message_id) values(?, 1)", name)
-  return err
+// Delimiter separates the levels of the mailbox hierarchy,
+// e.g. "work/projects/mailer".
+const Delimiter = "/"
+
+// Inbox is the name of the mailbox where new mail is delivered. Like all
+// mailbox names, it's case-insensitive, as RFC 3501 requires for INBOX.
+const Inbox = "INBOX"
+
+// CreateMailbox creates a mailbox with the given special-use attributes
+// (RFC 6154). A trailing delimiter, which clients send to say they intend
+// to create mailboxes below it, is removed. Missing parent mailboxes
+// aren't created. LIST shows them as \Noselect.
+func (db *DB) CreateMailbox(name string, uses ...imap.ListAttr) error {
+  name = strings.TrimSuffix(name, Delimiter)
+  if name == "" {
+    return fmt.Errorf("invalid mailbox name %q", name)
+  }
+
+  return db.withTx(func(tx *sql.Tx) error {
+    res, err := tx.Exec("insert into mailbox(name, next_message_id) values(?, 1)", name)
+    if err != nil {
+      return err
+    }
+    id, err := res.LastInsertId()
+    if err != nil {
+      return err
+    }
+
+    for _, use := range uses {
+      _, err := tx.Exec(
+        "insert or ignore into mailbox_special_use(mailbox_id, use) values(?, ?)",
+        id, use)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
 }
 
+// RenameMailbox renames a mailbox and the mailboxes below it
+// in the hierarchy, e.g. renaming "a" to "b" renames "a/c" to "b/c".
+// "from" may be a \Noselect parent which only exists because of its children.
 func (db *DB) RenameMailbox(from, to string) error {
-  _, err := db.db.Exec("update mailbox set name = ? where name = ?", to, from)
-  return err
+  // Renaming INBOX moves its messages to the new mailbox (RFC 3501),
+  // which isn't supported.
+  if strings.EqualFold(from, Inbox) {
+    return fmt.Errorf("renaming %s is not supported", Inbox)
+  }
+  if strings.HasPrefix(strings.ToLower(to + Delimiter), strings.ToLower(from + Delimiter)) {
+    return fmt.Errorf("can't rename %q below itself", from)
+  }
+
+  return db.withTx(func(tx *sql.Tx) error {
+    res, err := tx.Exec("update mailbox set name = ? where name = ?", to, from)
+    if err != nil {
+      return err
+    }
+    n, err := res.RowsAffected()
+    if err != nil {
+      return err
+    }
+
+    // substr() counts characters from 1, so this keeps the delimiter
+    // and the rest of the name.
+    res, err = tx.Exec(
+      `update mailbox set name = ? || substr(name, ?)
+      where name like ? escape '\'`,
+      to, utf8.RuneCountInString(from) + 1,
+      likeEscaper.Replace(from + Delimiter) + "%")
+    if err != nil {
+      return err
+    }
+    children, err := res.RowsAffected()
+    if err != nil {
+      return err
+    }
+
+    if n + children == 0 {
+      return fmt.Errorf("no mailbox named %q", from)
+    }
+    return nil
+  })
 }
 
+// DeleteMailbox deletes a mailbox and its messages. The mailboxes below it
+// in the hierarchy are kept, and the deleted mailbox remains as their
+// \Noselect parent. Deleting a \Noselect parent is an error (RFC 3501
+// section 6.3.4).
 func (db *DB) DeleteMailbox(name string) error {
-  _, err := db.db.Exec("delete from mailbox where name = ?", name)
-  return err
+  if strings.EqualFold(name, Inbox) {
+    return fmt.Errorf("%s can't be deleted", Inbox)
+  }
+
+  var paths []string
+  err := db.withTx(func(tx *sql.Tx) error {
+    boxID, err := db.mailboxID(tx, name)
+    if err != nil {
+      return err
+    }
+
+    rows, err := tx.Query("select row_id, path from message where mailbox_id = ?", boxID)
+    if err != nil {
+      return fmt.Errorf("loading messages: %v", err)
+    }
+    defer rows.Close()
+
+    var rowIDs []int
+    for rows.Next() {
+      var rowID int
+      var path string
+      err := rows.Scan(&rowID, &path)
+      if err != nil {
+        return fmt.Errorf("loading messages: %v", err)
+      }
+      rowIDs = append(rowIDs, rowID)
+      paths = append(paths, path)
+    }
+    if err := rows.Err(); err != nil {
+      return fmt.Errorf("loading messages: %v", err)
+    }
+    rows.Close()
+
+    for _, rowID := range rowIDs {
+      err := db.deleteMessage(tx, rowID)
+      if err != nil {
+        return err
+      }
+    }
+
+    // Like the messages, the rows which refer to the mailbox are deleted
+    // explicitly, rather than relying on "on delete cascade" (see deleteMessage).
+    for _, q := range []string{
+      "delete from expunged where mailbox_id = ?",
+      "delete from expunged_pruned where mailbox_id = ?",
+      "delete from mailbox_modseq where mailbox_id = ?",
+      "delete from mailbox_recent where mailbox_id = ?",
+      "delete from mailbox_special_use where mailbox_id = ?",
+      "delete from keyword where mailbox_id = ?",
+      "delete from mailbox where id = ?",
+    } {
+      _, err := tx.Exec(q, boxID)
+      if err != nil {
+        return fmt.Errorf("deleting mailbox: %v", err)
+      }
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+
+  // As with expunge, the body files are removed after the transaction commits.
+  for _, path := range paths {
+    err := db.removeMessageFile(path)
+    if err != nil {
+      log.Printf("error: deleting mailbox: %v", err)
+    }
+  }
+  return nil
 }
 
 func (db *DB) ListMailboxes() ([]*Mailbox, error) {
 
   var boxes []*Mailbox
 
-  rows, err := db.db.Query("select id, name, next_message_id from mailbox")
+  rows, err := db.db.Query(
+    `select id, name, next_message_id, coalesce(group_concat(u.use, ' '), '')
+    from mailbox
+    left join mailbox_special_use as u on u.mailbox_id = mailbox.id
+    group by mailbox.id`)
   if err != nil {
     return nil, fmt.Errorf("loading mailboxes from database: %v", err)
   }
@@ -32,10 +187,14 @@ func (db *DB) ListMailboxes() ([]*Mailbox, error) {
 
   for rows.Next() {
     box := &Mailbox{}
-    err := rows.Scan(&box.ID, &box.Name, &box.NextMessageID)
+    var uses string
+    err := rows.Scan(&box.ID, &box.Name, &box.NextMessageID, &uses)
     if err != nil {
       return nil, fmt.Errorf("loading mailboxes from database: %v", err)
     }
+    for _, use := range strings.Fields(uses) {
+      box.SpecialUse = append(box.SpecialUse, imap.ListAttr(use))
+    }
     boxes = append(boxes, box)
   }
 
@@ -49,9 +208,12 @@ func (db *DB) ListMailboxes() ([]*Mailbox, error) {
 func (db *DB) MailboxByName(name string) (*Mailbox, error) {
 
   box := &Mailbox{Name: name}
-  q := "select id, next_message_id from mailbox where name = ?"
+  q := `select id, next_message_id, coalesce(x.highest, 1)
+    from mailbox
+    left join mailbox_modseq as x on x.mailbox_id = mailbox.id
+    where name = ?`
   row := db.db.QueryRow(q, name)
-  err := row.Scan(&box.ID, &box.NextMessageID)
+  err := row.Scan(&box.ID, &box.NextMessageID, &box.HighestModSeq)
   if err == sql.ErrNoRows {
     return nil, fmt.Errorf("no mailbox named %q", name)
   }
@@ -79,6 +241,40 @@ func (db *DB) MessageCount(mailbox string) (int, error) {
   return count, nil
 }
 
+// MessageUIDs returns the UIDs of all the messages in the mailbox,
+// in ascending order, which is also message sequence number order.
+func (db *DB) MessageUIDs(mailbox string) ([]int64, error) {
+  rows, err := db.db.Query(
+    `select message.id
+    from message
+    join mailbox
+    on message.mailbox_id = mailbox.id
+    where mailbox.name = ?
+    order by message.id`,
+    mailbox)
+  if err != nil {
+    return nil, fmt.Errorf("database error: loading message UIDs: %v", err)
+  }
+  defer rows.Close()
+
+  var uids []int64
+  for rows.Next() {
+    var uid int64
+    err := rows.Scan(&uid)
+    if err != nil {
+      return nil, fmt.Errorf("database error: loading message UIDs: %v", err)
+    }
+    uids = append(uids, uid)
+  }
+
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("database error: loading message UIDs: %v", err)
+  }
+  return uids, nil
+}
+
+// RecentCount returns the number of messages in the mailbox
+// which no session has claimed as recent yet (see ClaimRecent).
 func (db *DB) RecentCount(mailbox string) (int, error) {
   var count int
 
@@ -87,8 +283,10 @@ func (db *DB) RecentCount(mailbox string) (int, error) {
     from message
     join mailbox
     on message.mailbox_id = mailbox.id
+    left join mailbox_recent
+    on mailbox_recent.mailbox_id = mailbox.id
     where mailbox.name = ?
-    and message.recent = 1`,
+    and message.id >= coalesce(mailbox_recent.first_unclaimed, 1)`,
     mailbox)
 
   err := row.Scan(&count)
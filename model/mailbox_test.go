@@ -0,0 +1,225 @@
+package model
+
+import (
+  "io/ioutil"
+  "os"
+  "reflect"
+  "sort"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+// mailboxNames returns the sorted names of the mailboxes in the database,
+// except those in "skip", e.g. the provisioned mailboxes.
+func mailboxNames(t *testing.T, db *DB, skip []string) []string {
+  boxes, err := db.ListMailboxes()
+  if err != nil {
+    t.Fatal(err)
+  }
+  var names []string
+  for _, box := range boxes {
+    if !contains(skip, box.Name) {
+      names = append(names, box.Name)
+    }
+  }
+  sort.Strings(names)
+  return names
+}
+
+func contains(list []string, s string) bool {
+  for _, x := range list {
+    if x == s {
+      return true
+    }
+  }
+  return false
+}
+
+func TestRenameMailbox(t *testing.T) {
+  tests := []struct {
+    desc, from, to string
+    err bool
+    expect []string
+  }{
+    {"children", "a", "x", false, []string{"a%", "ab", "b/c", "x", "x/b", "x/b/c"}},
+    {"child", "a/b", "y", false, []string{"a", "ab", "a%", "b/c", "y", "y/c"}},
+    {"into another parent", "a/b", "b/c/d", false, []string{"a", "ab", "a%", "b/c", "b/c/d", "b/c/d/c"}},
+    {"ignoring case", "A", "x", false, []string{"a%", "ab", "b/c", "x", "x/b", "x/b/c"}},
+    // "b" only exists as the parent of "b/c".
+    {"\\Noselect parent", "b", "z", false, []string{"a", "a/b", "a/b/c", "ab", "a%", "z/c"}},
+    // Wildcards in names are matched literally.
+    {"wildcard", "a%", "w", false, []string{"a", "a/b", "a/b/c", "ab", "b/c", "w"}},
+    {"below itself", "a", "a/b/x", true, nil},
+    {"existing name", "a/b", "ab", true, nil},
+    {"missing", "q", "r", true, nil},
+    {"INBOX", "inbox", "r", true, nil},
+  }
+
+  for _, test := range tests {
+    db, cleanup := testDB(t)
+    skip := mailboxNames(t, db, nil)
+    for _, name := range []string{"a", "a/b", "a/b/c", "ab", "a%", "b/c"} {
+      err := db.CreateMailbox(name)
+      if err != nil {
+        t.Fatal(err)
+      }
+    }
+    // Renamed children keep their messages.
+    addMessages(t, db, "a/b/c", 2)
+
+    err := db.RenameMailbox(test.from, test.to)
+    if test.err {
+      if err == nil {
+        t.Errorf("%s: expected an error", test.desc)
+      }
+      cleanup()
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", test.desc, err)
+      cleanup()
+      continue
+    }
+
+    got := mailboxNames(t, db, skip)
+    expect := append([]string(nil), test.expect...)
+    sort.Strings(expect)
+    if !reflect.DeepEqual(got, expect) {
+      t.Errorf("%s: expected %v, got %v", test.desc, expect, got)
+    }
+
+    var count int
+    err = db.db.QueryRow("select count(*) from message").Scan(&count)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if count != 2 {
+      t.Errorf("%s: expected 2 messages, got %d", test.desc, count)
+    }
+    cleanup()
+  }
+}
+
+func TestDeleteMailbox(t *testing.T) {
+  tests := []struct {
+    desc, name string
+    err bool
+    expect []string
+  }{
+    // Children are kept, and "a" remains as their \Noselect parent.
+    {"parent", "a", false, []string{"a/b", "a/b/c", "ab"}},
+    {"child", "a/b/c", false, []string{"a", "a/b", "ab"}},
+    {"ignoring case", "AB", false, []string{"a", "a/b", "a/b/c"}},
+    {"\\Noselect parent", "b", true, nil},
+    {"missing", "q", true, nil},
+    {"INBOX", "inbox", true, nil},
+  }
+
+  for _, test := range tests {
+    db, cleanup := testDB(t)
+    skip := mailboxNames(t, db, nil)
+    for _, name := range []string{"a", "a/b", "a/b/c", "ab", "b/c"} {
+      err := db.CreateMailbox(name)
+      if err != nil {
+        t.Fatal(err)
+      }
+    }
+    skip = append(skip, "b/c")
+
+    err := db.DeleteMailbox(test.name)
+    if test.err {
+      if err == nil {
+        t.Errorf("%s: expected an error", test.desc)
+      }
+      cleanup()
+      continue
+    }
+    if err != nil {
+      t.Errorf("%s: %v", test.desc, err)
+      cleanup()
+      continue
+    }
+
+    got := mailboxNames(t, db, skip)
+    if !reflect.DeepEqual(got, test.expect) {
+      t.Errorf("%s: expected %v, got %v", test.desc, test.expect, got)
+    }
+    cleanup()
+  }
+}
+
+func TestDeleteMailboxMessages(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  err := db.CreateMailbox("Work")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var msgs []*Message
+  for i := 0; i < 3; i++ {
+    msg, err := db.CreateMessage("Work", strings.NewReader("Subject: work\r\n\r\nbody\r\n"), []imap.Flag{imap.Seen, "$Work"})
+    if err != nil {
+      t.Fatal(err)
+    }
+    msgs = append(msgs, msg)
+  }
+  // The copy shares its body file with the original.
+  copied, err := db.CopyMessage(msgs[0], "INBOX")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  err = db.DeleteMailbox("Work")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // The columns which refer to the row IDs of messages.
+  columns := map[string]string{
+    "message": "row_id",
+    "header": "message_row_id",
+    "flag": "message_row_id",
+    "message_sort": "message_row_id",
+    "message_modseq": "message_row_id",
+  }
+  if db.fts {
+    columns["message_trigram"] = "rowid"
+  }
+  for table, col := range columns {
+    for _, msg := range msgs {
+      var count int
+      err := db.db.QueryRow("select count(*) from " + table + " where " + col + " = ?", msg.RowID).Scan(&count)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if count != 0 {
+        t.Errorf("expected no rows in %s for message %d, got %d", table, msg.RowID, count)
+      }
+    }
+  }
+
+  for _, table := range []string{"expunged", "mailbox_modseq", "keyword"} {
+    var count int
+    err := db.db.QueryRow(
+      "select count(*) from " + table + " where mailbox_id not in (select id from mailbox)").Scan(&count)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if count != 0 {
+      t.Errorf("expected no rows in %s for the deleted mailbox, got %d", table, count)
+    }
+  }
+
+  for _, msg := range msgs[1:] {
+    if _, err := os.Stat(msg.Path); !os.IsNotExist(err) {
+      t.Errorf("expected %s to be removed, got %v", msg.Path, err)
+    }
+  }
+  b, err := ioutil.ReadFile(copied.Path)
+  if err != nil || !strings.Contains(string(b), "Subject: work") {
+    t.Errorf("expected the copy's body file to remain, got %q, %v", b, err)
+  }
+}
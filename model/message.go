@@ -1,12 +1,13 @@
 package model
 
 import (
+  "bufio"
   "strings"
   "io"
   "fmt"
   "os"
+  "sort"
   "time"
-  "net/mail"
   "github.com/buchanae/mailer/imap"
 )
 
@@ -14,6 +15,11 @@ type Mailbox struct {
   ID int
   Name string
   NextMessageID int
+  // HighestModSeq is the highest mod-sequence of the mailbox (RFC 7162).
+  HighestModSeq int64
+  // SpecialUse holds the special-use attributes (RFC 6154).
+  // It's only loaded by ListMailboxes.
+  SpecialUse []imap.ListAttr
 }
 
 type Message struct {
@@ -24,6 +30,8 @@ type Message struct {
   Flags []imap.Flag
   Headers Headers
   Path string
+  // ModSeq is the mod-sequence of the last change to the message (RFC 7162).
+  ModSeq int64
 }
 
 func (m *Message) SetFlag(flag imap.Flag) {
@@ -48,33 +56,54 @@ func (m *Message) Body() (io.ReadCloser, error) {
   return os.Open(m.Path)
 }
 
-func (m *Message) Text() (io.ReadCloser, error) {
-  body, err := m.Body()
+// Text opens the message body file, positioned at the start of the
+// message text (i.e. after the header and the blank line which follows it),
+// and returns the size of the text in bytes.
+func (m *Message) Text() (*os.File, int, error) {
+  fh, err := os.Open(m.Path)
   if err != nil {
-    return nil, err
+    return nil, 0, err
   }
 
-  msg, err := mail.ReadMessage(body)
+  // Find the end of the header, which is the first empty line.
+  br := bufio.NewReader(fh)
+  offset := 0
+  for {
+    line, err := br.ReadString('\n')
+    offset += len(line)
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      fh.Close()
+      return nil, 0, err
+    }
+    if line == "\r\n" || line == "\n" {
+      break
+    }
+  }
+
+  _, err = fh.Seek(int64(offset), io.SeekStart)
   if err != nil {
-    return nil, err
+    fh.Close()
+    return nil, 0, err
   }
-  return &bodyCloser{
-    Reader: msg.Body,
-    body: body,
-  }, nil
+  return fh, m.Size - offset, nil
 }
 
-type bodyCloser struct {
-  io.Reader
-  body io.ReadCloser
-}
+type Headers map[string][]string
 
-func (b *bodyCloser) Close() error {
-  return b.body.Close()
+// Get returns the first value of the header with the given key,
+// ignoring case. If there is no such header, Get returns "".
+func (h Headers) Get(key string) string {
+  for k, vals := range h {
+    if strings.ToLower(k) == strings.ToLower(key) && len(vals) > 0 {
+      return vals[0]
+    }
+  }
+  return ""
 }
 
-type Headers map[string][]string
-
 // keys returns a list of header keys in the map.
 func (h Headers) Keys() []string {
   var keys []string
@@ -84,11 +113,16 @@ func (h Headers) Keys() []string {
   return keys
 }
 
-// Format formats the headers into a string.
+// Format formats the headers into a string. The original order of the
+// fields isn't kept, so they're sorted by key, which keeps the output
+// the same each time a message is fetched.
 func (h Headers) Format() string {
+  keys := h.Keys()
+  sort.Strings(keys)
+
   var s string
-  for key, vals := range h {
-    for _, val := range vals {
+  for _, key := range keys {
+    for _, val := range h[key] {
       s += fmt.Sprintf("%s: %s\r\n", key, val)
     }
   }
@@ -0,0 +1,161 @@
+package model
+
+import (
+  "database/sql"
+  "errors"
+  "fmt"
+  "github.com/buchanae/mailer/imap"
+)
+
+// ErrModified is returned by ReplaceFlagsUnchangedSince when the message
+// was modified after the given mod-sequence.
+var ErrModified = errors.New("message was modified")
+
+// ReplaceFlagsUnchangedSince is like ReplaceFlags, but only changes the
+// flags if the mod-sequence of the message is not greater than "modseq",
+// as described by the UNCHANGEDSINCE modifier of STORE (RFC 7162).
+// The check and the change happen in one transaction.
+func (db *DB) ReplaceFlagsUnchangedSince(rowID int, remove, add []imap.Flag, modseq int64) error {
+  // ErrModified is returned after the transaction, so that
+  // withTx doesn't wrap it.
+  modified := false
+  err := db.withTx(func(tx *sql.Tx) error {
+    var current int64
+    row := tx.QueryRow(
+      "select coalesce((select modseq from message_modseq where message_row_id = ?), 1)",
+      rowID)
+    err := row.Scan(&current)
+    if err != nil {
+      return fmt.Errorf("loading message mod-sequence: %v", err)
+    }
+    if current > modseq {
+      modified = true
+      return nil
+    }
+
+    err = db.removeFlags(tx, rowID, remove)
+    if err != nil {
+      return err
+    }
+    return db.addFlags(tx, rowID, add)
+  })
+  if err != nil {
+    return err
+  }
+  if modified {
+    return ErrModified
+  }
+  return db.flagsChanged(rowID)
+}
+
+// ExpungedRetention is the number of mod-sequences of history which are
+// kept for QRESYNC. Tombstones of messages expunged longer ago than that
+// are pruned, so the tombstone table doesn't grow forever.
+const ExpungedRetention = 10000
+
+// Vanished returns the UIDs of the messages which were expunged from
+// the mailbox after the given mod-sequence, in ascending order.
+//
+// If tombstones from after that mod-sequence were pruned, the exact set
+// isn't known, and every UID below UIDNEXT which isn't in the mailbox is
+// returned instead. RFC 7162 allows this: clients ignore UIDs they don't know.
+func (db *DB) Vanished(mailbox string, modseq int64) ([]int64, error) {
+  var pruned int64
+  var next int64
+  row := db.db.QueryRow(
+    `select coalesce(p.modseq, 0), mailbox.next_message_id
+    from mailbox
+    left join expunged_pruned as p on p.mailbox_id = mailbox.id
+    where mailbox.name = ?`,
+    mailbox)
+  err := row.Scan(&pruned, &next)
+  if err != nil {
+    return nil, fmt.Errorf("database error: loading expunged messages: %v", err)
+  }
+
+  if modseq < pruned {
+    exists, err := db.MessageUIDs(mailbox)
+    if err != nil {
+      return nil, err
+    }
+    var uids []int64
+    for uid := int64(1); uid < next; uid++ {
+      if len(exists) > 0 && exists[0] == uid {
+        exists = exists[1:]
+        continue
+      }
+      uids = append(uids, uid)
+    }
+    return uids, nil
+  }
+
+  rows, err := db.db.Query(
+    `select expunged.uid
+    from expunged
+    join mailbox
+    on expunged.mailbox_id = mailbox.id
+    where mailbox.name = ?
+    and expunged.modseq > ?
+    order by expunged.uid`,
+    mailbox, modseq)
+  if err != nil {
+    return nil, fmt.Errorf("database error: loading expunged messages: %v", err)
+  }
+  defer rows.Close()
+
+  var uids []int64
+  for rows.Next() {
+    var uid int64
+    err := rows.Scan(&uid)
+    if err != nil {
+      return nil, fmt.Errorf("database error: loading expunged messages: %v", err)
+    }
+    uids = append(uids, uid)
+  }
+
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("database error: loading expunged messages: %v", err)
+  }
+  return uids, nil
+}
+
+// pruneExpunged removes the tombstones of the mailbox which are older than
+// ExpungedRetention mod-sequences, and records the highest one removed,
+// so that Vanished knows its history is incomplete before that.
+func (db *DB) pruneExpunged(tx *sql.Tx, mailboxID int) error {
+  var highest int64
+  row := tx.QueryRow(
+    "select coalesce((select highest from mailbox_modseq where mailbox_id = ?), 1)",
+    mailboxID)
+  err := row.Scan(&highest)
+  if err != nil {
+    return fmt.Errorf("pruning expunged messages: %v", err)
+  }
+
+  below := highest - ExpungedRetention
+  var pruned sql.NullInt64
+  row = tx.QueryRow(
+    "select max(modseq) from expunged where mailbox_id = ? and modseq <= ?",
+    mailboxID, below)
+  err = row.Scan(&pruned)
+  if err != nil {
+    return fmt.Errorf("pruning expunged messages: %v", err)
+  }
+  if !pruned.Valid {
+    return nil
+  }
+
+  _, err = tx.Exec(
+    "delete from expunged where mailbox_id = ? and modseq <= ?",
+    mailboxID, pruned.Int64)
+  if err != nil {
+    return fmt.Errorf("pruning expunged messages: %v", err)
+  }
+  _, err = tx.Exec(
+    "insert or replace into expunged_pruned (mailbox_id, modseq) values (?, ?)",
+    mailboxID, pruned.Int64)
+  if err != nil {
+    return fmt.Errorf("pruning expunged messages: %v", err)
+  }
+  return nil
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+  "reflect"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+// expungeUIDs marks the messages with the given UIDs as deleted,
+// and expunges them.
+func expungeUIDs(t *testing.T, db *DB, mailbox string, uids ...int64) {
+  for _, uid := range uids {
+    msg, err := db.MessageByUID(mailbox, uid)
+    if err != nil {
+      t.Fatal(err)
+    }
+    err = db.AddFlags(msg.RowID, []imap.Flag{imap.Deleted})
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+  _, err := db.Expunge(mailbox)
+  if err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestVanished(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  addMessages(t, db, "INBOX", 5)
+  box, err := db.MailboxByName("INBOX")
+  if err != nil {
+    t.Fatal(err)
+  }
+  expungeUIDs(t, db, "INBOX", 2, 4)
+
+  uids, err := db.Vanished("INBOX", box.HighestModSeq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(uids, []int64{2, 4}) {
+    t.Errorf("unexpected vanished UIDs %v", uids)
+  }
+
+  // Move the history past the retention window,
+  // so the next expunge prunes the tombstones of 2 and 4.
+  _, err = db.db.Exec(
+    "update mailbox_modseq set highest = highest + ? where mailbox_id = ?",
+    ExpungedRetention, box.ID)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expungeUIDs(t, db, "INBOX", 5)
+
+  var count int
+  err = db.db.QueryRow("select count(*) from expunged where mailbox_id = ?", box.ID).Scan(&count)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if count != 1 {
+    t.Errorf("expected 1 tombstone after pruning, got %d", count)
+  }
+
+  // Without the pruned tombstones, every UID which isn't
+  // in the mailbox is reported.
+  uids, err = db.Vanished("INBOX", box.HighestModSeq)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if !reflect.DeepEqual(uids, []int64{2, 4, 5}) {
+    t.Errorf("unexpected vanished UIDs after pruning %v", uids)
+  }
+}
+
+func TestDeleteMailboxWithMessages(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  err := db.CreateMailbox("a")
+  if err != nil {
+    t.Fatal(err)
+  }
+  addMessages(t, db, "a", 3)
+
+  err = db.DeleteMailbox("a")
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  var count int
+  err = db.db.QueryRow("select count(*) from expunged").Scan(&count)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if count != 0 {
+    t.Errorf("expected no tombstones for a deleted mailbox, got %d", count)
+  }
+}
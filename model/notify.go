@@ -0,0 +1,126 @@
+package model
+
+import (
+  "sync"
+)
+
+// ChangeKind describes the kind of change made to a mailbox.
+type ChangeKind int
+
+const (
+  // MessageCreated means a message was added to the mailbox,
+  // e.g. by APPEND, COPY or SMTP delivery.
+  MessageCreated ChangeKind = iota
+  // FlagsChanged means the flags of a message were changed.
+  FlagsChanged
+  // MessageExpunged means a message was permanently removed
+  // from the mailbox by EXPUNGE or CLOSE.
+  MessageExpunged
+)
+
+// Change describes a change made to a message in a mailbox.
+type Change struct {
+  Kind ChangeKind
+  MailboxID int
+  // UID of the message which changed.
+  UID int64
+  // Origin is the listener of the connection which made the change,
+  // if any. The origin isn't notified, since it already knows.
+  Origin *Listener
+}
+
+// notifier fans out mailbox changes to listeners
+// (e.g. IMAP sessions with the mailbox selected).
+type notifier struct {
+  mtx sync.Mutex
+  listeners map[*Listener]bool
+}
+
+func (n *notifier) publish(c Change) {
+  n.mtx.Lock()
+  defer n.mtx.Unlock()
+
+  for l := range n.listeners {
+    if l.MailboxID == c.MailboxID && l != c.Origin {
+      l.push(c)
+    }
+  }
+}
+
+// publish notifies listeners of a change made through this DB.
+func (db *DB) publish(c Change) {
+  c.Origin = db.origin
+  db.notify.publish(c)
+}
+
+// From returns a DB which makes changes on behalf of the connection
+// which owns the listener "l". The listener isn't notified of those changes,
+// e.g. a session isn't sent back the flags it just stored.
+// A nil listener is allowed, in which case all listeners are notified.
+func (db *DB) From(l *Listener) *DB {
+  c := *db
+  c.origin = l
+  return &c
+}
+
+// Listener receives changes made to a mailbox by any connection
+// sharing the same DB. Changes are queued until they are drained
+// by Changes(), so a slow listener never blocks the writer.
+type Listener struct {
+  MailboxID int
+
+  n *notifier
+  mtx sync.Mutex
+  changes []Change
+  ready chan struct{}
+}
+
+// Listen returns a Listener which receives changes made to the mailbox
+// identified by "mailboxID". The caller must call Close when done.
+func (db *DB) Listen(mailboxID int) *Listener {
+  l := &Listener{
+    MailboxID: mailboxID,
+    n: db.notify,
+    ready: make(chan struct{}, 1),
+  }
+
+  db.notify.mtx.Lock()
+  defer db.notify.mtx.Unlock()
+  db.notify.listeners[l] = true
+  return l
+}
+
+func (l *Listener) push(c Change) {
+  l.mtx.Lock()
+  l.changes = append(l.changes, c)
+  l.mtx.Unlock()
+
+  // Signal that changes are available, without blocking
+  // if a signal is already pending.
+  select {
+  case l.ready <- struct{}{}:
+  default:
+  }
+}
+
+// Ready returns a channel which receives a value when
+// there are changes waiting to be drained.
+func (l *Listener) Ready() <-chan struct{} {
+  return l.ready
+}
+
+// Changes drains and returns the queued changes, oldest first.
+func (l *Listener) Changes() []Change {
+  l.mtx.Lock()
+  defer l.mtx.Unlock()
+  c := l.changes
+  l.changes = nil
+  return c
+}
+
+// Close stops the listener from receiving changes.
+func (l *Listener) Close() {
+  l.n.mtx.Lock()
+  defer l.n.mtx.Unlock()
+  delete(l.n.listeners, l)
+}
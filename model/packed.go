@@ -146,4 +146,203 @@ begin
   update message set deleted = 0 where row_id = old.message_row_id;
 end;
 
+-- Mod-sequences (RFC 7162). Adding a message, changing its flags, or
+-- expunging it increments the highest mod-sequence of the mailbox,
+-- which becomes the mod-sequence of the message (or its tombstone).
+-- \Recent isn't a change that clients need to resynchronize.
+
+create trigger if not exists modseq_message_insert after insert on message
+for each row
+begin
+  insert or ignore into mailbox_modseq(mailbox_id) values (new.mailbox_id);
+  update mailbox_modseq set highest = highest + 1 where mailbox_id = new.mailbox_id;
+  insert or replace into message_modseq(message_row_id, modseq)
+    select new.row_id, highest from mailbox_modseq where mailbox_id = new.mailbox_id;
+end;
+
+-- modseq_message_delete is in 009_expunged.sql.
+
+create trigger if not exists modseq_flag_insert after insert on flag
+for each row
+when new.value != '\recent'
+begin
+  insert or ignore into mailbox_modseq(mailbox_id)
+    select mailbox_id from message where row_id = new.message_row_id;
+  update mailbox_modseq set highest = highest + 1
+    where mailbox_id = (select mailbox_id from message where row_id = new.message_row_id);
+  insert or replace into message_modseq(message_row_id, modseq)
+    select m.row_id, x.highest from message as m
+    join mailbox_modseq as x on x.mailbox_id = m.mailbox_id
+    where m.row_id = new.message_row_id;
+end;
+
+create trigger if not exists modseq_flag_delete after delete on flag
+for each row
+when old.value != '\recent'
+begin
+  insert or ignore into mailbox_modseq(mailbox_id)
+    select mailbox_id from message where row_id = old.message_row_id;
+  update mailbox_modseq set highest = highest + 1
+    where mailbox_id = (select mailbox_id from message where row_id = old.message_row_id);
+  insert or replace into message_modseq(message_row_id, modseq)
+    select m.row_id, x.highest from message as m
+    join mailbox_modseq as x on x.mailbox_id = m.mailbox_id
+    where m.row_id = old.message_row_id;
+end;
+
+-- Sort and thread keys (RFC 5256), computed from the message headers
+-- when the message is inserted.
+create table if not exists message_sort (
+  message_row_id integer not null primary key references message(row_id) on delete cascade on update cascade,
+
+  -- Unix time of the Date header, or of the internal date if the header
+  -- is missing or invalid.
+  sent integer not null default 0,
+  -- Unix time of the internal date.
+  arrival integer not null default 0,
+  -- Base subject, in lowercase.
+  subject text not null default '',
+  -- Is the subject a reply or forward, e.g. "Re: hello"?
+  subject_reply integer not null default 0,
+  -- Lowercase mailbox (local part) of the first address.
+  from_addr text not null default '',
+  to_addr text not null default '',
+  cc_addr text not null default '',
+
+  message_id text not null default '',
+  -- Space separated message IDs from References,
+  -- or In-Reply-To if there are no References.
+  refs text not null default ''
+);
+
+create index if not exists message_sort_sent_index on message_sort (sent);
+create index if not exists message_sort_arrival_index on message_sort (arrival);
+create index if not exists message_sort_subject_index on message_sort (subject);
+create index if not exists message_sort_from_index on message_sort (from_addr);
+create index if not exists message_sort_to_index on message_sort (to_addr);
+create index if not exists message_sort_cc_index on message_sort (cc_addr);
+create index if not exists message_sort_message_id_index on message_sort (message_id);
+create index if not exists message_size_index on message (size);
+
+-- Mod-sequences (RFC 7162 CONDSTORE and QRESYNC). The values are kept up
+-- to date by the modseq triggers in 002_triggers.sql.
+
+-- The highest mod-sequence of each mailbox. Every change to the messages
+-- of a mailbox increments it. A mailbox with no row has never changed,
+-- and its highest mod-sequence is 1.
+create table if not exists mailbox_modseq (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  highest integer not null default 1
+);
+
+-- The mod-sequence of the last change to each message. A message with
+-- no row hasn't changed since it was stored, and its mod-sequence is 1.
+create table if not exists message_modseq (
+  message_row_id integer not null primary key references message(row_id) on delete cascade on update cascade,
+  modseq integer not null
+);
+
+create index if not exists message_modseq_index on message_modseq (modseq);
+
+-- Tombstones of expunged messages, which QRESYNC uses to tell clients
+-- which messages were expunged since they last synchronized.
+create table if not exists expunged (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  uid integer not null,
+  modseq integer not null,
+
+  primary key (mailbox_id, uid)
+);
+
+create index if not exists expunged_modseq_index on expunged (mailbox_id, modseq);
+
+-- Mailbox subscriptions (SUBSCRIBE, UNSUBSCRIBE and LSUB). The names aren't
+-- references to the mailbox table: a subscription is kept when its mailbox
+-- is deleted or renamed, and may be made to a mailbox which doesn't exist,
+-- as RFC 3501 allows.
+create table if not exists subscription (
+  name text not null collate nocase primary key
+);
+
+-- The keywords (flags without a backslash, e.g. "$Junk") which have been
+-- used in each mailbox. SELECT sends them in the FLAGS and PERMANENTFLAGS
+-- responses. A keyword stays in the set after the last message with it is
+-- expunged, because clients may still be showing it.
+create table if not exists keyword (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  value text not null collate nocase,
+
+  primary key (mailbox_id, value)
+);
+
+create trigger if not exists keyword_flag_insert after insert on flag
+for each row
+when substr(new.value, 1, 1) != '\'
+begin
+  insert or ignore into keyword (mailbox_id, value)
+  select mailbox_id, new.value from message where row_id = new.message_row_id;
+end;
+
+-- Add the keywords of messages which were stored before the keyword table.
+insert or ignore into keyword (mailbox_id, value)
+select message.mailbox_id, flag.value
+from flag
+join message on flag.message_row_id = message.row_id
+where substr(flag.value, 1, 1) != '\'
+and not exists (select 1 from keyword);
+
+-- \Recent is specific to a session (RFC 3501 section 2.3.2): a message is
+-- recent only in the first session which selects its mailbox after the
+-- message arrived. Each mailbox stores the lowest UID which no session has
+-- claimed yet, so messages with a UID below it aren't recent anymore.
+-- A mailbox with no row has never been selected, so all of its messages
+-- are recent.
+create table if not exists mailbox_recent (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  first_unclaimed integer not null
+);
+
+-- \Recent used to be stored as a flag.
+delete from flag where value = '\recent';
+
+-- Special-use attributes of mailboxes (RFC 6154), e.g. "\Sent".
+-- A mailbox may have more than one.
+create table if not exists mailbox_special_use (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  use text not null collate nocase,
+
+  primary key (mailbox_id, use)
+);
+
+-- Expunging a message increments the highest mod-sequence of its mailbox,
+-- and leaves a tombstone for QRESYNC (see 004_modseq.sql). DeleteMailbox
+-- removes the tombstones along with the mailbox, and when the messages of
+-- a deleted mailbox are removed by the foreign key cascade instead, after
+-- the mailbox row is gone, there's nothing left to resynchronize, so no
+-- tombstones are written.
+--
+-- The trigger used to be in 002_triggers.sql, without the "when" clause,
+-- so it's replaced in existing databases.
+drop trigger if exists modseq_message_delete;
+
+create trigger modseq_message_delete after delete on message
+for each row
+when exists (select 1 from mailbox where id = old.mailbox_id)
+begin
+  insert or ignore into mailbox_modseq(mailbox_id) values (old.mailbox_id);
+  update mailbox_modseq set highest = highest + 1 where mailbox_id = old.mailbox_id;
+  delete from message_modseq where message_row_id = old.row_id;
+  insert or replace into expunged(mailbox_id, uid, modseq)
+    select old.mailbox_id, old.id, highest from mailbox_modseq where mailbox_id = old.mailbox_id;
+end;
+
+-- Old tombstones are pruned (see pruneExpunged). Each mailbox stores the
+-- highest mod-sequence of the tombstones pruned from it: a client which
+-- last synchronized before that can't be told exactly which messages
+-- were expunged. A mailbox with no row has never been pruned.
+create table if not exists expunged_pruned (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  modseq integer not null
+);
+
 `
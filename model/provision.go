@@ -0,0 +1,54 @@
+package model
+
+import (
+  "fmt"
+  "github.com/buchanae/mailer/imap"
+)
+
+// defaultMailboxes are created with their special-use attributes
+// (RFC 6154) for a new account, i.e. a new database.
+var defaultMailboxes = []struct{
+  name string
+  use imap.ListAttr
+}{
+  {"Sent", imap.UseSent},
+  {"Drafts", imap.UseDrafts},
+  {"Trash", imap.UseTrash},
+  {"Junk", imap.UseJunk},
+  {"Archive", imap.UseArchive},
+}
+
+// provision creates the default mailboxes if the database has none, and
+// makes sure INBOX exists, because mail is delivered there. Mailboxes
+// deleted by the user aren't created again.
+func (db *DB) provision() error {
+  var count int
+  err := db.db.QueryRow("select count(*) from mailbox").Scan(&count)
+  if err != nil {
+    return fmt.Errorf("provisioning mailboxes: %v", err)
+  }
+
+  // Names are compared ignoring case, so nothing is inserted
+  // if INBOX exists as e.g. "inbox".
+  _, err = db.db.Exec("insert or ignore into mailbox(name, next_message_id) values(?, 1)", Inbox)
+  if err != nil {
+    return fmt.Errorf("provisioning mailboxes: creating %s: %v", Inbox, err)
+  }
+
+  if count == 0 {
+    for _, m := range defaultMailboxes {
+      err := db.CreateMailbox(m.name, m.use)
+      if err != nil {
+        return fmt.Errorf("provisioning mailboxes: creating %s: %v", m.name, err)
+      }
+    }
+  }
+
+  // LIST shows the name as it's stored, so older databases,
+  // which stored INBOX as "inbox", are fixed up.
+  _, err = db.db.Exec("update mailbox set name = ? where name = ? and name != ? collate binary", Inbox, Inbox, Inbox)
+  if err != nil {
+    return fmt.Errorf("provisioning mailboxes: renaming %s: %v", Inbox, err)
+  }
+  return nil
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+  "database/sql"
+  "fmt"
+)
+
+// ClaimRecent claims the messages in the mailbox which are recent for the
+// calling session, i.e. those with a UID up to "last" which no other session
+// has claimed, so that no other session will see them as recent.
+// It returns the lowest UID claimed: the recent messages are those with
+// a UID from "first" to "last". If "first" is greater than "last",
+// no messages were claimed.
+func (db *DB) ClaimRecent(mailboxID int, last int64) (first int64, err error) {
+  err = db.withTx(func(tx *sql.Tx) error {
+    var err error
+    first, err = db.firstUnclaimed(tx, mailboxID)
+    if err != nil || first > last {
+      return err
+    }
+
+    _, err = tx.Exec(
+      "insert or replace into mailbox_recent (mailbox_id, first_unclaimed) values (?, ?)",
+      mailboxID, last + 1)
+    if err != nil {
+      return fmt.Errorf("claiming recent messages: %v", err)
+    }
+    return nil
+  })
+  return first, err
+}
+
+// PeekRecent is like ClaimRecent, but doesn't claim the messages,
+// for sessions which opened the mailbox read-only.
+func (db *DB) PeekRecent(mailboxID int, last int64) (first int64, err error) {
+  err = db.withTx(func(tx *sql.Tx) error {
+    var err error
+    first, err = db.firstUnclaimed(tx, mailboxID)
+    return err
+  })
+  return first, err
+}
+
+// firstUnclaimed returns the lowest UID in the mailbox which no session
+// has claimed as recent.
+func (db *DB) firstUnclaimed(tx *sql.Tx, mailboxID int) (int64, error) {
+  var first int64
+  row := tx.QueryRow(
+    "select coalesce((select first_unclaimed from mailbox_recent where mailbox_id = ?), 1)",
+    mailboxID)
+  err := row.Scan(&first)
+  if err != nil {
+    return 0, fmt.Errorf("loading recent messages: %v", err)
+  }
+  return first, nil
+}
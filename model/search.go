@@ -3,52 +3,83 @@ package model
 import (
   "io"
   "bytes"
+  "database/sql"
   "fmt"
+  "sort"
+  "strings"
   "github.com/buchanae/mailer/imap"
 )
 
-func (db *DB) Search(cmd *imap.SearchCommand) ([]int, error) {
+// searchDateFormat is the format of dates compared by date search keys.
+// Dates compare correctly as strings in this format.
+const searchDateFormat = "2006-01-02"
 
+// Search returns the UIDs of the messages in the mailbox which match
+// the search command, and the highest mod-sequence of those messages
+// (RFC 7162). Sequence set keys, and the RECENT, NEW and OLD keys, must
+// be converted to UID keys by the caller, since sequence numbers and
+// recent messages are specific to a session.
+func (db *DB) Search(mailbox string, cmd *imap.SearchCommand) ([]int64, int64, error) {
+  var uids []int64
+  var highest int64
+  err := db.query(mailbox, cmd.Keys, "msg.id, coalesce(mm.modseq, 1)", "msg.id", func(rows *sql.Rows) error {
+    var uid, modseq int64
+    err := rows.Scan(&uid, &modseq)
+    uids = append(uids, uid)
+    if modseq > highest {
+      highest = modseq
+    }
+    return err
+  })
+  return uids, highest, err
+}
+
+// query runs a search query in the mailbox, selecting the columns
+// in "cols" from the matching messages (as "msg"), their sort keys
+// (as "s") and mod-sequences (as "mm"), ordered by "order",
+// and calls "f" for each row.
+func (db *DB) query(mailbox string, keys []imap.SearchKey, cols, order string, f func(*sql.Rows) error) error {
   buf := &bytes.Buffer{}
   b := &builder{
     Writer: buf,
+    fts: db.fts,
   }
-  b.expr("select distinct(msg.id) from message as msg")
-  b.expr("join header on msg.row_id = header.message_row_id where")
+  b.expr("select " + cols + " from message as msg")
+  b.expr("join mailbox on msg.mailbox_id = mailbox.id")
+  b.expr("left join message_sort as s on s.message_row_id = msg.row_id")
+  b.expr("left join message_modseq as mm on mm.message_row_id = msg.row_id")
+  b.expr("where mailbox.name = ? and", mailbox)
 
   // TODO implement charset handling
-  err := buildSearchQuery(b, &imap.GroupKey{Keys: cmd.Keys})
+  err := buildSearchQuery(b, &imap.GroupKey{Keys: keys})
   if err != nil {
-    return nil, err
+    return err
   }
+  b.expr("order by " + order)
 
-  q := buf.String()
-  fmt.Println(q, b.args)
-  rows, err := db.db.Query(q, b.args...)
+  rows, err := db.db.Query(buf.String(), b.args...)
   if err != nil {
-    return nil, err
+    return fmt.Errorf("searching messages: %v", err)
   }
   defer rows.Close()
 
-  var ids []int
   for rows.Next() {
-    var id int
-    err := rows.Scan(&id)
+    err := f(rows)
     if err != nil {
-      return nil, err
+      return fmt.Errorf("loading search results: %v", err)
     }
-    ids = append(ids, id)
   }
-
   if err := rows.Err(); err != nil {
-    return nil, fmt.Errorf("loading message range: %v", err)
+    return fmt.Errorf("loading search results: %v", err)
   }
-  return ids, nil
+  return nil
 }
 
 type builder struct {
   io.Writer
   args []interface{}
+  // fts is true if the full-text search index is available.
+  fts bool
 }
 func (b *builder) expr(s string, args ...interface{}) {
   fmt.Fprint(b, " ")
@@ -77,6 +108,7 @@ func buildSearchQuery(b *builder, key imap.SearchKey) error {
     return nil
 
   case *imap.OrKey:
+    b.expr("(")
     err := buildSearchQuery(b, z.Arg1)
     if err != nil {
       return err
@@ -86,6 +118,7 @@ func buildSearchQuery(b *builder, key imap.SearchKey) error {
     if err != nil {
       return err
     }
+    b.expr(")")
     return nil
 
   case *imap.NotKey:
@@ -99,36 +132,31 @@ func buildSearchQuery(b *builder, key imap.SearchKey) error {
 
   case *imap.StatusKey:
     switch z.Name {
-    // TODO
     case "all":
-      // Apparently "all" means all messages in the mailbox, so there's
-      // nothing to query for here. Seems silly?
+      // All messages in the mailbox.
+      b.expr("1")
     case  "answered":
-      b.expr("answered = 1")
+      b.expr("msg.answered = 1")
     case "unanswered":
-      b.expr("answered = 0")
+      b.expr("msg.answered = 0")
     case  "deleted":
-      b.expr("deleted = 1")
+      b.expr("msg.deleted = 1")
     case  "undeleted":
-      b.expr("deleted = 0")
+      b.expr("msg.deleted = 0")
     case  "flagged":
-      b.expr("flagged = 1")
+      b.expr("msg.flagged = 1")
     case  "unflagged":
-      b.expr("flagged = 0")
-    case  "recent":
-      b.expr("recent = 1")
-    case  "new":
-      b.expr("recent = 1 and seen = 0")
-    case  "old":
-      b.expr("recent = 0")
+      b.expr("msg.flagged = 0")
+    case "recent", "new", "old":
+      return fmt.Errorf("search key %q must be converted to UIDs", z.Name)
     case  "seen":
-      b.expr("seen = 1")
+      b.expr("msg.seen = 1")
     case  "unseen":
-      b.expr("seen = 0")
+      b.expr("msg.seen = 0")
     case  "draft":
-      b.expr("draft = 1")
+      b.expr("msg.draft = 1")
     case  "undraft":
-      b.expr("draft = 0")
+      b.expr("msg.draft = 0")
     default:
       return fmt.Errorf("unknown status key %q", z.Name)
     }
@@ -136,32 +164,41 @@ func buildSearchQuery(b *builder, key imap.SearchKey) error {
   case *imap.FieldKey:
     switch z.Name {
     case "bcc", "cc", "from", "subject", "to":
-      arg := "%" + z.Arg + "%"
-      b.expr("header.key = ? and header.value like ?", z.Name, arg)
-    // TODO
-    //case  "body":
-    //case  "text":
-    //case "keyword":
-    //case  "unkeyword":
+      headerContains(b, z.Name, z.Arg)
+    case "body", "text":
+      textContainsExpr(b, z.Name, z.Arg)
+    case "keyword":
+      b.expr("exists (select 1 from flag where flag.message_row_id = msg.row_id and flag.value = ?)", z.Arg)
+    case "unkeyword":
+      b.expr("not exists (select 1 from flag where flag.message_row_id = msg.row_id and flag.value = ?)", z.Arg)
     default:
       return fmt.Errorf("unknown field key %q", z.Name)
     }
 
   case *imap.HeaderKey:
-    arg := "%" + z.Arg + "%"
-    b.expr("header.key = ? and header.value like ?", z.Name, arg)
+    headerContains(b, z.Name, z.Arg)
 
   case *imap.DateKey:
+    // Dates are compared disregarding time and timezone (RFC 3501 6.4.4).
+    // The internal date is stored in the format "2006-01-02 15:04:05...",
+    // so the first 10 characters are the date.
+    const internal = "substr(msg.created, 1, 10)"
+    const sent = "exists (select 1 from header where header.message_row_id = msg.row_id and header.key = 'date' and sent_date(header.value) != '' and sent_date(header.value) %s ?)"
+    arg := z.Arg.Format(searchDateFormat)
+
     switch z.Name {
     case "before":
-      b.expr("msg.created < ?", z.Arg)
+      b.expr(internal + " < ?", arg)
+    case "on":
+      b.expr(internal + " = ?", arg)
     case  "since":
-      b.expr("msg.created > ?", z.Arg)
-    // TODO
-    //case  "on":
-    //case "sentbefore":
-    //case  "senton":
-    //case  "sentsince":
+      b.expr(internal + " >= ?", arg)
+    case "sentbefore":
+      b.expr(fmt.Sprintf(sent, "<"), arg)
+    case "senton":
+      b.expr(fmt.Sprintf(sent, "="), arg)
+    case "sentsince":
+      b.expr(fmt.Sprintf(sent, ">="), arg)
     default:
       return fmt.Errorf("unknown date key %q", z.Name)
     }
@@ -176,19 +213,123 @@ func buildSearchQuery(b *builder, key imap.SearchKey) error {
       return fmt.Errorf("unknown size key %q", z.Name)
     }
 
+  case *imap.ModSeqKey:
+    b.expr("coalesce(mm.modseq, 1) >= ?", z.ModSeq)
+
   case *imap.UIDKey:
-    for _, seq := range z.Seqs {
-      if seq.IsRange && seq.End > seq.Start {
-        b.expr("msg.id >= ? and msg.id <= ?", seq.Start, seq.End)
-      } else {
-        b.expr("msg.id >= ?", seq.Start)
-      }
-    }
+    b.expr(uidSetExpr(z.Seqs))
 
   case *imap.SequenceKey:
-    return fmt.Errorf("sequence key is not supported")
+    return fmt.Errorf("sequence key must be converted to a UID key")
   default:
     return fmt.Errorf("unknown search key")
   }
   return nil
 }
+
+// likeEscaper escapes the LIKE wildcards, so they match literally,
+// in patterns used with "escape '\'".
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// headerContains matches messages which have a header field named "key"
+// containing "arg", ignoring case. An empty "arg" matches all messages
+// which have the field.
+func headerContains(b *builder, key, arg string) {
+  arg = "%" + likeEscaper.Replace(arg) + "%"
+  b.expr(`exists (select 1 from header where header.message_row_id = msg.row_id and header.key = ? and header.value like ? escape '\')`, key, arg)
+}
+
+// textContainsExpr matches messages whose text contains "arg", for the BODY
+// and TEXT search keys. The message files are read to check the text, which
+// is slow, so the full-text index is used first to narrow the candidates,
+// if it's available and "arg" is long enough to look up. Messages missing
+// from the index (see initFTS) are always candidates.
+func textContainsExpr(b *builder, name, arg string) {
+  check := "text_contains(msg.path, ?)"
+  if name == "body" {
+    check = "body_contains(msg.path, ?)"
+  }
+
+  q, ok := ftsQuery(arg)
+  if !b.fts || !ok {
+    b.expr(check, arg)
+    return
+  }
+  if name == "body" {
+    q = "body : (" + q + ")"
+  }
+  b.expr(`(msg.row_id in (select rowid from message_trigram where message_trigram match ?)
+    or msg.row_id not in (select rowid from message_trigram)) and ` + check, q, arg)
+}
+
+// uidSetExpr returns an expression which matches the messages in a UID set.
+// Overlapping and adjacent ranges are merged, single UIDs are listed in one
+// "in" term, and the terms are joined by a balanced tree of "or", so that
+// large sets stay within SQLite's limits on expression depth and on the
+// number of parameters. UIDs are integers, so they're written into
+// the SQL directly.
+func uidSetExpr(set []imap.Sequence) string {
+  // "*" (zero) is the highest UID in the message's mailbox.
+  const max = "(select max(id) from message where mailbox_id = msg.mailbox_id)"
+
+  var terms []string
+  var ranges [][2]int
+  for _, seq := range set {
+    start, end := seq.Start, seq.End
+    if !seq.IsRange {
+      end = start
+    }
+    switch {
+    case start == 0 && end == 0:
+      terms = append(terms, "msg.id = " + max)
+    case start == 0 || end == 0:
+      // A range may be given in either order, e.g. "*:4" is the same as "4:*".
+      n := start + end
+      terms = append(terms, fmt.Sprintf("msg.id between min(%d, %s) and max(%d, %s)", n, max, n, max))
+    case start > end:
+      ranges = append(ranges, [2]int{end, start})
+    default:
+      ranges = append(ranges, [2]int{start, end})
+    }
+  }
+
+  sort.Slice(ranges, func(i, j int) bool {
+    return ranges[i][0] < ranges[j][0]
+  })
+  var merged [][2]int
+  for _, r := range ranges {
+    if n := len(merged); n > 0 && r[0] <= merged[n-1][1] + 1 {
+      if r[1] > merged[n-1][1] {
+        merged[n-1][1] = r[1]
+      }
+      continue
+    }
+    merged = append(merged, r)
+  }
+
+  var single []string
+  for _, r := range merged {
+    if r[0] == r[1] {
+      single = append(single, fmt.Sprint(r[0]))
+    } else {
+      terms = append(terms, fmt.Sprintf("msg.id between %d and %d", r[0], r[1]))
+    }
+  }
+  if len(single) > 0 {
+    terms = append(terms, "msg.id in (" + strings.Join(single, ", ") + ")")
+  }
+
+  if len(terms) == 0 {
+    return "0"
+  }
+  return orTerms(terms)
+}
+
+// orTerms joins the terms with "or", nested as a balanced tree.
+func orTerms(terms []string) string {
+  if len(terms) == 1 {
+    return "(" + terms[0] + ")"
+  }
+  mid := len(terms) / 2
+  return "(" + orTerms(terms[:mid]) + " or " + orTerms(terms[mid:]) + ")"
+}
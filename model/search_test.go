@@ -0,0 +1,302 @@
+package model
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+  "github.com/buchanae/mailer/imap"
+)
+
+// testDB opens a new database in a temporary directory,
+// which is removed by the returned function.
+func testDB(t *testing.T) (*DB, func()) {
+  dir, err := ioutil.TempDir("", "mailer-model-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  db, err := Open(dir)
+  if err != nil {
+    os.RemoveAll(dir)
+    t.Fatal(err)
+  }
+  return db, func() {
+    db.Close()
+    os.RemoveAll(dir)
+  }
+}
+
+// addMessages adds "n" messages to the mailbox,
+// with the subjects "message 1", "message 2", etc.
+func addMessages(t *testing.T, db *DB, mailbox string, n int) {
+  for i := 1; i <= n; i++ {
+    body := fmt.Sprintf("Subject: message %d\r\n\r\nbody %d\r\n", i, i)
+    _, err := db.CreateMessage(mailbox, strings.NewReader(body), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+}
+
+func TestSearchManyUIDs(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  const n = 2000
+  addMessages(t, db, "INBOX", n)
+
+  // Every other message, as single UIDs, which used to become
+  // one "or" term each, past SQLite's expression depth limit.
+  var odd []imap.Sequence
+  for i := 1; i <= n; i += 2 {
+    odd = append(odd, imap.Sequence{Start: i})
+  }
+
+  tests := []struct {
+    desc string
+    set []imap.Sequence
+    count int
+  }{
+    {"1:2000", []imap.Sequence{{Start: 1, End: n, IsRange: true}}, n},
+    {"odd", odd, n / 2},
+    {"1:10,5:20,21,30:25", []imap.Sequence{
+      {Start: 1, End: 10, IsRange: true},
+      {Start: 5, End: 20, IsRange: true},
+      {Start: 21},
+      {Start: 30, End: 25, IsRange: true},
+    }, 27},
+    {"1990:*", []imap.Sequence{{Start: 1990, IsRange: true}}, 11},
+    {"5000:*", []imap.Sequence{{Start: 5000, IsRange: true}}, 1},
+    {"empty", nil, 0},
+  }
+
+  for _, test := range tests {
+    cmd := &imap.SearchCommand{Keys: []imap.SearchKey{&imap.UIDKey{Seqs: test.set}}}
+    uids, _, err := db.Search("INBOX", cmd)
+    if err != nil {
+      t.Errorf("searching %s: %v", test.desc, err)
+      continue
+    }
+    if len(uids) != test.count {
+      t.Errorf("searching %s: expected %d messages, got %d", test.desc, test.count, len(uids))
+    }
+  }
+}
+
+func TestSearchKeys(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  msgs := []struct {
+    msg string
+    flags []imap.Flag
+  }{
+    {
+      "Date: Mon, 02 Jan 2006 15:04:05 -0700\r\nSubject: alpha\r\n\r\n",
+      []imap.Flag{imap.Seen, "$Junk"},
+    },
+    {
+      // The date is compared disregarding the timezone.
+      "Date: Tue, 03 Jan 2006 23:30:00 -0700\r\nSubject: beta\r\n\r\n",
+      []imap.Flag{imap.Flagged},
+    },
+    {
+      "Date: not a date\r\nSubject: gamma\r\n\r\n",
+      []imap.Flag{imap.Seen, "$Forwarded"},
+    },
+  }
+  for _, m := range msgs {
+    _, err := db.CreateMessage("INBOX", strings.NewReader(m.msg), m.flags)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  subject := func(s string) imap.SearchKey {
+    return &imap.FieldKey{Name: "subject", Arg: s}
+  }
+  seen := &imap.StatusKey{Name: "seen"}
+  flagged := &imap.StatusKey{Name: "flagged"}
+  jan3 := time.Date(2006, 1, 3, 0, 0, 0, 0, time.UTC)
+
+  tests := []struct {
+    desc string
+    keys []imap.SearchKey
+    expect []int64
+  }{
+    {"OR SUBJECT alpha SUBJECT beta",
+      []imap.SearchKey{&imap.OrKey{Arg1: subject("alpha"), Arg2: subject("beta")}},
+      []int64{1, 2}},
+    {"SEEN OR SUBJECT beta FLAGGED",
+      []imap.SearchKey{seen, &imap.OrKey{Arg1: subject("beta"), Arg2: flagged}},
+      nil},
+    {"OR (SUBJECT gamma SEEN) FLAGGED",
+      []imap.SearchKey{&imap.OrKey{
+        Arg1: &imap.GroupKey{Keys: []imap.SearchKey{subject("gamma"), seen}},
+        Arg2: flagged,
+      }},
+      []int64{2, 3}},
+    {"NOT OR SUBJECT alpha SUBJECT beta",
+      []imap.SearchKey{&imap.NotKey{Arg: &imap.OrKey{Arg1: subject("alpha"), Arg2: subject("beta")}}},
+      []int64{3}},
+    {"KEYWORD $Junk",
+      []imap.SearchKey{&imap.FieldKey{Name: "keyword", Arg: "$Junk"}},
+      []int64{1}},
+    {"KEYWORD $junk",
+      []imap.SearchKey{&imap.FieldKey{Name: "keyword", Arg: "$junk"}},
+      []int64{1}},
+    {"KEYWORD $Missing",
+      []imap.SearchKey{&imap.FieldKey{Name: "keyword", Arg: "$Missing"}},
+      nil},
+    {"UNKEYWORD $Junk",
+      []imap.SearchKey{&imap.FieldKey{Name: "unkeyword", Arg: "$Junk"}},
+      []int64{2, 3}},
+    {"SENTON 3-Jan-2006",
+      []imap.SearchKey{&imap.DateKey{Name: "senton", Arg: jan3}},
+      []int64{2}},
+    {"SENTBEFORE 3-Jan-2006",
+      []imap.SearchKey{&imap.DateKey{Name: "sentbefore", Arg: jan3}},
+      []int64{1}},
+    {"SENTSINCE 3-Jan-2006",
+      []imap.SearchKey{&imap.DateKey{Name: "sentsince", Arg: jan3}},
+      []int64{2}},
+    // Messages without a valid date never match SENTSINCE,
+    // so NOT SENTSINCE matches them.
+    {"NOT SENTSINCE 3-Jan-2006",
+      []imap.SearchKey{&imap.NotKey{Arg: &imap.DateKey{Name: "sentsince", Arg: jan3}}},
+      []int64{1, 3}},
+  }
+
+  for _, test := range tests {
+    uids, _, err := db.Search("INBOX", &imap.SearchCommand{Keys: test.keys})
+    if err != nil {
+      t.Errorf("searching %s: %v", test.desc, err)
+      continue
+    }
+    if !reflect.DeepEqual(uids, test.expect) {
+      t.Errorf("searching %s: expected %v, got %v", test.desc, test.expect, uids)
+    }
+  }
+}
+
+func TestSearchText(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  msgs := []string{
+    "Subject: plans\r\n\r\nThe secret agent arrives tomorrow.\r\n",
+    "Subject: secret\r\n\r\nNothing to see here.\r\n",
+    "Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\r\n\r\nvon J\xc3\xb6rg\r\n",
+  }
+  for _, m := range msgs {
+    _, err := db.CreateMessage("INBOX", strings.NewReader(m), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  body := func(s string) imap.SearchKey {
+    return &imap.FieldKey{Name: "body", Arg: s}
+  }
+  text := func(s string) imap.SearchKey {
+    return &imap.FieldKey{Name: "text", Arg: s}
+  }
+
+  tests := []struct {
+    key imap.SearchKey
+    expect []int64
+  }{
+    {body("secret"), []int64{1}},
+    {body("SECRET"), []int64{1}},
+    // Substrings in the middle of a word match too.
+    {body("ecre"), []int64{1}},
+    {body("ecret AGEN"), []int64{1}},
+    {body("agent arrives"), []int64{1}},
+    {body("arrives agent"), nil},
+    {body(" see"), []int64{2}},
+    {body("tomorrow."), []int64{1}},
+    {body("JÖRG"), []int64{3}},
+    // Too short to look up in the index.
+    {body("se"), []int64{1, 2}},
+    {text("ecre"), []int64{1, 2}},
+    {text("plans"), []int64{1}},
+    {text("grüße"), []int64{3}},
+  }
+
+  search := func() {
+    for _, test := range tests {
+      cmd := &imap.SearchCommand{Keys: []imap.SearchKey{test.key}}
+      uids, _, err := db.Search("INBOX", cmd)
+      if err != nil {
+        t.Errorf("searching %v: %v", test.key, err)
+        continue
+      }
+      if !reflect.DeepEqual(uids, test.expect) {
+        t.Errorf("searching %v: expected %v, got %v", test.key, test.expect, uids)
+      }
+    }
+  }
+  search()
+
+  // With the index, only the candidates are read. Message 2's body file
+  // isn't needed to search for "secret".
+  if db.fts {
+    msg, err := db.MessageByUID("INBOX", 2)
+    if err != nil {
+      t.Fatal(err)
+    }
+    b, err := ioutil.ReadFile(msg.Path)
+    if err != nil {
+      t.Fatal(err)
+    }
+    os.Remove(msg.Path)
+    uids, _, err := db.Search("INBOX", &imap.SearchCommand{Keys: []imap.SearchKey{body("secret")}})
+    if err != nil || !reflect.DeepEqual(uids, []int64{1}) {
+      t.Errorf("searching with the index: expected [1], got %v, %v", uids, err)
+    }
+    err = ioutil.WriteFile(msg.Path, b, 0600)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  // Messages missing from the index, e.g. those delivered by a build
+  // without FTS5, are still found.
+  if db.fts {
+    _, err := db.db.Exec("delete from message_trigram")
+    if err != nil {
+      t.Fatal(err)
+    }
+    search()
+  }
+}
+
+func TestFTSQuery(t *testing.T) {
+  tests := []struct {
+    arg, expect string
+    ok bool
+  }{
+    {"", "", false},
+    {"se", "", false},
+    {"abc", `"616263"`, true},
+    {"ABCb", `"616263" AND "626362"`, true},
+    {"aaaa", `"616161"`, true},
+    {"ab c", `"616220" AND "622063"`, true},
+    {"ö.x", `"c3b62e78"`, true},
+  }
+
+  for _, test := range tests {
+    q, ok := ftsQuery(test.arg)
+    if q != test.expect || ok != test.ok {
+      t.Errorf("ftsQuery(%q): got %q, %v, expected %q, %v", test.arg, q, ok, test.expect, test.ok)
+    }
+  }
+
+  q, _ := ftsQuery("the quick brown fox jumps over the lazy dog, again and again")
+  if n := len(strings.Split(q, " AND ")); n != maxQueryTrigrams {
+    t.Errorf("expected %d trigrams in a long query, got %d", maxQueryTrigrams, n)
+  }
+}
@@ -0,0 +1,239 @@
+package model
+
+import (
+  "database/sql"
+  "fmt"
+  "mime"
+  "net/mail"
+  "regexp"
+  "strings"
+  "github.com/buchanae/mailer/imap"
+)
+
+// sortKeys holds the values of the message_sort table for a message.
+type sortKeys struct {
+  sent, arrival int64
+  subject string
+  subjectReply bool
+  from, to, cc string
+  messageID string
+  refs string
+}
+
+func messageSortKeys(msg *Message) *sortKeys {
+  k := &sortKeys{
+    arrival: msg.Created.Unix(),
+    sent: msg.Created.Unix(),
+    from: firstMailbox(msg.Headers.Get("From")),
+    to: firstMailbox(msg.Headers.Get("To")),
+    cc: firstMailbox(msg.Headers.Get("Cc")),
+    messageID: firstMessageID(msg.Headers.Get("Message-Id")),
+  }
+
+  if t, err := mail.ParseDate(msg.Headers.Get("Date")); err == nil {
+    k.sent = t.Unix()
+  }
+
+  k.subject, k.subjectReply = baseSubject(decodeHeader(msg.Headers.Get("Subject")))
+
+  refs := messageIDs(msg.Headers.Get("References"))
+  if len(refs) == 0 {
+    if id := firstMessageID(msg.Headers.Get("In-Reply-To")); id != "" {
+      refs = []string{id}
+    }
+  }
+  k.refs = strings.Join(refs, " ")
+  return k
+}
+
+func (db *DB) addSortKeys(tx *sql.Tx, msg *Message) error {
+  k := messageSortKeys(msg)
+  _, err := tx.Exec(`
+    insert or replace into message_sort(
+      message_row_id,
+      sent,
+      arrival,
+      subject,
+      subject_reply,
+      from_addr,
+      to_addr,
+      cc_addr,
+      message_id,
+      refs
+    ) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+    msg.RowID, k.sent, k.arrival, k.subject, k.subjectReply,
+    k.from, k.to, k.cc, k.messageID, k.refs)
+  if err != nil {
+    return fmt.Errorf("inserting sort keys: %v", err)
+  }
+  return nil
+}
+
+// rebuildSortKeys recomputes the sort keys of all messages,
+// e.g. for messages stored before the message_sort table existed.
+func (db *DB) rebuildSortKeys() error {
+  rows, err := db.db.Query("select row_id from message")
+  if err != nil {
+    return fmt.Errorf("loading messages: %v", err)
+  }
+  defer rows.Close()
+
+  var rowIDs []int
+  for rows.Next() {
+    var rowID int
+    err := rows.Scan(&rowID)
+    if err != nil {
+      return fmt.Errorf("loading messages: %v", err)
+    }
+    rowIDs = append(rowIDs, rowID)
+  }
+  if err := rows.Err(); err != nil {
+    return fmt.Errorf("loading messages: %v", err)
+  }
+  rows.Close()
+
+  return db.withTx(func(tx *sql.Tx) error {
+    for _, rowID := range rowIDs {
+      msg, err := db.Message(rowID)
+      if err != nil {
+        return err
+      }
+      err = db.addSortKeys(tx, msg)
+      if err != nil {
+        return err
+      }
+    }
+    return nil
+  })
+}
+
+// sortColumns maps SORT keys to the columns they order by.
+var sortColumns = map[string]string{
+  "arrival": "coalesce(s.arrival, 0)",
+  "cc": "coalesce(s.cc_addr, '')",
+  "date": "coalesce(s.sent, 0)",
+  "from": "coalesce(s.from_addr, '')",
+  "size": "msg.size",
+  "subject": "coalesce(s.subject, '')",
+  "to": "coalesce(s.to_addr, '')",
+}
+
+// Sort returns the UIDs of the messages in the mailbox which match
+// the search keys, ordered by the sort criteria (RFC 5256). Messages
+// which compare equal are ordered by UID, i.e. by sequence number.
+func (db *DB) Sort(mailbox string, criteria []imap.SortCriterion, keys []imap.SearchKey) ([]int64, error) {
+  var order []string
+  for _, c := range criteria {
+    col, ok := sortColumns[c.Key]
+    if !ok {
+      return nil, fmt.Errorf("unknown sort key %q", c.Key)
+    }
+    if c.Reverse {
+      col += " desc"
+    }
+    order = append(order, col)
+  }
+  order = append(order, "msg.id")
+
+  var uids []int64
+  err := db.query(mailbox, keys, "msg.id", strings.Join(order, ", "), func(rows *sql.Rows) error {
+    var uid int64
+    err := rows.Scan(&uid)
+    uids = append(uids, uid)
+    return err
+  })
+  return uids, err
+}
+
+func decodeHeader(s string) string {
+  dec := &mime.WordDecoder{}
+  if d, err := dec.DecodeHeader(s); err == nil {
+    return d
+  }
+  return s
+}
+
+// firstMailbox returns the lowercase mailbox (local part) of the first
+// address in an address list header, as used by the SORT keys FROM, TO and CC.
+func firstMailbox(s string) string {
+  addrs, err := mail.ParseAddressList(s)
+  if err != nil || len(addrs) == 0 {
+    return ""
+  }
+  local := addrs[0].Address
+  if i := strings.LastIndex(local, "@"); i != -1 {
+    local = local[:i]
+  }
+  return strings.ToLower(local)
+}
+
+var msgIDPattern = regexp.MustCompile(`<[^<>]+>`)
+
+// messageIDs returns the message IDs (e.g. "<abc@example.com>")
+// in a References or In-Reply-To header.
+func messageIDs(s string) []string {
+  return msgIDPattern.FindAllString(s, -1)
+}
+
+func firstMessageID(s string) string {
+  ids := messageIDs(s)
+  if len(ids) == 0 {
+    return ""
+  }
+  return ids[0]
+}
+
+var (
+  subjBlob = `\[[^\[\]]*\]\s*`
+  subjLeader = regexp.MustCompile(`(?i)^(` + subjBlob + `)*(re|fwd?)\s*(` + subjBlob + `)?:\s*`)
+  subjBlobLeader = regexp.MustCompile(`^` + subjBlob)
+  subjFwd = regexp.MustCompile(`(?i)^\[fwd:(.*)\]$`)
+)
+
+// baseSubject extracts the base subject (RFC 5256 section 2.1), which
+// is used to sort and thread by subject, e.g. "Re: [list] Fwd: hello (fwd)"
+// becomes "hello". It also returns true if the subject indicated a reply
+// or forward. The result is lowercase, so it compares ignoring case.
+func baseSubject(s string) (string, bool) {
+  reply := false
+
+  // (1) Convert runs of whitespace to a single space.
+  s = strings.Join(strings.Fields(s), " ")
+
+  for {
+    // (2) Remove trailing "(fwd)" and whitespace.
+    for {
+      s = strings.TrimRight(s, " ")
+      if !strings.HasSuffix(strings.ToLower(s), "(fwd)") {
+        break
+      }
+      s = s[:len(s) - len("(fwd)")]
+      reply = true
+    }
+
+    // (3, 4, 5) Remove leading whitespace, "Re:", "Fwd:", etc. and "[blob]",
+    // unless the blob is the whole subject.
+    for {
+      s = strings.TrimLeft(s, " ")
+      if loc := subjLeader.FindStringIndex(s); loc != nil {
+        s = s[loc[1]:]
+        reply = true
+        continue
+      }
+      if loc := subjBlobLeader.FindStringIndex(s); loc != nil && loc[1] < len(s) {
+        s = s[loc[1]:]
+        continue
+      }
+      break
+    }
+
+    // (6) Unwrap "[fwd: ...]" and start over.
+    if m := subjFwd.FindStringSubmatch(s); m != nil {
+      s = m[1]
+      reply = true
+      continue
+    }
+    break
+  }
+  return strings.ToLower(strings.TrimSpace(s)), reply
+}
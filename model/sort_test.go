@@ -0,0 +1,105 @@
+package model
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestBaseSubject(t *testing.T) {
+  tests := []struct {
+    subject, base string
+    reply bool
+  }{
+    {"hello", "hello", false},
+    {"  Hello   World ", "hello world", false},
+    {"Re: hello", "hello", true},
+    {"RE: Fwd: hello", "hello", true},
+    {"re [list]: hello", "hello", true},
+    {"[list] hello", "hello", false},
+    {"[list]", "[list]", false},
+    {"hello (fwd)", "hello", true},
+    {"[Fwd: Re: hello]", "hello", true},
+    {"Re: [list] [Fwd: hello] (fwd)", "hello", true},
+  }
+
+  for _, test := range tests {
+    base, reply := baseSubject(test.subject)
+    if base != test.base || reply != test.reply {
+      t.Errorf("baseSubject(%q): got %q, %v, expected %q, %v", test.subject, base, reply, test.base, test.reply)
+    }
+  }
+}
+
+func TestSort(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  msgs := []string{
+    "Date: Wed, 04 Jan 2006 10:00:00 +0000\r\nFrom: Carol <carol@example.com>\r\n" +
+      "To: bob@example.com\r\nSubject: Re: beta\r\n\r\n" + strings.Repeat("x", 1000),
+    "Date: Mon, 02 Jan 2006 10:00:00 +0000\r\nFrom: alice@example.com\r\n" +
+      "To: dave@example.com\r\nCc: zed@example.com\r\nSubject: alpha\r\n\r\n",
+    "Date: Tue, 03 Jan 2006 10:00:00 +0000\r\nFrom: Bob <BOB@example.com>\r\n" +
+      "To: alice@example.com\r\nSubject: [list] Gamma\r\n\r\n" + strings.Repeat("x", 500),
+    // Without a Date header, the internal date is used.
+    "From: alice@example.com\r\nSubject: Fwd: alpha (fwd)\r\n\r\n" + strings.Repeat("x", 250),
+  }
+  for _, m := range msgs {
+    _, err := db.CreateMessage("INBOX", strings.NewReader(m), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  sortBy := func(keys ...string) []imap.SortCriterion {
+    var c []imap.SortCriterion
+    for _, k := range keys {
+      if strings.HasPrefix(k, "-") {
+        c = append(c, imap.SortCriterion{Key: k[1:], Reverse: true})
+      } else {
+        c = append(c, imap.SortCriterion{Key: k})
+      }
+    }
+    return c
+  }
+  all := []imap.SearchKey{&imap.StatusKey{Name: "all"}}
+  alpha := []imap.SearchKey{&imap.FieldKey{Name: "subject", Arg: "alpha"}}
+
+  // Keys starting with "-" are reversed.
+  tests := []struct {
+    criteria []imap.SortCriterion
+    keys []imap.SearchKey
+    expect []int64
+  }{
+    {sortBy("arrival"), all, []int64{1, 2, 3, 4}},
+    {sortBy("date"), all, []int64{2, 3, 1, 4}},
+    {sortBy("-date"), all, []int64{4, 1, 3, 2}},
+    {sortBy("from"), all, []int64{2, 4, 3, 1}},
+    {sortBy("from", "-date"), all, []int64{4, 2, 3, 1}},
+    {sortBy("to"), all, []int64{4, 3, 1, 2}},
+    {sortBy("cc"), all, []int64{1, 3, 4, 2}},
+    {sortBy("size"), all, []int64{2, 4, 3, 1}},
+    {sortBy("subject"), all, []int64{2, 4, 1, 3}},
+    // Messages which compare equal stay in UID order, even when reversed.
+    {sortBy("-subject"), all, []int64{3, 1, 2, 4}},
+    {sortBy("-size"), alpha, []int64{4, 2}},
+  }
+
+  for _, test := range tests {
+    uids, err := db.Sort("INBOX", test.criteria, test.keys)
+    if err != nil {
+      t.Errorf("sorting by %v: %v", test.criteria, err)
+      continue
+    }
+    if !reflect.DeepEqual(uids, test.expect) {
+      t.Errorf("sorting by %v: expected %v, got %v", test.criteria, test.expect, uids)
+    }
+  }
+
+  _, err := db.Sort("INBOX", sortBy("color"), all)
+  if err == nil {
+    t.Error("expected an error sorting by an unknown key")
+  }
+}
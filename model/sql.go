@@ -1,5 +1,57 @@
 package model
 
+import (
+  "database/sql"
+  "net/mail"
+  "strings"
+  "github.com/mattn/go-sqlite3"
+)
+
 const startupSql = `PRAGMA foreign_keys = ON;`
 
 //go:generate go run scripts/pack_sql.go
+
+// driverName is the name of the sqlite driver, extended with
+// the functions used by search queries.
+const driverName = "sqlite3_mailer"
+
+func init() {
+  sql.Register(driverName, &sqlite3.SQLiteDriver{
+    ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+      err := conn.RegisterFunc("sent_date", sentDate, true)
+      if err != nil {
+        return err
+      }
+      err = conn.RegisterFunc("body_contains", bodyContains, false)
+      if err != nil {
+        return err
+      }
+      return conn.RegisterFunc("text_contains", textContainsFunc, false)
+    },
+  })
+}
+
+// sentDate parses the value of a Date header and returns the date
+// as "YYYY-MM-DD", disregarding the time and timezone, as required by
+// the SENTBEFORE, SENTON and SENTSINCE search keys. It returns an empty
+// string if the date can't be parsed.
+func sentDate(value string) string {
+  t, err := mail.ParseDate(value)
+  if err != nil {
+    return ""
+  }
+  return t.Format(searchDateFormat)
+}
+
+func bodyContains(path, s string) (bool, error) {
+  return textContains(path, s, false)
+}
+
+func textContainsFunc(path, s string) (bool, error) {
+  return textContains(path, s, true)
+}
+
+// containsFold returns true if "s" contains "substr", ignoring case.
+func containsFold(s, substr string) bool {
+  return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
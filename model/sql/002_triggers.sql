@@ -87,3 +87,47 @@ when old.value = '\deleted'
 begin
   update message set deleted = 0 where row_id = old.message_row_id;
 end;
+
+-- Mod-sequences (RFC 7162). Adding a message, changing its flags, or
+-- expunging it increments the highest mod-sequence of the mailbox,
+-- which becomes the mod-sequence of the message (or its tombstone).
+-- \Recent isn't a change that clients need to resynchronize.
+
+create trigger if not exists modseq_message_insert after insert on message
+for each row
+begin
+  insert or ignore into mailbox_modseq(mailbox_id) values (new.mailbox_id);
+  update mailbox_modseq set highest = highest + 1 where mailbox_id = new.mailbox_id;
+  insert or replace into message_modseq(message_row_id, modseq)
+    select new.row_id, highest from mailbox_modseq where mailbox_id = new.mailbox_id;
+end;
+
+-- modseq_message_delete is in 009_expunged.sql.
+
+create trigger if not exists modseq_flag_insert after insert on flag
+for each row
+when new.value != '\recent'
+begin
+  insert or ignore into mailbox_modseq(mailbox_id)
+    select mailbox_id from message where row_id = new.message_row_id;
+  update mailbox_modseq set highest = highest + 1
+    where mailbox_id = (select mailbox_id from message where row_id = new.message_row_id);
+  insert or replace into message_modseq(message_row_id, modseq)
+    select m.row_id, x.highest from message as m
+    join mailbox_modseq as x on x.mailbox_id = m.mailbox_id
+    where m.row_id = new.message_row_id;
+end;
+
+create trigger if not exists modseq_flag_delete after delete on flag
+for each row
+when old.value != '\recent'
+begin
+  insert or ignore into mailbox_modseq(mailbox_id)
+    select mailbox_id from message where row_id = old.message_row_id;
+  update mailbox_modseq set highest = highest + 1
+    where mailbox_id = (select mailbox_id from message where row_id = old.message_row_id);
+  insert or replace into message_modseq(message_row_id, modseq)
+    select m.row_id, x.highest from message as m
+    join mailbox_modseq as x on x.mailbox_id = m.mailbox_id
+    where m.row_id = old.message_row_id;
+end;
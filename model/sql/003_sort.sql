@@ -0,0 +1,33 @@
+-- Sort and thread keys (RFC 5256), computed from the message headers
+-- when the message is inserted.
+create table if not exists message_sort (
+  message_row_id integer not null primary key references message(row_id) on delete cascade on update cascade,
+
+  -- Unix time of the Date header, or of the internal date if the header
+  -- is missing or invalid.
+  sent integer not null default 0,
+  -- Unix time of the internal date.
+  arrival integer not null default 0,
+  -- Base subject, in lowercase.
+  subject text not null default '',
+  -- Is the subject a reply or forward, e.g. "Re: hello"?
+  subject_reply integer not null default 0,
+  -- Lowercase mailbox (local part) of the first address.
+  from_addr text not null default '',
+  to_addr text not null default '',
+  cc_addr text not null default '',
+
+  message_id text not null default '',
+  -- Space separated message IDs from References,
+  -- or In-Reply-To if there are no References.
+  refs text not null default ''
+);
+
+create index if not exists message_sort_sent_index on message_sort (sent);
+create index if not exists message_sort_arrival_index on message_sort (arrival);
+create index if not exists message_sort_subject_index on message_sort (subject);
+create index if not exists message_sort_from_index on message_sort (from_addr);
+create index if not exists message_sort_to_index on message_sort (to_addr);
+create index if not exists message_sort_cc_index on message_sort (cc_addr);
+create index if not exists message_sort_message_id_index on message_sort (message_id);
+create index if not exists message_size_index on message (size);
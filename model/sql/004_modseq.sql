@@ -0,0 +1,31 @@
+-- Mod-sequences (RFC 7162 CONDSTORE and QRESYNC). The values are kept up
+-- to date by the modseq triggers in 002_triggers.sql.
+
+-- The highest mod-sequence of each mailbox. Every change to the messages
+-- of a mailbox increments it. A mailbox with no row has never changed,
+-- and its highest mod-sequence is 1.
+create table if not exists mailbox_modseq (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  highest integer not null default 1
+);
+
+-- The mod-sequence of the last change to each message. A message with
+-- no row hasn't changed since it was stored, and its mod-sequence is 1.
+create table if not exists message_modseq (
+  message_row_id integer not null primary key references message(row_id) on delete cascade on update cascade,
+  modseq integer not null
+);
+
+create index if not exists message_modseq_index on message_modseq (modseq);
+
+-- Tombstones of expunged messages, which QRESYNC uses to tell clients
+-- which messages were expunged since they last synchronized.
+create table if not exists expunged (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  uid integer not null,
+  modseq integer not null,
+
+  primary key (mailbox_id, uid)
+);
+
+create index if not exists expunged_modseq_index on expunged (mailbox_id, modseq);
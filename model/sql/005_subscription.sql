@@ -0,0 +1,7 @@
+-- Mailbox subscriptions (SUBSCRIBE, UNSUBSCRIBE and LSUB). The names aren't
+-- references to the mailbox table: a subscription is kept when its mailbox
+-- is deleted or renamed, and may be made to a mailbox which doesn't exist,
+-- as RFC 3501 allows.
+create table if not exists subscription (
+  name text not null collate nocase primary key
+);
@@ -0,0 +1,26 @@
+-- The keywords (flags without a backslash, e.g. "$Junk") which have been
+-- used in each mailbox. SELECT sends them in the FLAGS and PERMANENTFLAGS
+-- responses. A keyword stays in the set after the last message with it is
+-- expunged, because clients may still be showing it.
+create table if not exists keyword (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  value text not null collate nocase,
+
+  primary key (mailbox_id, value)
+);
+
+create trigger if not exists keyword_flag_insert after insert on flag
+for each row
+when substr(new.value, 1, 1) != '\'
+begin
+  insert or ignore into keyword (mailbox_id, value)
+  select mailbox_id, new.value from message where row_id = new.message_row_id;
+end;
+
+-- Add the keywords of messages which were stored before the keyword table.
+insert or ignore into keyword (mailbox_id, value)
+select message.mailbox_id, flag.value
+from flag
+join message on flag.message_row_id = message.row_id
+where substr(flag.value, 1, 1) != '\'
+and not exists (select 1 from keyword);
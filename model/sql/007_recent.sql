@@ -0,0 +1,13 @@
+-- \Recent is specific to a session (RFC 3501 section 2.3.2): a message is
+-- recent only in the first session which selects its mailbox after the
+-- message arrived. Each mailbox stores the lowest UID which no session has
+-- claimed yet, so messages with a UID below it aren't recent anymore.
+-- A mailbox with no row has never been selected, so all of its messages
+-- are recent.
+create table if not exists mailbox_recent (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  first_unclaimed integer not null
+);
+
+-- \Recent used to be stored as a flag.
+delete from flag where value = '\recent';
@@ -0,0 +1,8 @@
+-- Special-use attributes of mailboxes (RFC 6154), e.g. "\Sent".
+-- A mailbox may have more than one.
+create table if not exists mailbox_special_use (
+  mailbox_id integer not null references mailbox(id) on delete cascade on update cascade,
+  use text not null collate nocase,
+
+  primary key (mailbox_id, use)
+);
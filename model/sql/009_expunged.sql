@@ -0,0 +1,30 @@
+-- Expunging a message increments the highest mod-sequence of its mailbox,
+-- and leaves a tombstone for QRESYNC (see 004_modseq.sql). DeleteMailbox
+-- removes the tombstones along with the mailbox, and when the messages of
+-- a deleted mailbox are removed by the foreign key cascade instead, after
+-- the mailbox row is gone, there's nothing left to resynchronize, so no
+-- tombstones are written.
+--
+-- The trigger used to be in 002_triggers.sql, without the "when" clause,
+-- so it's replaced in existing databases.
+drop trigger if exists modseq_message_delete;
+
+create trigger modseq_message_delete after delete on message
+for each row
+when exists (select 1 from mailbox where id = old.mailbox_id)
+begin
+  insert or ignore into mailbox_modseq(mailbox_id) values (old.mailbox_id);
+  update mailbox_modseq set highest = highest + 1 where mailbox_id = old.mailbox_id;
+  delete from message_modseq where message_row_id = old.row_id;
+  insert or replace into expunged(mailbox_id, uid, modseq)
+    select old.mailbox_id, old.id, highest from mailbox_modseq where mailbox_id = old.mailbox_id;
+end;
+
+-- Old tombstones are pruned (see pruneExpunged). Each mailbox stores the
+-- highest mod-sequence of the tombstones pruned from it: a client which
+-- last synchronized before that can't be told exactly which messages
+-- were expunged. A mailbox with no row has never been pruned.
+create table if not exists expunged_pruned (
+  mailbox_id integer not null primary key references mailbox(id) on delete cascade on update cascade,
+  modseq integer not null
+);
@@ -0,0 +1,55 @@
+package model
+
+import (
+  "fmt"
+)
+
+// Subscribe adds the mailbox name to the subscriptions.
+// The mailbox doesn't need to exist.
+func (db *DB) Subscribe(name string) error {
+  _, err := db.db.Exec("insert or ignore into subscription(name) values (?)", name)
+  if err != nil {
+    return fmt.Errorf("database error: subscribing: %v", err)
+  }
+  return nil
+}
+
+// Unsubscribe removes the mailbox name from the subscriptions.
+func (db *DB) Unsubscribe(name string) error {
+  res, err := db.db.Exec("delete from subscription where name = ?", name)
+  if err != nil {
+    return fmt.Errorf("database error: unsubscribing: %v", err)
+  }
+  n, err := res.RowsAffected()
+  if err != nil {
+    return fmt.Errorf("database error: unsubscribing: %v", err)
+  }
+  if n == 0 {
+    return fmt.Errorf("not subscribed to %q", name)
+  }
+  return nil
+}
+
+// Subscriptions returns the subscribed mailbox names, sorted by name.
+func (db *DB) Subscriptions() ([]string, error) {
+  rows, err := db.db.Query("select name from subscription order by name")
+  if err != nil {
+    return nil, fmt.Errorf("database error: loading subscriptions: %v", err)
+  }
+  defer rows.Close()
+
+  var names []string
+  for rows.Next() {
+    var name string
+    err := rows.Scan(&name)
+    if err != nil {
+      return nil, fmt.Errorf("database error: loading subscriptions: %v", err)
+    }
+    names = append(names, name)
+  }
+
+  if err := rows.Err(); err != nil {
+    return nil, fmt.Errorf("database error: loading subscriptions: %v", err)
+  }
+  return names, nil
+}
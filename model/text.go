@@ -0,0 +1,149 @@
+package model
+
+import (
+  "encoding/base64"
+  "fmt"
+  "html"
+  "io"
+  "io/ioutil"
+  "mime"
+  "mime/quotedprintable"
+  "net/mail"
+  "net/textproto"
+  "os"
+  "regexp"
+  "strings"
+  "github.com/buchanae/mailer/multipart"
+)
+
+// messageText reads the message body file at "path" and returns the
+// searchable text of the message: the header (with encoded words decoded)
+// and the decoded text of the message's text/* parts, including the parts
+// of encapsulated (message/rfc822) messages.
+func messageText(path string) (header, body string, err error) {
+  fh, err := os.Open(path)
+  if err != nil {
+    return "", "", fmt.Errorf("opening message body: %v", err)
+  }
+  defer fh.Close()
+
+  msg, err := mail.ReadMessage(fh)
+  if err != nil {
+    return "", "", fmt.Errorf("reading message: %v", err)
+  }
+
+  b := &strings.Builder{}
+  err = entityText(b, textproto.MIMEHeader(msg.Header), msg.Body)
+  if err != nil {
+    return "", "", err
+  }
+  return headerText(msg.Header), b.String(), nil
+}
+
+func headerText(h mail.Header) string {
+  dec := &mime.WordDecoder{}
+  b := &strings.Builder{}
+  for key, values := range h {
+    for _, v := range values {
+      if d, err := dec.DecodeHeader(v); err == nil {
+        v = d
+      }
+      fmt.Fprintf(b, "%s: %s\n", key, v)
+    }
+  }
+  return b.String()
+}
+
+// entityText writes the decoded text of an entity (a message or body part)
+// to "w", recursing into multipart and message/rfc822 entities.
+// Non-text parts (e.g. images) are skipped.
+func entityText(w io.Writer, h textproto.MIMEHeader, body io.Reader) error {
+  mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+  if err != nil {
+    mt = "text/plain"
+  }
+
+  switch {
+  case strings.HasPrefix(mt, "multipart/"):
+    mr := multipart.NewReader(DecodeBody(h, body), params["boundary"])
+    for {
+      p, err := mr.NextPart()
+      if err == io.EOF {
+        return nil
+      }
+      if err != nil {
+        return fmt.Errorf("reading part: %v", err)
+      }
+      err = entityText(w, p.Header, p)
+      if err != nil {
+        return err
+      }
+    }
+
+  case mt == "message/rfc822":
+    inner, err := mail.ReadMessage(DecodeBody(h, body))
+    if err != nil {
+      return fmt.Errorf("reading encapsulated message: %v", err)
+    }
+    io.WriteString(w, headerText(inner.Header))
+    return entityText(w, textproto.MIMEHeader(inner.Header), inner.Body)
+
+  case mt == "text/html":
+    b, err := ioutil.ReadAll(DecodeBody(h, body))
+    if err != nil {
+      return fmt.Errorf("reading part: %v", err)
+    }
+    io.WriteString(w, stripHTML(string(b)))
+    io.WriteString(w, "\n")
+
+  case strings.HasPrefix(mt, "text/"):
+    _, err := io.Copy(w, DecodeBody(h, body))
+    if err != nil {
+      return fmt.Errorf("reading part: %v", err)
+    }
+    io.WriteString(w, "\n")
+  }
+  return nil
+}
+
+var (
+  htmlHidden = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>|<!--.*?-->`)
+  htmlTag = regexp.MustCompile(`(?s)<[^>]*>`)
+  htmlSpace = regexp.MustCompile(`\s+`)
+)
+
+// stripHTML converts HTML to plain text by removing tags, comments and
+// elements which aren't displayed (e.g. scripts), and decoding entities.
+func stripHTML(s string) string {
+  s = htmlHidden.ReplaceAllString(s, " ")
+  s = htmlTag.ReplaceAllString(s, " ")
+  s = html.UnescapeString(s)
+  return strings.TrimSpace(htmlSpace.ReplaceAllString(s, " "))
+}
+
+// DecodeBody decodes the Content-Transfer-Encoding of a body. It's shared
+// with the BODYSTRUCTURE and body section code, which decode enclosing
+// entities the same way the text index does.
+func DecodeBody(h textproto.MIMEHeader, body io.Reader) io.Reader {
+  switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+  case "base64":
+    return base64.NewDecoder(base64.StdEncoding, body)
+  case "quoted-printable":
+    return quotedprintable.NewReader(body)
+  }
+  return body
+}
+
+// textContains returns true if the message text contains "s",
+// ignoring case. If "includeHeader" is true, the header is searched too
+// (the TEXT search key), otherwise only the body is (the BODY key).
+func textContains(path, s string, includeHeader bool) (bool, error) {
+  header, body, err := messageText(path)
+  if err != nil {
+    return false, err
+  }
+  if includeHeader && containsFold(header, s) {
+    return true, nil
+  }
+  return containsFold(body, s), nil
+}
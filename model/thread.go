@@ -0,0 +1,341 @@
+package model
+
+import (
+  "database/sql"
+  "fmt"
+  "sort"
+  "strings"
+  "github.com/buchanae/mailer/imap"
+)
+
+// threadMsg holds the sort keys of a message needed for threading.
+type threadMsg struct {
+  uid int64
+  sent int64
+  subject string
+  reply bool
+  messageID string
+  refs []string
+}
+
+// container is a node in a thread tree. A container with no message is
+// a "dummy", e.g. a message which was referenced but isn't in the results.
+type container struct {
+  msg *threadMsg
+  parent *container
+  children []*container
+}
+
+// Thread returns the messages in the mailbox which match the search keys,
+// as threads built by the given algorithm, "orderedsubject" or "references"
+// (RFC 5256). The IDs of the threads are UIDs.
+func (db *DB) Thread(mailbox, algorithm string, keys []imap.SearchKey) ([]*imap.Thread, error) {
+  cols := `msg.id,
+    coalesce(s.sent, 0),
+    coalesce(s.subject, ''),
+    coalesce(s.subject_reply, 0),
+    coalesce(s.message_id, ''),
+    coalesce(s.refs, '')`
+
+  var msgs []*threadMsg
+  err := db.query(mailbox, keys, cols, "msg.id", func(rows *sql.Rows) error {
+    m := &threadMsg{}
+    var refs string
+    err := rows.Scan(&m.uid, &m.sent, &m.subject, &m.reply, &m.messageID, &refs)
+    m.refs = strings.Fields(refs)
+    msgs = append(msgs, m)
+    return err
+  })
+  if err != nil {
+    return nil, err
+  }
+
+  var roots []*container
+  switch algorithm {
+  case "orderedsubject":
+    roots = threadOrderedSubject(msgs)
+  case "references":
+    roots = threadReferences(msgs)
+  default:
+    return nil, fmt.Errorf("unknown thread algorithm %q", algorithm)
+  }
+
+  var threads []*imap.Thread
+  for _, c := range roots {
+    threads = append(threads, c.thread())
+  }
+  return threads, nil
+}
+
+// threadOrderedSubject groups messages by base subject. The first message
+// (by sent date) of each group is the parent of the others, which are
+// siblings. Threads are ordered by the sent date of their first message.
+func threadOrderedSubject(msgs []*threadMsg) []*container {
+  sort.SliceStable(msgs, func(i, j int) bool {
+    a, b := msgs[i], msgs[j]
+    if a.subject != b.subject {
+      return a.subject < b.subject
+    }
+    return before(a, b)
+  })
+
+  var roots []*container
+  var root *container
+  for _, m := range msgs {
+    c := &container{msg: m}
+    if root != nil && root.msg.subject == m.subject {
+      root.add(c)
+      continue
+    }
+    root = c
+    roots = append(roots, root)
+  }
+
+  sortContainers(roots)
+  return roots
+}
+
+// threadReferences threads messages by their References and In-Reply-To
+// headers, then merges threads with the same base subject, as described
+// by the REFERENCES algorithm in RFC 5256.
+func threadReferences(msgs []*threadMsg) []*container {
+  // (1) Link messages to their parents by message ID.
+  // "all" keeps the containers in a stable order.
+  ids := map[string]*container{}
+  var all []*container
+  get := func(id string) *container {
+    c, ok := ids[id]
+    if !ok {
+      c = &container{}
+      ids[id] = c
+      all = append(all, c)
+    }
+    return c
+  }
+
+  for _, m := range msgs {
+    // A message with no (or a duplicate) message ID is given a unique one.
+    id := m.messageID
+    if id == "" || (ids[id] != nil && ids[id].msg != nil) {
+      id = fmt.Sprintf("<uid.%d@mailer>", m.uid)
+    }
+    c := get(id)
+    c.msg = m
+
+    // (A) Link the references together, in order, unless they're already
+    // linked or the link would create a loop.
+    var prev *container
+    for _, ref := range m.refs {
+      r := get(ref)
+      if prev != nil && r.parent == nil && r != prev && !r.isAncestorOf(prev) {
+        prev.add(r)
+      }
+      prev = r
+    }
+
+    // (B) The last reference is the message's parent.
+    if c.parent != nil {
+      c.parent.remove(c)
+    }
+    if prev != nil && prev != c && !c.isAncestorOf(prev) {
+      prev.add(c)
+    }
+  }
+
+  // (2) The roots are the containers without parents.
+  var roots []*container
+  for _, c := range all {
+    if c.parent == nil {
+      roots = append(roots, c)
+    }
+  }
+
+  // (4) Prune dummies.
+  roots = prune(roots, true)
+
+  // (5) Sort the roots, then merge threads with the same base subject.
+  sortContainers(roots)
+  roots = mergeSubjects(roots)
+
+  // (6) Sort the siblings, now that threads have been merged.
+  sortContainers(roots)
+  return roots
+}
+
+// prune removes dummies with no children, and replaces dummies with their
+// children, except at the root level, where a dummy is only replaced if it
+// has one child, since otherwise its children would become separate threads.
+func prune(list []*container, isRoot bool) []*container {
+  var out []*container
+  for _, c := range list {
+    c.children = prune(c.children, false)
+    for _, child := range c.children {
+      child.parent = c
+    }
+
+    if c.msg != nil {
+      out = append(out, c)
+      continue
+    }
+    if len(c.children) == 0 {
+      continue
+    }
+    if !isRoot || len(c.children) == 1 {
+      for _, child := range c.children {
+        child.parent = c.parent
+      }
+      out = append(out, c.children...)
+      continue
+    }
+    out = append(out, c)
+  }
+  return out
+}
+
+// mergeSubjects merges root threads which have the same base subject
+// (RFC 5256, REFERENCES step 5).
+func mergeSubjects(roots []*container) []*container {
+  table := map[string]*container{}
+  for _, c := range roots {
+    subj := c.subject()
+    if subj == "" {
+      continue
+    }
+    old, ok := table[subj]
+    if !ok {
+      table[subj] = c
+      continue
+    }
+    if old.msg != nil && (c.msg == nil || (old.reply() && !c.reply())) {
+      table[subj] = c
+    }
+  }
+
+  var out []*container
+  for _, c := range roots {
+    subj := c.subject()
+    t := table[subj]
+    if subj == "" || t == c {
+      out = append(out, c)
+      continue
+    }
+
+    switch {
+    case t.msg == nil && c.msg == nil:
+      // Copy the list, since add() removes the child from "c".
+      children := append([]*container(nil), c.children...)
+      for _, child := range children {
+        t.add(child)
+      }
+    case t.msg == nil:
+      t.add(c)
+    case c.reply() && !t.reply():
+      t.add(c)
+    default:
+      // Replace the table's message with a new dummy parent of both.
+      d := &container{}
+      replaced := false
+      for i, x := range out {
+        if x == t {
+          out[i] = d
+          replaced = true
+        }
+      }
+      // If the table's message comes later in the roots,
+      // it's merged into the dummy when it's reached.
+      if !replaced {
+        out = append(out, d)
+      }
+      d.add(t)
+      d.add(c)
+      table[subj] = d
+    }
+  }
+  return out
+}
+
+// sortContainers sorts a list of siblings, and their descendants,
+// by sent date. A dummy is sorted by the date of its first child.
+func sortContainers(list []*container) {
+  for _, c := range list {
+    sortContainers(c.children)
+  }
+  sort.SliceStable(list, func(i, j int) bool {
+    return before(list[i].first(), list[j].first())
+  })
+}
+
+// before orders messages by sent date, then by UID.
+func before(a, b *threadMsg) bool {
+  if a == nil || b == nil {
+    return b != nil
+  }
+  if a.sent != b.sent {
+    return a.sent < b.sent
+  }
+  return a.uid < b.uid
+}
+
+func (c *container) add(child *container) {
+  if child.parent != nil {
+    child.parent.remove(child)
+  }
+  child.parent = c
+  c.children = append(c.children, child)
+}
+
+func (c *container) remove(child *container) {
+  for i, x := range c.children {
+    if x == child {
+      c.children = append(c.children[:i], c.children[i+1:]...)
+      break
+    }
+  }
+  child.parent = nil
+}
+
+// isAncestorOf returns true if "c" is "x" or one of its ancestors.
+func (c *container) isAncestorOf(x *container) bool {
+  for ; x != nil; x = x.parent {
+    if x == c {
+      return true
+    }
+  }
+  return false
+}
+
+// first returns the message of the container,
+// or the first message of its children, if it's a dummy.
+func (c *container) first() *threadMsg {
+  if c.msg != nil {
+    return c.msg
+  }
+  for _, child := range c.children {
+    if m := child.first(); m != nil {
+      return m
+    }
+  }
+  return nil
+}
+
+func (c *container) subject() string {
+  if m := c.first(); m != nil {
+    return m.subject
+  }
+  return ""
+}
+
+func (c *container) reply() bool {
+  return c.msg != nil && c.msg.reply
+}
+
+func (c *container) thread() *imap.Thread {
+  t := &imap.Thread{}
+  if c.msg != nil {
+    t.ID = c.msg.uid
+  }
+  for _, child := range c.children {
+    t.Children = append(t.Children, child.thread())
+  }
+  return t
+}
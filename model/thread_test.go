@@ -0,0 +1,65 @@
+package model
+
+import (
+  "bytes"
+  "strings"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestThread(t *testing.T) {
+  db, cleanup := testDB(t)
+  defer cleanup()
+
+  msgs := []string{
+    "Message-Id: <1@example.com>\r\nDate: Mon, 02 Jan 2006 10:00:00 +0000\r\nSubject: hello\r\n\r\n",
+    "Message-Id: <2@example.com>\r\nDate: Tue, 03 Jan 2006 10:00:00 +0000\r\nSubject: Re: hello\r\n" +
+      "References: <1@example.com>\r\n\r\n",
+    "Message-Id: <3@example.com>\r\nDate: Sun, 01 Jan 2006 10:00:00 +0000\r\nSubject: other\r\n\r\n",
+    "Message-Id: <4@example.com>\r\nDate: Thu, 05 Jan 2006 10:00:00 +0000\r\nSubject: Re: hello\r\n" +
+      "In-Reply-To: <2@example.com>\r\n\r\n",
+    // The parent of 5 isn't in the mailbox.
+    "Message-Id: <5@example.com>\r\nDate: Wed, 04 Jan 2006 10:00:00 +0000\r\nSubject: Re: hello\r\n" +
+      "References: <missing@example.com>\r\n\r\n",
+    "Message-Id: <6@example.com>\r\nDate: Fri, 06 Jan 2006 10:00:00 +0000\r\nSubject: Re: other\r\n" +
+      "References: <3@example.com>\r\n\r\n",
+  }
+  for _, m := range msgs {
+    _, err := db.CreateMessage("INBOX", strings.NewReader(m), nil)
+    if err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  all := []imap.SearchKey{&imap.StatusKey{Name: "all"}}
+  tests := []struct {
+    algorithm string
+    keys []imap.SearchKey
+    expect string
+  }{
+    {"orderedsubject", all, "* THREAD (3 6)(1 (2)(5)(4))\r\n"},
+    {"references", all, "* THREAD (3 6)(1 (2 4)(5))\r\n"},
+    // Without 2, 4 is a child of 1 through the subject only.
+    {"references", []imap.SearchKey{&imap.NotKey{Arg: &imap.UIDKey{Seqs: []imap.Sequence{{Start: 2}}}}},
+      "* THREAD (3 6)(1 (5)(4))\r\n"},
+    {"orderedsubject", []imap.SearchKey{&imap.FieldKey{Name: "subject", Arg: "other"}}, "* THREAD (3 6)\r\n"},
+  }
+
+  for _, test := range tests {
+    threads, err := db.Thread("INBOX", test.algorithm, test.keys)
+    if err != nil {
+      t.Errorf("threading by %s: %v", test.algorithm, err)
+      continue
+    }
+    buf := &bytes.Buffer{}
+    imap.ThreadResponse(buf, threads)
+    if buf.String() != test.expect {
+      t.Errorf("threading by %s %v: expected %q, got %q", test.algorithm, test.keys, test.expect, buf.String())
+    }
+  }
+
+  _, err := db.Thread("INBOX", "unknown", all)
+  if err == nil {
+    t.Error("expected an error for an unknown algorithm")
+  }
+}
@@ -0,0 +1,129 @@
+package mailer
+
+import (
+  "fmt"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func init() {
+  registerCapability("CONDSTORE", "QRESYNC")
+  registerEnable("CONDSTORE", nil)
+  // QRESYNC implies CONDSTORE.
+  registerEnable("QRESYNC", func(f *fake) {
+    f.enable("CONDSTORE")
+  })
+}
+
+// resync builds the responses to the QRESYNC parameter of SELECT and
+// EXAMINE (RFC 7162): the UIDs the client knows about which were expunged
+// since its mod-sequence, and the flags of the messages changed since then.
+// If the UIDVALIDITY doesn't match, the client has to resynchronize
+// from scratch, so there's nothing to send.
+func (f *fake) resync(box *model.Mailbox, seqs *seqMap, p *imap.QResyncParam) (imap.Resync, error) {
+  var r imap.Resync
+  if p == nil || p.UIDValidity != box.ID {
+    return r, nil
+  }
+
+  vanished, err := f.db.Vanished(box.Name, p.ModSeq)
+  if err != nil {
+    return r, err
+  }
+  max := int64(box.NextMessageID - 1)
+  for _, uid := range vanished {
+    if p.KnownUIDs == nil || inSet(p.KnownUIDs, uid, max) {
+      r.Vanished = append(r.Vanished, uid)
+    }
+  }
+
+  keys := []imap.SearchKey{&imap.ModSeqKey{ModSeq: p.ModSeq + 1}}
+  if p.KnownUIDs != nil {
+    keys = append(keys, &imap.UIDKey{Seqs: p.KnownUIDs})
+  }
+  changed, _, err := f.db.Search(box.Name, &imap.SearchCommand{Keys: keys})
+  if err != nil {
+    return r, err
+  }
+
+  for _, uid := range changed {
+    seq, ok := seqs.Seq(uid)
+    if !ok {
+      continue
+    }
+    msg, err := f.db.MessageByUID(box.Name, uid)
+    if err != nil {
+      return r, fmt.Errorf("database error: retrieving message: %v", err)
+    }
+    res := &imap.FetchResult{ID: seq}
+    res.AddString("uid", fmt.Sprint(msg.ID))
+    res.AddString("flags", f.flags(msg))
+    res.AddString("modseq", modSeqValue(msg))
+    r.Changed = append(r.Changed, res)
+  }
+  return r, nil
+}
+
+// vanishedSince sends the "* VANISHED (EARLIER)" response for the UIDs
+// in the set which were expunged since the given mod-sequence, for the
+// VANISHED modifier of UID FETCH (RFC 7162).
+func (f *fake) vanishedSince(set []imap.Sequence, modseq int64) error {
+  box, err := f.db.MailboxByName(f.mailbox)
+  if err != nil {
+    return err
+  }
+
+  vanished, err := f.db.Vanished(f.mailbox, modseq)
+  if err != nil {
+    return err
+  }
+
+  var uids []int64
+  max := int64(box.NextMessageID - 1)
+  for _, uid := range vanished {
+    if inSet(set, uid, max) {
+      uids = append(uids, uid)
+    }
+  }
+  if len(uids) > 0 {
+    imap.Vanished(f.w, uids, true)
+  }
+  return nil
+}
+
+// modSeqValue formats the MODSEQ fetch item, e.g. "(12)".
+func modSeqValue(msg *model.Message) string {
+  return fmt.Sprintf("(%d)", msg.ModSeq)
+}
+
+func hasFetchAttr(cmd *imap.FetchCommand, name string) bool {
+  for _, attr := range cmd.Attrs {
+    if attr.Name == name {
+      return true
+    }
+  }
+  return false
+}
+
+// hasModSeqKey returns true if the search keys include the MODSEQ key.
+func hasModSeqKey(keys []imap.SearchKey) bool {
+  for _, k := range keys {
+    switch z := k.(type) {
+    case *imap.ModSeqKey:
+      return true
+    case *imap.GroupKey:
+      if hasModSeqKey(z.Keys) {
+        return true
+      }
+    case *imap.OrKey:
+      if hasModSeqKey([]imap.SearchKey{z.Arg1, z.Arg2}) {
+        return true
+      }
+    case *imap.NotKey:
+      if hasModSeqKey([]imap.SearchKey{z.Arg}) {
+        return true
+      }
+    }
+  }
+  return false
+}
@@ -0,0 +1,30 @@
+package mailer
+
+import (
+  "strings"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+func init() {
+  registerCapability("NAMESPACE")
+}
+
+// Namespace implements NAMESPACE (RFC 2342). Mailboxes are in the personal
+// namespace, which has no prefix, except those under the shared namespace
+// prefix, if one is configured. There are no other users.
+func (f *fake) Namespace(cmd *imap.NamespaceCommand) {
+  personal := []imap.Namespace{{Prefix: "", Delimiter: model.Delimiter}}
+
+  var shared []imap.Namespace
+  if f.sharedNamespace != "" {
+    prefix := f.sharedNamespace
+    if !strings.HasSuffix(prefix, model.Delimiter) {
+      prefix += model.Delimiter
+    }
+    shared = append(shared, imap.Namespace{Prefix: prefix, Delimiter: model.Delimiter})
+  }
+
+  imap.Namespaces(f.w, personal, nil, shared)
+  imap.Complete(f.w, cmd.Tag, "NAMESPACE")
+}
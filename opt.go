@@ -10,8 +10,67 @@ type SMTPOpt struct {
   Timeout time.Duration
 }
 
+// IMAPOpt describes the IMAP listeners. All listeners share
+// the same database and connection logging.
 type IMAPOpt struct {
+  // Addresses to listen on, e.g. a plaintext listener which offers
+  // STARTTLS on port 143, and an implicit TLS listener on port 993.
+  Listeners []IMAPListenerOpt
+  // Server identity sent in response to the ID command (RFC 2971).
+  ID IDOpt
+  // Prefix of the shared mailboxes, e.g. "Shared", which the NAMESPACE
+  // command reports (RFC 2342). If empty, there's no shared namespace.
+  SharedNamespace string
+}
+
+// IDOpt describes the server identity. Empty fields aren't sent.
+type IDOpt struct {
+  Name, Version, Vendor, SupportURL string
+}
+
+// params returns the ID fields, keyed by the names from RFC 2971.
+func (i IDOpt) params() map[string]string {
+  params := map[string]string{}
+  for k, v := range map[string]string{
+    "name": i.Name,
+    "version": i.Version,
+    "vendor": i.Vendor,
+    "support-url": i.SupportURL,
+  } {
+    if v != "" {
+      params[k] = v
+    }
+  }
+  return params
+}
+
+// enabledListeners returns the enabled listeners, i.e. those with an address.
+func (i IMAPOpt) enabledListeners() []IMAPListenerOpt {
+  var ls []IMAPListenerOpt
+  for _, l := range i.Listeners {
+    if l.Addr != "" {
+      ls = append(ls, l)
+    }
+  }
+  return ls
+}
+
+type IMAPListenerOpt struct {
+  // Address to listen on. If empty, the listener is disabled.
   Addr string
+  // Start TLS as soon as a client connects, as "imaps" does on port 993.
+  ImplicitTLS bool
+  // Enable the STARTTLS command, which upgrades a plaintext
+  // connection to TLS using the TLS certificate and key.
+  StartTLS bool
+  // Allow LOGIN on connections which are not using TLS.
+  // Otherwise, clients must use STARTTLS before logging in.
+  AllowPlaintextAuth bool
+}
+
+// usesTLS returns true if the listener needs the TLS certificate and key.
+func (l IMAPListenerOpt) usesTLS() bool {
+  return l.ImplicitTLS || l.StartTLS
 }
 
 type DBOpt struct {
@@ -68,7 +127,19 @@ func DefaultServerOpt() ServerOpt {
       Timeout: 5 * time.Minute,
     },
     IMAP: IMAPOpt{
-      Addr: "localhost:993",
+      Listeners: []IMAPListenerOpt{
+        {
+          Addr: "localhost:143",
+          StartTLS: true,
+        },
+        {
+          Addr: "localhost:993",
+          ImplicitTLS: true,
+        },
+      },
+      ID: IDOpt{
+        Name: "mailer",
+      },
     },
     TLS: TLSOpt{
       Cert: "certificate.pem",
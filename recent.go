@@ -0,0 +1,78 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+// updateRecent claims the new messages in the selected mailbox as recent,
+// unless another session already did, and sends the new RECENT count.
+// A mailbox opened by EXAMINE doesn't claim messages, so they're
+// still recent for the next session which selects the mailbox.
+func (f *fake) updateRecent() error {
+  claim := f.db.ClaimRecent
+  if f.readOnly {
+    claim = f.db.PeekRecent
+  }
+  box, err := f.db.MailboxByName(f.mailbox)
+  if err != nil {
+    return err
+  }
+  last := f.seqs.Last()
+  first, err := claim(box.ID, last)
+  if err != nil {
+    return err
+  }
+
+  f.addRecent(first, last)
+  imap.Line(f.w, "* %d RECENT", f.recentCount())
+  return nil
+}
+
+// addRecent records that the messages with UIDs from "first" to "last"
+// are recent in this session, as returned by ClaimRecent. The range
+// is merged with the previous one if they overlap, which they do when
+// a mailbox opened by EXAMINE peeks at the same messages again.
+func (f *fake) addRecent(first, last int64) {
+  if first > last {
+    return
+  }
+  if n := len(f.recent); n > 0 && first <= int64(f.recent[n-1].End) + 1 {
+    r := &f.recent[n-1]
+    if int64(r.Start) < first {
+      first = int64(r.Start)
+    }
+    if int64(r.End) > last {
+      last = int64(r.End)
+    }
+    f.recent = f.recent[:n-1]
+  }
+  f.recent = append(f.recent, imap.Sequence{Start: int(first), End: int(last), IsRange: true})
+}
+
+// isRecent returns true if the message is recent in this session.
+func (f *fake) isRecent(uid int64) bool {
+  return inSet(f.recent, uid, 0)
+}
+
+// recentCount returns the number of messages in the selected mailbox
+// which are recent in this session.
+func (f *fake) recentCount() int {
+  return len(f.seqs.UIDSeqs(f.recent))
+}
+
+// recentKey converts the RECENT, NEW and OLD search keys to keys which
+// match the UID ranges of the messages which are recent in this session.
+// Other status keys are returned unchanged.
+func (f *fake) recentKey(key *imap.StatusKey) imap.SearchKey {
+  recent := &imap.UIDKey{Seqs: f.recent}
+
+  switch key.Name {
+  case "recent":
+    return recent
+  case "new":
+    return &imap.GroupKey{Keys: []imap.SearchKey{recent, &imap.StatusKey{Name: "unseen"}}}
+  case "old":
+    return &imap.NotKey{Arg: recent}
+  }
+  return key
+}
@@ -0,0 +1,187 @@
+package mailer
+
+import (
+  "fmt"
+  "io"
+  "io/ioutil"
+  "net/mail"
+  "net/textproto"
+  "strings"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+  "github.com/buchanae/mailer/multipart"
+)
+
+// openPart opens the body section of a message part, e.g. BODY[1.2]
+// or BODY[2.MIME], returning a reader of the section's bytes and the
+// section's size in bytes. As RFC 3501 says, the section isn't decoded.
+// The body of a message/rfc822 or multipart entity should never be encoded
+// (RFC 2045 section 6.4), but some mail does it anyway, so it's decoded
+// to find the parts, the same way BODYSTRUCTURE and the search index do.
+//
+// The size must be known before the section is sent, so the message
+// is walked twice: once to count the section's bytes, and again to
+// stream them, so that large attachments aren't held in memory.
+func openPart(msg *model.Message, attr *imap.FetchAttr) (io.ReadCloser, int, error) {
+  size, err := partSize(msg, attr)
+  if err != nil {
+    return nil, 0, err
+  }
+
+  body, err := msg.Body()
+  if err != nil {
+    return nil, 0, fmt.Errorf("opening message body: %v", err)
+  }
+  r, err := partSection(body, attr)
+  if err != nil {
+    body.Close()
+    return nil, 0, err
+  }
+  // The literal must be exactly "size" bytes, so never send more.
+  return &partReader{Reader: io.LimitReader(r, int64(size)), Closer: body}, size, nil
+}
+
+// partSize returns the size in bytes of a body section of a message part.
+func partSize(msg *model.Message, attr *imap.FetchAttr) (int, error) {
+  body, err := msg.Body()
+  if err != nil {
+    return 0, fmt.Errorf("opening message body: %v", err)
+  }
+  defer body.Close()
+
+  r, err := partSection(body, attr)
+  if err != nil {
+    return 0, err
+  }
+  cr := &countReader{R: r}
+  _, err = io.Copy(ioutil.Discard, cr)
+  if err != nil {
+    return 0, fmt.Errorf("reading message part: %v", err)
+  }
+  return cr.N, nil
+}
+
+// partReader reads a body section, and closes the message body it's read from.
+type partReader struct {
+  io.Reader
+  io.Closer
+}
+
+// partSection finds the part in the message's MIME tree and returns
+// a reader for the requested section text of that part.
+func partSection(body io.Reader, attr *imap.FetchAttr) (io.Reader, error) {
+  msg, err := mail.ReadMessage(body)
+  if err != nil {
+    return nil, fmt.Errorf("reading message: %v", err)
+  }
+
+  h, r, err := findPart(textproto.MIMEHeader(msg.Header), msg.Body, attr.Part)
+  if err != nil {
+    return nil, err
+  }
+
+  switch attr.Section {
+  case "":
+    return r, nil
+
+  case "mime":
+    return strings.NewReader(formatHeader(h)), nil
+
+  case "header", "header.fields", "header.fields.not", "text":
+    // These refer to the header or text of a message/rfc822 part.
+    if mediaType(h) != "message/rfc822" {
+      return nil, fmt.Errorf("part %s is not a message/rfc822 part", partPath(attr.Part))
+    }
+
+    inner, err := mail.ReadMessage(model.DecodeBody(h, r))
+    if err != nil {
+      return nil, fmt.Errorf("reading encapsulated message: %v", err)
+    }
+
+    ih := model.Headers(inner.Header)
+    switch attr.Section {
+    case "header":
+      return strings.NewReader(formatHeader(textproto.MIMEHeader(ih))), nil
+    case "header.fields":
+      return strings.NewReader(formatHeader(textproto.MIMEHeader(ih.Include(attr.Headers)))), nil
+    case "header.fields.not":
+      return strings.NewReader(formatHeader(textproto.MIMEHeader(ih.Exclude(attr.Headers)))), nil
+    case "text":
+      return inner.Body, nil
+    }
+  }
+  return nil, fmt.Errorf("unknown section %q", attr.Section)
+}
+
+// findPart walks the MIME tree, following the part path (e.g. [1, 2]
+// for part "1.2"), and returns the MIME header and raw body of the part.
+// See RFC 3501 section 6.4.5 for the part numbering rules.
+func findPart(h textproto.MIMEHeader, body io.Reader, path []int) (textproto.MIMEHeader, io.Reader, error) {
+  for i, n := range path {
+    // The parts of a message/rfc822 part are the parts
+    // of the encapsulated message.
+    if i > 0 && mediaType(h) == "message/rfc822" {
+      inner, err := mail.ReadMessage(model.DecodeBody(h, body))
+      if err != nil {
+        return nil, nil, fmt.Errorf("reading encapsulated message: %v", err)
+      }
+      h = textproto.MIMEHeader(inner.Header)
+      body = inner.Body
+    }
+
+    var err error
+    h, body, err = subpart(h, body, n)
+    if err != nil {
+      return nil, nil, fmt.Errorf("finding part %s: %v", partPath(path[:i+1]), err)
+    }
+  }
+  return h, body, nil
+}
+
+// subpart returns part "n" of an entity. The parts of a multipart entity
+// are numbered from 1. A non-multipart entity has only one part, "1",
+// which is the entity's body.
+func subpart(h textproto.MIMEHeader, body io.Reader, n int) (textproto.MIMEHeader, io.Reader, error) {
+  typ, _, params := contentType(h, "text/plain")
+  if typ != "multipart" {
+    if n != 1 {
+      return nil, nil, fmt.Errorf("no such part")
+    }
+    return h, body, nil
+  }
+
+  mr := multipart.NewReader(model.DecodeBody(h, body), params["boundary"])
+  for i := 1; ; i++ {
+    p, err := mr.NextPart()
+    if err == io.EOF {
+      return nil, nil, fmt.Errorf("no such part")
+    }
+    if err != nil {
+      return nil, nil, fmt.Errorf("reading part: %v", err)
+    }
+    if i == n {
+      return p.Header, p, nil
+    }
+  }
+}
+
+// mediaType returns the lowercase media type of an entity,
+// e.g. "text/plain", which is the default when the header is missing.
+func mediaType(h textproto.MIMEHeader) string {
+  typ, subtype, _ := contentType(h, "text/plain")
+  return typ + "/" + subtype
+}
+
+// formatHeader formats a header, including the blank line
+// which separates the header from the body.
+func formatHeader(h textproto.MIMEHeader) string {
+  return model.Headers(h).Format() + "\r\n"
+}
+
+func partPath(path []int) string {
+  var s []string
+  for _, p := range path {
+    s = append(s, fmt.Sprint(p))
+  }
+  return strings.Join(s, ".")
+}
@@ -0,0 +1,77 @@
+package mailer
+
+import (
+  "bytes"
+  "io/ioutil"
+  "os"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+  "github.com/buchanae/mailer/model"
+)
+
+const sectionTestMessage = "Subject: test\r\n" +
+  "Content-Type: multipart/mixed; boundary=a\r\n\r\n" +
+  "--a\r\n" +
+  "Content-Type: multipart/alternative; boundary=b\r\n\r\n" +
+  "--b\r\n" +
+  "Content-Type: text/plain\r\n\r\n" +
+  "plain\r\n" +
+  "--b\r\n" +
+  "Content-Type: text/html\r\n" +
+  "Content-Transfer-Encoding: base64\r\n\r\n" +
+  "PHA+aHRtbDwvcD4=\r\n" +
+  "--b--\r\n" +
+  "--a\r\n" +
+  "Content-Type: message/rfc822\r\n" +
+  "Content-Transfer-Encoding: base64\r\n\r\n" +
+  // "Subject: inner\r\n\r\ninner body\r\n"
+  "U3ViamVjdDogaW5uZXINCg0KaW5uZXIgYm9keQ0K\r\n" +
+  "--a--\r\n"
+
+func TestOpenPart(t *testing.T) {
+  fh, err := ioutil.TempFile("", "mailer-section-test")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.Remove(fh.Name())
+  fh.WriteString(sectionTestMessage)
+  fh.Close()
+  msg := &model.Message{Path: fh.Name()}
+
+  tests := []struct {
+    attr *imap.FetchAttr
+    expected string
+  }{
+    {&imap.FetchAttr{Part: []int{1, 1}}, "* 1 FETCH (body[1.1] {5}\r\nplain)\r\n"},
+    // Sections aren't decoded.
+    {&imap.FetchAttr{Part: []int{1, 2}}, "* 1 FETCH (body[1.2] {16}\r\nPHA+aHRtbDwvcD4=)\r\n"},
+    {&imap.FetchAttr{Part: []int{1, 2}, Section: "mime"}, "* 1 FETCH (body[1.2.mime] {62}\r\nContent-Transfer-Encoding: base64\r\nContent-Type: text/html\r\n\r\n)\r\n"},
+    {&imap.FetchAttr{Part: []int{1}, Section: "mime"}, "* 1 FETCH (body[1.mime] {51}\r\nContent-Type: multipart/alternative; boundary=b\r\n\r\n)\r\n"},
+    {&imap.FetchAttr{Part: []int{1, 2}, Partial: &imap.Partial{Offset: 4, Limit: 5}}, "* 1 FETCH (body[1.2]<4> {5}\r\naHRtb)\r\n"},
+    {&imap.FetchAttr{Part: []int{1, 2}, Partial: &imap.Partial{Offset: 100, Limit: 5}}, "* 1 FETCH (body[1.2]<100> {0}\r\n)\r\n"},
+    // The encapsulated message is decoded to find its parts.
+    {&imap.FetchAttr{Part: []int{2}, Section: "header"}, "* 1 FETCH (body[2.header] {18}\r\nSubject: inner\r\n\r\n)\r\n"},
+    {&imap.FetchAttr{Part: []int{2}, Section: "text"}, "* 1 FETCH (body[2.text] {12}\r\ninner body\r\n)\r\n"},
+    {&imap.FetchAttr{Part: []int{2, 1}}, "* 1 FETCH (body[2.1] {12}\r\ninner body\r\n)\r\n"},
+  }
+
+  for _, test := range tests {
+    r, size, err := openPart(msg, test.attr)
+    if err != nil {
+      t.Errorf("%s: %v", test.attr.Key(), err)
+      continue
+    }
+    res := imap.FetchResult{ID: 1}
+    err = addSection(&res, test.attr, size, r)
+    r.Close()
+    if err != nil {
+      t.Errorf("%s: %v", test.attr.Key(), err)
+      continue
+    }
+    buf := &bytes.Buffer{}
+    res.Encode(buf)
+    if buf.String() != test.expected {
+      t.Errorf("%s: unexpected result\nexpected: %q\ngot:      %q", test.attr.Key(), test.expected, buf.String())
+    }
+  }
+}
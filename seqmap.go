@@ -0,0 +1,165 @@
+package mailer
+
+import (
+  "fmt"
+  "sort"
+  "github.com/buchanae/mailer/imap"
+)
+
+// seqMap maps message sequence numbers to UIDs for the mailbox selected
+// by a session. Sequence numbers are relative to what the session has been
+// told about: the map is built at SELECT, and only changes when the session
+// sends "* n EXISTS" or "* n EXPUNGE", so the client and server always agree
+// on which message a sequence number refers to.
+type seqMap struct {
+  // uids[i] is the UID of the message with sequence number i+1.
+  // UIDs are strictly ascending.
+  uids []int64
+}
+
+func newSeqMap(uids []int64) *seqMap {
+  return &seqMap{uids: uids}
+}
+
+// Len returns the number of messages in the map, i.e. the highest
+// sequence number.
+func (m *seqMap) Len() int {
+  return len(m.uids)
+}
+
+// Last returns the highest UID in the map, or zero if it's empty.
+func (m *seqMap) Last() int64 {
+  if len(m.uids) == 0 {
+    return 0
+  }
+  return m.uids[len(m.uids)-1]
+}
+
+// UID returns the UID of the message with the given sequence number.
+func (m *seqMap) UID(seq int) (int64, bool) {
+  if seq < 1 || seq > len(m.uids) {
+    return 0, false
+  }
+  return m.uids[seq-1], true
+}
+
+// Seq returns the sequence number of the message with the given UID.
+func (m *seqMap) Seq(uid int64) (int, bool) {
+  i := m.search(uid)
+  if i < len(m.uids) && m.uids[i] == uid {
+    return i + 1, true
+  }
+  return 0, false
+}
+
+// Add appends a message to the map, giving it the next sequence number.
+// The caller must send "* n EXISTS". Add returns false if the message
+// is already in the map. A UID lower than the highest one in the map is
+// an error, since inserting it would renumber the following messages
+// without the client knowing.
+func (m *seqMap) Add(uid int64) (bool, error) {
+  if _, ok := m.Seq(uid); ok {
+    return false, nil
+  }
+  if n := len(m.uids); n > 0 && uid < m.uids[n-1] {
+    return false, fmt.Errorf("UID %d is lower than the last UID %d", uid, m.uids[n-1])
+  }
+  m.uids = append(m.uids, uid)
+  return true, nil
+}
+
+// Remove removes a message from the map, returning the sequence number
+// the message had, which is the number to send in "* n EXPUNGE".
+// The sequence numbers of the following messages are decremented.
+func (m *seqMap) Remove(uid int64) (int, bool) {
+  seq, ok := m.Seq(uid)
+  if !ok {
+    return 0, false
+  }
+  m.uids = append(m.uids[:seq-1], m.uids[seq:]...)
+  return seq, true
+}
+
+// Seqs resolves a sequence set, e.g. "2,4:*", to message sequence numbers,
+// in ascending order without duplicates. "*" is the highest sequence number.
+// Numbers which don't refer to a message are ignored.
+func (m *seqMap) Seqs(set []imap.Sequence) []int {
+  max := int64(len(m.uids))
+  var seqs []int
+  for i := range m.uids {
+    seq := int64(i + 1)
+    if inSet(set, seq, max) {
+      seqs = append(seqs, int(seq))
+    }
+  }
+  return seqs
+}
+
+// UIDSeqs resolves a UID set, e.g. "100:*", to the message sequence numbers
+// of the matching messages, in ascending order. "*" is the highest UID
+// in the mailbox. UIDs which don't refer to a message are ignored.
+func (m *seqMap) UIDSeqs(set []imap.Sequence) []int {
+  if len(m.uids) == 0 {
+    return nil
+  }
+  max := m.uids[len(m.uids)-1]
+  var seqs []int
+  for i, uid := range m.uids {
+    if inSet(set, uid, max) {
+      seqs = append(seqs, i + 1)
+    }
+  }
+  return seqs
+}
+
+// UIDRanges returns the UIDs of the messages with the given sequence numbers,
+// which must be ascending, as a UID set. Consecutive sequence numbers become
+// one range, e.g. "1:5000" is one range, not 5000 UIDs.
+func (m *seqMap) UIDRanges(seqs []int) []imap.Sequence {
+  var set []imap.Sequence
+  for i := 0; i < len(seqs); {
+    j := i
+    for j + 1 < len(seqs) && seqs[j+1] == seqs[j] + 1 {
+      j++
+    }
+    start, _ := m.UID(seqs[i])
+    end, _ := m.UID(seqs[j])
+    if i == j {
+      set = append(set, imap.Sequence{Start: int(start)})
+    } else {
+      set = append(set, imap.Sequence{Start: int(start), End: int(end), IsRange: true})
+    }
+    i = j + 1
+  }
+  return set
+}
+
+func (m *seqMap) search(uid int64) int {
+  return sort.Search(len(m.uids), func(i int) bool {
+    return m.uids[i] >= uid
+  })
+}
+
+// inSet returns true if "n" is in the sequence set. "max" is the value
+// of "*", which the parser represents as 0. A range may be given in
+// either order, e.g. "4:2" is the same as "2:4".
+func inSet(set []imap.Sequence, n, max int64) bool {
+  for _, s := range set {
+    start, end := int64(s.Start), int64(s.End)
+    if start == 0 {
+      start = max
+    }
+    if !s.IsRange {
+      end = start
+    } else if end == 0 {
+      end = max
+    }
+    if start > end {
+      start, end = end, start
+    }
+    if n >= start && n <= end {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,185 @@
+package mailer
+
+import (
+  "reflect"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestSeqMapAdd(t *testing.T) {
+  tests := []struct {
+    uids []int64
+    add int64
+    added bool
+    err bool
+    expect []int64
+  }{
+    {nil, 5, true, false, []int64{5}},
+    {[]int64{1, 2}, 7, true, false, []int64{1, 2, 7}},
+    {[]int64{1, 2}, 2, false, false, []int64{1, 2}},
+    {[]int64{1, 2, 7}, 1, false, false, []int64{1, 2, 7}},
+    // Lower UIDs would renumber the following messages.
+    {[]int64{1, 2, 7}, 4, false, true, []int64{1, 2, 7}},
+  }
+
+  for _, test := range tests {
+    m := newSeqMap(append([]int64(nil), test.uids...))
+    added, err := m.Add(test.add)
+    if added != test.added || (err != nil) != test.err {
+      t.Errorf("Add(%d) to %v: got %v, %v", test.add, test.uids, added, err)
+    }
+    if !reflect.DeepEqual(m.uids, test.expect) {
+      t.Errorf("Add(%d) to %v: got %v, expected %v", test.add, test.uids, m.uids, test.expect)
+    }
+  }
+}
+
+func TestSeqMapRemove(t *testing.T) {
+  tests := []struct {
+    remove int64
+    seq int
+    ok bool
+    expect []int64
+  }{
+    {2, 1, true, []int64{5, 9}},
+    {5, 2, true, []int64{2, 9}},
+    {9, 3, true, []int64{2, 5}},
+    {4, 0, false, []int64{2, 5, 9}},
+  }
+
+  for _, test := range tests {
+    m := newSeqMap([]int64{2, 5, 9})
+    seq, ok := m.Remove(test.remove)
+    if seq != test.seq || ok != test.ok {
+      t.Errorf("Remove(%d): got %d, %v", test.remove, seq, ok)
+    }
+    if !reflect.DeepEqual(m.uids, test.expect) {
+      t.Errorf("Remove(%d): got %v, expected %v", test.remove, m.uids, test.expect)
+    }
+  }
+}
+
+func TestSeqMapSeqs(t *testing.T) {
+  // A zero start or end is "*".
+  tests := []struct {
+    desc string
+    set []imap.Sequence
+    expect []int
+  }{
+    {"2", []imap.Sequence{{Start: 2}}, []int{2}},
+    {"*", []imap.Sequence{{}}, []int{4}},
+    {"2:3", []imap.Sequence{{Start: 2, End: 3, IsRange: true}}, []int{2, 3}},
+    {"3:2", []imap.Sequence{{Start: 3, End: 2, IsRange: true}}, []int{2, 3}},
+    {"2:*", []imap.Sequence{{Start: 2, IsRange: true}}, []int{2, 3, 4}},
+    {"*:3", []imap.Sequence{{End: 3, IsRange: true}}, []int{3, 4}},
+    {"3:10", []imap.Sequence{{Start: 3, End: 10, IsRange: true}}, []int{3, 4}},
+    {"9", []imap.Sequence{{Start: 9}}, nil},
+    {"4,1,1:2", []imap.Sequence{{Start: 4}, {Start: 1}, {Start: 1, End: 2, IsRange: true}}, []int{1, 2, 4}},
+  }
+
+  m := newSeqMap([]int64{10, 20, 30, 40})
+  for _, test := range tests {
+    got := m.Seqs(test.set)
+    if !reflect.DeepEqual(got, test.expect) {
+      t.Errorf("Seqs(%s): got %v, expected %v", test.desc, got, test.expect)
+    }
+  }
+}
+
+func TestSeqMapUIDSeqs(t *testing.T) {
+  tests := []struct {
+    desc string
+    set []imap.Sequence
+    expect []int
+  }{
+    {"20", []imap.Sequence{{Start: 20}}, []int{2}},
+    {"25", []imap.Sequence{{Start: 25}}, nil},
+    {"*", []imap.Sequence{{}}, []int{4}},
+    {"15:30", []imap.Sequence{{Start: 15, End: 30, IsRange: true}}, []int{2, 3}},
+    {"30:15", []imap.Sequence{{Start: 30, End: 15, IsRange: true}}, []int{2, 3}},
+    {"25:*", []imap.Sequence{{Start: 25, IsRange: true}}, []int{3, 4}},
+    // "*" is the highest UID, so a range past it still includes it.
+    {"100:*", []imap.Sequence{{Start: 100, IsRange: true}}, []int{4}},
+    {"10,40", []imap.Sequence{{Start: 10}, {Start: 40}}, []int{1, 4}},
+  }
+
+  m := newSeqMap([]int64{10, 20, 30, 40})
+  for _, test := range tests {
+    got := m.UIDSeqs(test.set)
+    if !reflect.DeepEqual(got, test.expect) {
+      t.Errorf("UIDSeqs(%s): got %v, expected %v", test.desc, got, test.expect)
+    }
+  }
+
+  if got := newSeqMap(nil).UIDSeqs([]imap.Sequence{{}}); got != nil {
+    t.Errorf("UIDSeqs(*) of an empty mailbox: got %v", got)
+  }
+}
+
+func TestSeqMapUIDRanges(t *testing.T) {
+  tests := []struct {
+    seqs []int
+    expect []imap.Sequence
+  }{
+    {nil, nil},
+    {[]int{2}, []imap.Sequence{{Start: 20}}},
+    {[]int{1, 2, 3}, []imap.Sequence{{Start: 10, End: 30, IsRange: true}}},
+    {[]int{1, 3, 4}, []imap.Sequence{{Start: 10}, {Start: 30, End: 40, IsRange: true}}},
+  }
+
+  m := newSeqMap([]int64{10, 20, 30, 40})
+  for _, test := range tests {
+    got := m.UIDRanges(test.seqs)
+    if !reflect.DeepEqual(got, test.expect) {
+      t.Errorf("UIDRanges(%v): got %v, expected %v", test.seqs, got, test.expect)
+    }
+  }
+}
+
+func TestSeqKeyToUIDs(t *testing.T) {
+  f := &fake{
+    seqs: newSeqMap([]int64{10, 20, 30, 40}),
+    recent: []imap.Sequence{{Start: 30, End: 40, IsRange: true}},
+  }
+  seqKey := func(seqs ...imap.Sequence) imap.SearchKey {
+    return &imap.SequenceKey{Seqs: seqs}
+  }
+  uidKey := func(seqs ...imap.Sequence) imap.SearchKey {
+    return &imap.UIDKey{Seqs: seqs}
+  }
+  recent := uidKey(imap.Sequence{Start: 30, End: 40, IsRange: true})
+  seen := &imap.StatusKey{Name: "seen"}
+
+  tests := []struct {
+    desc string
+    key, expect imap.SearchKey
+  }{
+    {"2:3", seqKey(imap.Sequence{Start: 2, End: 3, IsRange: true}),
+      uidKey(imap.Sequence{Start: 20, End: 30, IsRange: true})},
+    {"1,3:*", seqKey(imap.Sequence{Start: 1}, imap.Sequence{Start: 3, IsRange: true}),
+      uidKey(imap.Sequence{Start: 10}, imap.Sequence{Start: 30, End: 40, IsRange: true})},
+    // No messages match, so no UIDs do either.
+    {"9", seqKey(imap.Sequence{Start: 9}), uidKey()},
+    {"NOT OR 1 (SEEN 4)",
+      &imap.NotKey{Arg: &imap.OrKey{
+        Arg1: seqKey(imap.Sequence{Start: 1}),
+        Arg2: &imap.GroupKey{Keys: []imap.SearchKey{seen, seqKey(imap.Sequence{Start: 4})}},
+      }},
+      &imap.NotKey{Arg: &imap.OrKey{
+        Arg1: uidKey(imap.Sequence{Start: 10}),
+        Arg2: &imap.GroupKey{Keys: []imap.SearchKey{seen, uidKey(imap.Sequence{Start: 40})}},
+      }}},
+    {"RECENT", &imap.StatusKey{Name: "recent"}, recent},
+    {"NEW", &imap.StatusKey{Name: "new"},
+      &imap.GroupKey{Keys: []imap.SearchKey{recent, &imap.StatusKey{Name: "unseen"}}}},
+    {"OLD", &imap.StatusKey{Name: "old"}, &imap.NotKey{Arg: recent}},
+    {"SEEN", seen, seen},
+  }
+
+  for _, test := range tests {
+    got := f.seqKeyToUIDs(test.key)
+    if !reflect.DeepEqual(got, test.expect) {
+      t.Errorf("seqKeyToUIDs(%s): got %#v, expected %#v", test.desc, got, test.expect)
+    }
+  }
+}
@@ -3,7 +3,6 @@ package mailer
 import (
   "bytes"
   "net"
-  "github.com/buchanae/mailer/imap"
   "log"
   "github.com/buchanae/mailer/model"
 )
@@ -13,7 +12,7 @@ type smtpHandler struct {
 }
 func (s *smtpHandler) Mail(r net.Addr, from string, to []string, data []byte) {
   buf := bytes.NewBuffer(data)
-  msg, err := s.db.CreateMessage("inbox", buf, []imap.Flag{imap.Recent})
+  msg, err := s.db.CreateMessage(model.Inbox, buf, nil)
   if err != nil {
     log.Println("ERROR:", err)
   }
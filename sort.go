@@ -0,0 +1,99 @@
+package mailer
+
+import (
+  "github.com/buchanae/mailer/imap"
+)
+
+func init() {
+  registerCapability("SORT", "THREAD=ORDEREDSUBJECT", "THREAD=REFERENCES")
+}
+
+// Sort implements the SORT command from RFC 5256.
+func (f *fake) Sort(cmd *imap.SortCommand) {
+  uids, err := f.db.Sort(f.mailbox, cmd.Criteria, f.uidKeys(cmd.Keys))
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "sort error: %v", err)
+    return
+  }
+
+  var ids []int64
+  for _, uid := range uids {
+    if seq, ok := f.seqs.Seq(uid); ok {
+      ids = append(ids, int64(seq))
+    }
+  }
+  imap.Sort(f.w, ids)
+  imap.Complete(f.w, cmd.Tag, "SORT")
+}
+
+func (f *fake) UIDSort(cmd *imap.SortCommand) {
+  uids, err := f.db.Sort(f.mailbox, cmd.Criteria, f.uidKeys(cmd.Keys))
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "sort error: %v", err)
+    return
+  }
+
+  var ids []int64
+  for _, uid := range uids {
+    // Only report messages the session knows about.
+    if _, ok := f.seqs.Seq(uid); ok {
+      ids = append(ids, uid)
+    }
+  }
+  imap.Sort(f.w, ids)
+  imap.Complete(f.w, cmd.Tag, "UID SORT")
+}
+
+// Thread implements the THREAD command from RFC 5256.
+func (f *fake) Thread(cmd *imap.ThreadCommand) {
+  threads, err := f.db.Thread(f.mailbox, cmd.Algorithm, f.uidKeys(cmd.Keys))
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "thread error: %v", err)
+    return
+  }
+  imap.ThreadResponse(f.w, f.threadIDs(threads, false))
+  imap.Complete(f.w, cmd.Tag, "THREAD")
+}
+
+func (f *fake) UIDThread(cmd *imap.ThreadCommand) {
+  threads, err := f.db.Thread(f.mailbox, cmd.Algorithm, f.uidKeys(cmd.Keys))
+  if err != nil {
+    imap.No(f.w, cmd.Tag, "thread error: %v", err)
+    return
+  }
+  imap.ThreadResponse(f.w, f.threadIDs(threads, true))
+  imap.Complete(f.w, cmd.Tag, "UID THREAD")
+}
+
+// threadIDs converts the UIDs in the threads from the database to sequence
+// numbers, unless "uid" is true. Messages the session doesn't know about
+// (i.e. which arrived since the last update) are removed, and replaced
+// by their children, if any.
+func (f *fake) threadIDs(threads []*imap.Thread, uid bool) []*imap.Thread {
+  var out []*imap.Thread
+  for _, t := range threads {
+    t.Children = f.threadIDs(t.Children, uid)
+
+    if t.ID == 0 {
+      // Already a missing message.
+      out = append(out, t)
+      continue
+    }
+
+    seq, ok := f.seqs.Seq(t.ID)
+    switch {
+    case !ok && len(t.Children) == 0:
+    case !ok && len(t.Children) == 1:
+      out = append(out, t.Children[0])
+    case !ok:
+      t.ID = 0
+      out = append(out, t)
+    case !uid:
+      t.ID = int64(seq)
+      out = append(out, t)
+    default:
+      out = append(out, t)
+    }
+  }
+  return out
+}
@@ -0,0 +1,40 @@
+package mailer
+
+import (
+  "bytes"
+  "testing"
+  "github.com/buchanae/mailer/imap"
+)
+
+func TestThreadIDs(t *testing.T) {
+  // The session knows about UIDs 10 to 50, but not 60 or 70,
+  // which arrived since its last update. Unknown messages are replaced
+  // by their only child, or kept as a parent with no ID.
+  threads := func() []*imap.Thread {
+    return []*imap.Thread{
+      {ID: 10, Children: []*imap.Thread{
+        {ID: 20},
+        {ID: 70, Children: []*imap.Thread{{ID: 30}}},
+      }},
+      {ID: 70},
+      {ID: 60, Children: []*imap.Thread{{ID: 40}, {ID: 50}}},
+    }
+  }
+
+  tests := []struct {
+    uid bool
+    expect string
+  }{
+    {false, "* THREAD (1 (2)(3))((4)(5))\r\n"},
+    {true, "* THREAD (10 (20)(30))((40)(50))\r\n"},
+  }
+
+  for _, test := range tests {
+    f := &fake{seqs: newSeqMap([]int64{10, 20, 30, 40, 50})}
+    buf := &bytes.Buffer{}
+    imap.ThreadResponse(buf, f.threadIDs(threads(), test.uid))
+    if buf.String() != test.expect {
+      t.Errorf("threadIDs(uid=%v): expected %q, got %q", test.uid, test.expect, buf.String())
+    }
+  }
+}
@@ -0,0 +1,88 @@
+package mailer
+
+import (
+  "fmt"
+  "github.com/buchanae/mailer/imap"
+)
+
+// connState is the state of an IMAP connection, as described by RFC 3501
+// section 3: https://tools.ietf.org/html/rfc3501#section-3
+type connState int
+
+const (
+  notAuthenticatedState connState = iota
+  authenticatedState
+  selectedState
+  logoutState
+)
+
+func (s connState) String() string {
+  switch s {
+  case notAuthenticatedState:
+    return "not authenticated"
+  case authenticatedState:
+    return "authenticated"
+  case selectedState:
+    return "selected"
+  case logoutState:
+    return "logout"
+  }
+  return "unknown"
+}
+
+// checkState returns an error if the command is not valid
+// in the given connection state.
+func checkState(cmd imap.Command, s connState) error {
+  switch cmd.(type) {
+
+  // Valid in any state.
+  case *imap.CapabilityCommand, *imap.NoopCommand, *imap.LogoutCommand,
+       *imap.IDCommand:
+    if s == logoutState {
+      return fmt.Errorf("connection is logging out")
+    }
+    return nil
+
+  // Valid only in the not authenticated state.
+  case *imap.LoginCommand, *imap.AuthenticateCommand, *imap.StartTLSCommand:
+    if s != notAuthenticatedState {
+      return fmt.Errorf("already authenticated")
+    }
+    return nil
+
+  // Valid only in the authenticated state (RFC 5161).
+  case *imap.EnableCommand:
+    if s != authenticatedState {
+      return fmt.Errorf("ENABLE is only valid before a mailbox is selected")
+    }
+    return nil
+
+  // Valid in the authenticated or selected states.
+  case *imap.SelectCommand, *imap.ExamineCommand, *imap.CreateCommand,
+       *imap.DeleteCommand, *imap.RenameCommand, *imap.SubscribeCommand,
+       *imap.UnsubscribeCommand, *imap.ListCommand, *imap.LsubCommand,
+       *imap.StatusCommand, *imap.AppendCommand, *imap.IdleCommand,
+       *imap.NamespaceCommand:
+    if s != authenticatedState && s != selectedState {
+      return fmt.Errorf("not authenticated")
+    }
+    return nil
+
+  // Valid only in the selected state.
+  case *imap.CheckCommand, *imap.CloseCommand, *imap.ExpungeCommand,
+       *imap.SearchCommand, *imap.FetchCommand, *imap.StoreCommand,
+       *imap.CopyCommand, *imap.UIDFetchCommand, *imap.UIDStoreCommand,
+       *imap.UIDSearchCommand, *imap.UIDCopyCommand,
+       *imap.SortCommand, *imap.ThreadCommand,
+       *imap.UIDSortCommand, *imap.UIDThreadCommand,
+       *imap.MoveCommand, *imap.UIDMoveCommand, *imap.UIDExpungeCommand:
+    if s == notAuthenticatedState {
+      return fmt.Errorf("not authenticated")
+    }
+    if s != selectedState {
+      return fmt.Errorf("no mailbox selected")
+    }
+    return nil
+  }
+  return fmt.Errorf("unknown command")
+}